@@ -0,0 +1,252 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+// Package cloud describes the endpoints and token audiences of the Azure clouds
+package cloud
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-extension-foundation/errorhelper"
+	"github.com/Azure/azure-extension-foundation/metadata"
+)
+
+// Environment holds the endpoints and token audiences of an Azure cloud. Audiences end with a slash where Azure
+// Resource Manager and Azure AD expect it.
+type Environment struct {
+	// Name is the value of the azEnvironment field of the instance metadata in this cloud
+	Name                     string `json:"name"`
+	ResourceManagerEndpoint  string `json:"resourceManagerEndpoint"`
+	ResourceManagerAudience  string `json:"resourceManagerAudience"`
+	ActiveDirectoryAuthority string `json:"activeDirectoryAuthority"`
+	StorageEndpointSuffix    string `json:"storageEndpointSuffix"`
+	StorageAudience          string `json:"storageAudience"`
+	KeyVaultDnsSuffix        string `json:"keyVaultDnsSuffix"`
+	KeyVaultAudience         string `json:"keyVaultAudience"`
+}
+
+var (
+	AzurePublicCloud = Environment{
+		Name:                     "AzurePublicCloud",
+		ResourceManagerEndpoint:  "https://management.azure.com/",
+		ResourceManagerAudience:  "https://management.core.windows.net/",
+		ActiveDirectoryAuthority: "https://login.microsoftonline.com/",
+		StorageEndpointSuffix:    "core.windows.net",
+		StorageAudience:          "https://storage.azure.com/",
+		KeyVaultDnsSuffix:        "vault.azure.net",
+		KeyVaultAudience:         "https://vault.azure.net",
+	}
+	AzureUSGovernmentCloud = Environment{
+		Name:                     "AzureUSGovernmentCloud",
+		ResourceManagerEndpoint:  "https://management.usgovcloudapi.net/",
+		ResourceManagerAudience:  "https://management.core.usgovcloudapi.net/",
+		ActiveDirectoryAuthority: "https://login.microsoftonline.us/",
+		StorageEndpointSuffix:    "core.usgovcloudapi.net",
+		StorageAudience:          "https://storage.azure.com/",
+		KeyVaultDnsSuffix:        "vault.usgovcloudapi.net",
+		KeyVaultAudience:         "https://vault.usgovcloudapi.net",
+	}
+	AzureChinaCloud = Environment{
+		Name:                     "AzureChinaCloud",
+		ResourceManagerEndpoint:  "https://management.chinacloudapi.cn/",
+		ResourceManagerAudience:  "https://management.core.chinacloudapi.cn/",
+		ActiveDirectoryAuthority: "https://login.chinacloudapi.cn/",
+		StorageEndpointSuffix:    "core.chinacloudapi.cn",
+		StorageAudience:          "https://storage.azure.com/",
+		KeyVaultDnsSuffix:        "vault.azure.cn",
+		KeyVaultAudience:         "https://vault.azure.cn",
+	}
+)
+
+// Settings overrides the cloud detected from the instance metadata, extensions embed it in their public settings
+type Settings struct {
+	// Cloud is the name of a known or registered cloud, e.g. AzureUSGovernmentCloud
+	Cloud string `json:"cloud,omitempty"`
+	// CloudEnvironment describes a cloud not known to the extension, e.g. an air-gapped cloud
+	CloudEnvironment *Environment `json:"cloudEnvironment,omitempty"`
+}
+
+// authorityAliases lists other hosts of the Azure AD authority of a cloud, e.g. Key Vault challenges name
+// login.windows.net in the public cloud
+var authorityAliases = map[string][]string{
+	"login.microsoftonline.com": {"login.windows.net", "login.microsoft.com", "sts.windows.net"},
+	"login.microsoftonline.us":  {"login.usgovcloudapi.net"},
+	"login.chinacloudapi.cn":    {"login.partner.microsoftonline.cn"},
+}
+
+var storageServices = map[string]bool{"blob": true, "dfs": true, "file": true, "queue": true, "table": true}
+
+var (
+	mu           sync.RWMutex
+	environments = map[string]Environment{}
+	active       = AzurePublicCloud
+	// initialized is set once Init or SetActiveEnvironment chose the active environment
+	initialized bool
+
+	// initMu serializes Init without blocking ActiveEnvironment while the instance metadata is requested
+	initMu sync.Mutex
+)
+
+func init() {
+	for _, environment := range []Environment{AzurePublicCloud, AzureUSGovernmentCloud, AzureChinaCloud} {
+		environments[strings.ToLower(environment.Name)] = environment
+	}
+	// names used by the Azure CLI
+	environments["azurecloud"] = AzurePublicCloud
+	environments["azureusgovernment"] = AzureUSGovernmentCloud
+}
+
+// RegisterEnvironment makes environment known by its name, e.g. for air-gapped clouds reporting their own
+// azEnvironment
+func RegisterEnvironment(environment Environment) error {
+	if err := environment.Validate(); err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	environments[strings.ToLower(environment.Name)] = environment
+	return nil
+}
+
+// EnvironmentFromName returns the known or registered environment named name, case-insensitively
+func EnvironmentFromName(name string) (Environment, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	environment, ok := environments[strings.ToLower(name)]
+	if !ok {
+		return Environment{}, errorhelper.AddStackToError(fmt.Errorf("unknown cloud %s", name))
+	}
+	return environment, nil
+}
+
+// Detect returns the environment set in settings, or the environment named by the azEnvironment field of the
+// instance metadata. Machines not reporting azEnvironment are in the public cloud.
+func Detect(provider metadata.MetadataProvider, settings Settings) (Environment, error) {
+	if settings.CloudEnvironment != nil {
+		if err := settings.CloudEnvironment.Validate(); err != nil {
+			return Environment{}, err
+		}
+		return *settings.CloudEnvironment, nil
+	}
+	if settings.Cloud != "" {
+		return EnvironmentFromName(settings.Cloud)
+	}
+	vmMetadata, err := provider.GetMetadata()
+	if err != nil {
+		return Environment{}, err
+	}
+	if vmMetadata.Compute.AzEnvironment == "" {
+		return AzurePublicCloud, nil
+	}
+	return EnvironmentFromName(vmMetadata.Compute.AzEnvironment)
+}
+
+// Init activates the environment returned by Detect, once per process: after a successful call or a call to
+// SetActiveEnvironment it returns the active environment without detecting it again. Extensions running outside the
+// public cloud must call it at startup, unless they pass metadata to the msihttpclient constructors which call it
+// themselves, before requesting tokens for the default audiences of the msi package.
+func Init(provider metadata.MetadataProvider, settings Settings) (Environment, error) {
+	initMu.Lock()
+	defer initMu.Unlock()
+	mu.RLock()
+	done, environment := initialized, active
+	mu.RUnlock()
+	if done {
+		return environment, nil
+	}
+
+	environment, err := Detect(provider, settings)
+	if err != nil {
+		return Environment{}, err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !initialized {
+		active = environment
+		initialized = true
+	}
+	return active, nil
+}
+
+// ActiveEnvironment returns the environment the msi and msihttpclient packages use for their default audiences and
+// authority, the public cloud unless Init or SetActiveEnvironment was called
+func ActiveEnvironment() Environment {
+	mu.RLock()
+	defer mu.RUnlock()
+	return active
+}
+
+// SetActiveEnvironment changes the active environment and stops Init from detecting it. Tokens already cached for
+// the default audience aren't invalidated, so it is usually called once at startup.
+func SetActiveEnvironment(environment Environment) error {
+	if err := environment.Validate(); err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	active = environment
+	initialized = true
+	return nil
+}
+
+// Validate returns an error if an endpoint or audience the packages rely on is missing
+func (environment Environment) Validate() error {
+	var missing []string
+	for _, field := range []struct{ name, value string }{
+		{"name", environment.Name},
+		{"resourceManagerEndpoint", environment.ResourceManagerEndpoint},
+		{"resourceManagerAudience", environment.ResourceManagerAudience},
+		{"activeDirectoryAuthority", environment.ActiveDirectoryAuthority},
+	} {
+		if field.value == "" {
+			missing = append(missing, field.name)
+		}
+	}
+	if len(missing) != 0 {
+		return errorhelper.AddStackToError(fmt.Errorf("cloud environment is missing %s", strings.Join(missing, ", ")))
+	}
+	return nil
+}
+
+// AudienceForHost returns the audience of the Azure Resource Manager, Key Vault or storage endpoint host belongs to
+func (environment Environment) AudienceForHost(host string) (string, bool) {
+	host = strings.ToLower(host)
+	if manager := strings.TrimPrefix(strings.TrimSuffix(environment.ResourceManagerEndpoint, "/"), "https://"); manager != "" && host == strings.ToLower(manager) {
+		return environment.ResourceManagerAudience, true
+	}
+	if environment.KeyVaultDnsSuffix != "" && environment.KeyVaultAudience != "" && strings.HasSuffix(host, "."+strings.ToLower(environment.KeyVaultDnsSuffix)) {
+		return environment.KeyVaultAudience, true
+	}
+	if environment.StorageEndpointSuffix != "" && environment.StorageAudience != "" {
+		// storage hosts are {account}.{service}.{suffix}
+		if prefix := strings.TrimSuffix(host, "."+strings.ToLower(environment.StorageEndpointSuffix)); prefix != host {
+			labels := strings.Split(prefix, ".")
+			if len(labels) == 2 && storageServices[labels[1]] {
+				return environment.StorageAudience, true
+			}
+		}
+	}
+	return "", false
+}
+
+// IsAuthorityHost returns true if host is the host of the Azure AD authority of environment or one of its aliases
+func (environment Environment) IsAuthorityHost(host string) bool {
+	authority, err := url.Parse(environment.ActiveDirectoryAuthority)
+	if err != nil || authority.Hostname() == "" {
+		return false
+	}
+	authorityHost := strings.ToLower(authority.Hostname())
+	host = strings.ToLower(host)
+	if host == authorityHost {
+		return true
+	}
+	for _, alias := range authorityAliases[authorityHost] {
+		if host == alias {
+			return true
+		}
+	}
+	return false
+}
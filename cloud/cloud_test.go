@@ -0,0 +1,142 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package cloud
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Azure/azure-extension-foundation/metadata"
+)
+
+type fakeMetadataProvider struct {
+	azEnvironment string
+	err           error
+}
+
+func (provider fakeMetadataProvider) GetMetadata() (metadata.Metadata, error) {
+	return metadata.Metadata{Compute: metadata.MetadataCompute{AzEnvironment: provider.azEnvironment}}, provider.err
+}
+
+func TestDetect(t *testing.T) {
+	custom := Environment{
+		Name:                     "AirGapped",
+		ResourceManagerEndpoint:  "https://management.airgapped.example/",
+		ResourceManagerAudience:  "https://management.airgapped.example/",
+		ActiveDirectoryAuthority: "https://login.airgapped.example/",
+	}
+	for _, test := range []struct {
+		provider fakeMetadataProvider
+		settings Settings
+		expected string
+	}{
+		{fakeMetadataProvider{azEnvironment: "AzureUSGovernmentCloud"}, Settings{}, "AzureUSGovernmentCloud"},
+		{fakeMetadataProvider{azEnvironment: "azurechinacloud"}, Settings{}, "AzureChinaCloud"},
+		{fakeMetadataProvider{}, Settings{}, "AzurePublicCloud"},
+		{fakeMetadataProvider{azEnvironment: "AzurePublicCloud"}, Settings{Cloud: "AzureUSGovernment"}, "AzureUSGovernmentCloud"},
+		{fakeMetadataProvider{err: fmt.Errorf("unreachable")}, Settings{CloudEnvironment: &custom}, "AirGapped"},
+	} {
+		environment, err := Detect(test.provider, test.settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if environment.Name != test.expected {
+			t.Fatalf("detected %s instead of %s", environment.Name, test.expected)
+		}
+	}
+
+	if _, err := Detect(fakeMetadataProvider{azEnvironment: "AirGapped"}, Settings{}); err == nil {
+		t.Fatal("unknown cloud was accepted")
+	}
+	if err := RegisterEnvironment(custom); err != nil {
+		t.Fatal(err)
+	}
+	if environment, err := Detect(fakeMetadataProvider{azEnvironment: "AirGapped"}, Settings{}); err != nil || environment != custom {
+		t.Fatalf("registered cloud wasn't detected: %v", err)
+	}
+	if environment, err := Detect(fakeMetadataProvider{}, Settings{CloudEnvironment: &Environment{Name: "incomplete"}}); err == nil || environment != (Environment{}) {
+		t.Fatal("incomplete cloud was accepted")
+	}
+}
+
+func TestActiveEnvironment(t *testing.T) {
+	if ActiveEnvironment() != AzurePublicCloud {
+		t.Fatal("public cloud isn't active by default")
+	}
+	if err := SetActiveEnvironment(Environment{Name: "incomplete"}); err == nil {
+		t.Fatal("incomplete cloud was activated")
+	}
+	if err := SetActiveEnvironment(AzureChinaCloud); err != nil {
+		t.Fatal(err)
+	}
+	defer SetActiveEnvironment(AzurePublicCloud)
+	if ActiveEnvironment().ResourceManagerAudience != "https://management.core.chinacloudapi.cn/" {
+		t.Fatalf("unexpected active cloud %+v", ActiveEnvironment())
+	}
+}
+
+func TestInitDetectsOnce(t *testing.T) {
+	defer func() {
+		SetActiveEnvironment(AzurePublicCloud)
+		mu.Lock()
+		initialized = false
+		mu.Unlock()
+	}()
+	mu.Lock()
+	initialized = false
+	mu.Unlock()
+
+	if _, err := Init(fakeMetadataProvider{err: fmt.Errorf("unreachable")}, Settings{}); err == nil {
+		t.Fatal("failed detection was ignored")
+	}
+	if ActiveEnvironment() != AzurePublicCloud {
+		t.Fatalf("failed detection changed the active cloud to %s", ActiveEnvironment().Name)
+	}
+	if environment, err := Init(fakeMetadataProvider{azEnvironment: "AzureUSGovernmentCloud"}, Settings{}); err != nil || environment.Name != "AzureUSGovernmentCloud" {
+		t.Fatalf("unexpected environment %s: %v", environment.Name, err)
+	}
+	if ActiveEnvironment().Name != "AzureUSGovernmentCloud" {
+		t.Fatalf("detected cloud isn't active, %s is", ActiveEnvironment().Name)
+	}
+	if environment, err := Init(fakeMetadataProvider{azEnvironment: "AzureChinaCloud"}, Settings{}); err != nil || environment.Name != "AzureUSGovernmentCloud" {
+		t.Fatalf("cloud was detected again: %s %v", environment.Name, err)
+	}
+}
+
+func TestAudienceForHost(t *testing.T) {
+	for host, expected := range map[string]string{
+		"management.azure.com":                "https://management.core.windows.net/",
+		"MyVault.Vault.Azure.Net":             "https://vault.azure.net",
+		"account.blob.core.windows.net":       "https://storage.azure.com/",
+		"account.dfs.core.windows.net":        "https://storage.azure.com/",
+		"namespace.servicebus.windows.net":    "",
+		"management.core.windows.net":         "",
+		"account.blob.core.usgovcloudapi.net": "",
+	} {
+		audience, ok := AzurePublicCloud.AudienceForHost(host)
+		if audience != expected || ok != (expected != "") {
+			t.Fatalf("unexpected audience %q for %s", audience, host)
+		}
+	}
+}
+
+func TestIsAuthorityHost(t *testing.T) {
+	for _, test := range []struct {
+		environment Environment
+		host        string
+		expected    bool
+	}{
+		{AzurePublicCloud, "login.microsoftonline.com", true},
+		{AzurePublicCloud, "Login.Windows.Net", true},
+		{AzurePublicCloud, "sts.windows.net", true},
+		{AzurePublicCloud, "login.microsoftonline.us", false},
+		{AzureUSGovernmentCloud, "login.usgovcloudapi.net", true},
+		{AzureUSGovernmentCloud, "login.windows.net", false},
+		{AzureChinaCloud, "login.partner.microsoftonline.cn", true},
+	} {
+		if test.environment.IsAuthorityHost(test.host) != test.expected {
+			t.Fatalf("%s is an authority of %s: %v", test.host, test.environment.Name, !test.expected)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+// Command imdsemulator serves the instance metadata service emulator for manual testing, e.g.
+//
+//	imdsemulator -address 127.0.0.1:8080 -metadata metadata.json
+//	IMDS_ENDPOINT=http://127.0.0.1:8080 ./extension
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-extension-foundation/imdstest"
+	"github.com/Azure/azure-extension-foundation/metadata"
+)
+
+func main() {
+	address := flag.String("address", "127.0.0.1:8080", "address to listen on")
+	metadataFile := flag.String("metadata", "", "json file with the instance metadata to serve")
+	userDataFile := flag.String("user-data", "", "file with the user data to serve")
+	tokenLifetime := flag.Duration("token-lifetime", time.Hour, "lifetime of issued tokens")
+	userAssigned := flag.String("user-assigned-client-ids", "", "comma separated client ids of user assigned identities")
+	flag.Parse()
+
+	options := imdstest.Options{TokenLifetime: *tokenLifetime}
+	if *metadataFile != "" {
+		data, err := ioutil.ReadFile(*metadataFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := json.Unmarshal(data, &options.Metadata); err != nil {
+			log.Fatalf("unable to deserialize %s: %v", *metadataFile, err)
+		}
+	} else {
+		options.Metadata = metadata.Metadata{Compute: metadata.MetadataCompute{
+			Name:              "emulated-vm",
+			Location:          "westus",
+			OsType:            runtimeOsType(),
+			ResourceGroupName: "emulated-rg",
+			SubscriptionId:    "00000000-0000-0000-0000-000000000000",
+			VmId:              "00000000-0000-0000-0000-000000000001",
+		}}
+	}
+	if *userDataFile != "" {
+		data, err := ioutil.ReadFile(*userDataFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		options.UserData = data
+	}
+	for _, clientId := range strings.Split(*userAssigned, ",") {
+		if clientId != "" {
+			options.UserAssignedIdentities = append(options.UserAssignedIdentities, imdstest.Identity{ClientId: clientId, ObjectId: clientId})
+		}
+	}
+
+	emulator, err := imdstest.NewEmulator(options)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintf(os.Stderr, "serving the instance metadata service emulator, export %s=http://%s\n", metadata.ImdsEndpointEnvVar, *address)
+	log.Fatal(http.ListenAndServe(*address, emulator))
+}
+
+func runtimeOsType() string {
+	if runtime.GOOS == "windows" {
+		return "Windows"
+	}
+	return "Linux"
+}
@@ -0,0 +1,112 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package httputil
+
+import (
+	"net/http"
+	"strings"
+)
+
+// BearerChallenge is the Bearer challenge of a WWW-Authenticate header, as returned by Key Vault and Storage
+// when a request is not authorized
+type BearerChallenge struct {
+	// AuthorizationUri is the authority tokens must be requested from, from either authorization_uri or authorization
+	AuthorizationUri string
+	// ResourceId is the audience requested with resource or resource_id
+	ResourceId string
+	Scope      string
+	// Parameters holds every parameter of the challenge with lower case names
+	Parameters map[string]string
+}
+
+// Resource returns the audience tokens must be issued for, derived from the scope when no resource is given
+func (challenge BearerChallenge) Resource() string {
+	if challenge.ResourceId != "" {
+		return challenge.ResourceId
+	}
+	return strings.TrimSuffix(strings.Fields(challenge.Scope + " ")[0], "/.default")
+}
+
+// ParseBearerChallenge returns the first Bearer challenge of the WWW-Authenticate headers of a response
+func ParseBearerChallenge(header http.Header) (BearerChallenge, bool) {
+	for _, value := range header.Values("WWW-Authenticate") {
+		for _, challenge := range parseAuthenticateHeader(value) {
+			if !strings.EqualFold(challenge.scheme, "Bearer") {
+				continue
+			}
+			bearer := BearerChallenge{Parameters: challenge.parameters}
+			bearer.AuthorizationUri = firstNonEmpty(challenge.parameters["authorization_uri"], challenge.parameters["authorization"])
+			bearer.ResourceId = firstNonEmpty(challenge.parameters["resource"], challenge.parameters["resource_id"])
+			bearer.Scope = challenge.parameters["scope"]
+			return bearer, true
+		}
+	}
+	return BearerChallenge{}, false
+}
+
+type authenticateChallenge struct {
+	scheme     string
+	parameters map[string]string
+}
+
+// parseAuthenticateHeader splits a WWW-Authenticate header into its challenges, a header may hold several
+// comma separated challenges each followed by its comma separated parameters
+func parseAuthenticateHeader(value string) []authenticateChallenge {
+	var challenges []authenticateChallenge
+	for i := 0; i < len(value); {
+		for i < len(value) && (value[i] == ' ' || value[i] == ',' || value[i] == '\t') {
+			i++
+		}
+		start := i
+		for i < len(value) && value[i] != ' ' && value[i] != ',' && value[i] != '=' && value[i] != '\t' {
+			i++
+		}
+		token := value[start:i]
+		if token == "" {
+			if i < len(value) {
+				// stray separator
+				i++
+			}
+			continue
+		}
+		for i < len(value) && (value[i] == ' ' || value[i] == '\t') {
+			i++
+		}
+		if i >= len(value) || value[i] != '=' || len(challenges) == 0 {
+			challenges = append(challenges, authenticateChallenge{scheme: token, parameters: make(map[string]string)})
+			continue
+		}
+
+		// parameter of the current challenge
+		i++
+		for i < len(value) && (value[i] == ' ' || value[i] == '\t') {
+			i++
+		}
+		var parameter strings.Builder
+		if i < len(value) && value[i] == '"' {
+			for i++; i < len(value) && value[i] != '"'; i++ {
+				if value[i] == '\\' && i+1 < len(value) {
+					i++
+				}
+				parameter.WriteByte(value[i])
+			}
+			i++
+		} else {
+			for ; i < len(value) && value[i] != ',' && value[i] != ' ' && value[i] != '\t'; i++ {
+				parameter.WriteByte(value[i])
+			}
+		}
+		challenges[len(challenges)-1].parameters[strings.ToLower(token)] = strings.TrimSpace(parameter.String())
+	}
+	return challenges
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
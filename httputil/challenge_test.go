@@ -0,0 +1,41 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package httputil
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseBearerChallenge(t *testing.T) {
+	header := http.Header{}
+	header.Add("WWW-Authenticate", `Basic realm="storage"`)
+	header.Add("WWW-Authenticate", `Bearer authorization="https://login.microsoftonline.com/tenant", resource="https://vault.azure.net"`)
+
+	challenge, ok := ParseBearerChallenge(header)
+	if !ok {
+		t.Fatal("challenge was not found")
+	}
+	if challenge.AuthorizationUri != "https://login.microsoftonline.com/tenant" || challenge.Resource() != "https://vault.azure.net" {
+		t.Fatalf("unexpected challenge %+v", challenge)
+	}
+}
+
+func TestParseBearerChallengeScopeAndResourceId(t *testing.T) {
+	header := http.Header{"Www-Authenticate": {`Basic realm="x", Bearer authorization_uri=https://login.microsoftonline.com/tenant/oauth2/authorize, scope="https://vault.azure.net/.default"`}}
+	challenge, ok := ParseBearerChallenge(header)
+	if !ok || challenge.Resource() != "https://vault.azure.net" || challenge.AuthorizationUri != "https://login.microsoftonline.com/tenant/oauth2/authorize" {
+		t.Fatalf("unexpected challenge %+v %v", challenge, ok)
+	}
+
+	header = http.Header{"Www-Authenticate": {`Bearer authorization_uri=https://login.microsoftonline.com/tenant/oauth2/authorize resource_id=https://storage.azure.com`}}
+	challenge, ok = ParseBearerChallenge(header)
+	if !ok || challenge.Resource() != "https://storage.azure.com" || challenge.AuthorizationUri != "https://login.microsoftonline.com/tenant/oauth2/authorize" {
+		t.Fatalf("unexpected challenge %+v %v", challenge, ok)
+	}
+
+	if _, ok := ParseBearerChallenge(http.Header{"Www-Authenticate": {`Basic realm="x"`}}); ok {
+		t.Fatal("basic challenge was returned as bearer challenge")
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package httputil
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+type CircuitState int
+
+const (
+	CircuitClosed CircuitState = iota
+	CircuitOpen
+	CircuitHalfOpen
+)
+
+func (state CircuitState) String() string {
+	switch state {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// ErrCircuitOpen is returned instead of issuing a request while the circuit is open
+var ErrCircuitOpen = errors.New("circuit breaker is open, request was not sent")
+
+// CircuitBreaker stops sending requests to an endpoint after failureThreshold consecutive failures.
+// Once openDuration has elapsed a single probe request is let through (half-open); its outcome either
+// closes the circuit again or re-opens it for another openDuration.
+type CircuitBreaker struct {
+	mu               sync.Mutex
+	failureThreshold int
+	openDuration     time.Duration
+	state            CircuitState
+	failures         int
+	openedAt         time.Time
+	probeInFlight    bool
+}
+
+func NewCircuitBreaker(failureThreshold int, openDuration time.Duration) *CircuitBreaker {
+	if failureThreshold < 1 {
+		panic("failureThreshold must be at least 1")
+	}
+	return &CircuitBreaker{failureThreshold: failureThreshold, openDuration: openDuration}
+}
+
+// State returns the current state of the circuit
+func (breaker *CircuitBreaker) State() CircuitState {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	if breaker.state == CircuitOpen && time.Since(breaker.openedAt) >= breaker.openDuration {
+		return CircuitHalfOpen
+	}
+	return breaker.state
+}
+
+// Allow returns ErrCircuitOpen if a request must not be sent right now.
+// Every successful call to Allow must be followed by RecordSuccess or RecordFailure.
+func (breaker *CircuitBreaker) Allow() error {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	switch breaker.state {
+	case CircuitOpen:
+		if time.Since(breaker.openedAt) < breaker.openDuration {
+			return ErrCircuitOpen
+		}
+		breaker.state = CircuitHalfOpen
+		breaker.probeInFlight = true
+		return nil
+	case CircuitHalfOpen:
+		if breaker.probeInFlight {
+			return ErrCircuitOpen
+		}
+		breaker.probeInFlight = true
+		return nil
+	default:
+		return nil
+	}
+}
+
+// RecordSuccess closes the circuit and resets the failure count
+func (breaker *CircuitBreaker) RecordSuccess() {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	breaker.state = CircuitClosed
+	breaker.failures = 0
+	breaker.probeInFlight = false
+}
+
+// RecordFailure counts a failure and opens the circuit when the threshold is reached or the probe failed
+func (breaker *CircuitBreaker) RecordFailure() {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	breaker.failures++
+	if breaker.state == CircuitHalfOpen || breaker.failures >= breaker.failureThreshold {
+		breaker.state = CircuitOpen
+		breaker.openedAt = time.Now()
+	}
+	breaker.probeInFlight = false
+}
+
+// HostCircuitBreaker keeps an independent circuit for every host
+type HostCircuitBreaker struct {
+	mu               sync.Mutex
+	failureThreshold int
+	openDuration     time.Duration
+	breakers         map[string]*CircuitBreaker
+}
+
+func NewHostCircuitBreaker(failureThreshold int, openDuration time.Duration) *HostCircuitBreaker {
+	if failureThreshold < 1 {
+		panic("failureThreshold must be at least 1")
+	}
+	return &HostCircuitBreaker{
+		failureThreshold: failureThreshold,
+		openDuration:     openDuration,
+		breakers:         make(map[string]*CircuitBreaker),
+	}
+}
+
+// ForHost returns the circuit used for host, creating it on first use
+func (hostBreaker *HostCircuitBreaker) ForHost(host string) *CircuitBreaker {
+	hostBreaker.mu.Lock()
+	defer hostBreaker.mu.Unlock()
+	breaker, ok := hostBreaker.breakers[host]
+	if !ok {
+		breaker = NewCircuitBreaker(hostBreaker.failureThreshold, hostBreaker.openDuration)
+		hostBreaker.breakers[host] = breaker
+	}
+	return breaker
+}
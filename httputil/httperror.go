@@ -0,0 +1,67 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package httputil
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// maximum number of response body bytes kept in an HTTPError
+const maxErrorBodySnippetLength = 1024
+
+// HTTPError describes a response with an unexpected status code
+type HTTPError struct {
+	StatusCode int
+	Header     http.Header
+	// Body holds at most the first 1024 bytes of the response body
+	Body string
+	// Code and Message are taken from the Azure error envelope {"error":{"code":...,"message":...}} or from the
+	// OAuth style {"error":...,"error_description":...} body, when the response carried one
+	Code    string
+	Message string
+}
+
+// NewHTTPError builds an HTTPError from a response, extracting the Azure error envelope from body if present
+func NewHTTPError(statusCode int, header http.Header, body []byte) *HTTPError {
+	httpErr := &HTTPError{StatusCode: statusCode, Header: header}
+	if len(body) > maxErrorBodySnippetLength {
+		httpErr.Body = string(body[:maxErrorBodySnippetLength])
+	} else {
+		httpErr.Body = string(body)
+	}
+
+	var envelope struct {
+		Error            json.RawMessage `json:"error"`
+		ErrorDescription string          `json:"error_description"`
+	}
+	if json.Unmarshal(body, &envelope) != nil || len(envelope.Error) == 0 {
+		return httpErr
+	}
+	var azureError struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(envelope.Error, &azureError) == nil {
+		httpErr.Code = azureError.Code
+		httpErr.Message = azureError.Message
+	} else if json.Unmarshal(envelope.Error, &httpErr.Code) == nil {
+		httpErr.Message = envelope.ErrorDescription
+	}
+	return httpErr
+}
+
+func (httpErr *HTTPError) Error() string {
+	switch {
+	case httpErr.Code != "" && httpErr.Message != "":
+		return fmt.Sprintf("http request failed with status code %d: %s: %s", httpErr.StatusCode, httpErr.Code, httpErr.Message)
+	case httpErr.Code != "":
+		return fmt.Sprintf("http request failed with status code %d: %s", httpErr.StatusCode, httpErr.Code)
+	case httpErr.Body != "":
+		return fmt.Sprintf("http request failed with status code %d: %s", httpErr.StatusCode, httpErr.Body)
+	default:
+		return fmt.Sprintf("http request failed with status code %d", httpErr.StatusCode)
+	}
+}
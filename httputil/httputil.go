@@ -5,11 +5,13 @@ package httputil
 
 import (
 	"bytes"
-	"crypto/tls"
 	"github.com/Azure/azure-extension-foundation/errorhelper"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 )
 
@@ -18,6 +20,8 @@ const (
 	OperationPost   = "POST"
 	OperationDelete = "DELETE"
 	OperationPut    = "PUT"
+	OperationPatch  = "PATCH"
+	OperationHead   = "HEAD"
 )
 
 type HttpClient interface {
@@ -25,6 +29,25 @@ type HttpClient interface {
 	Post(url string, headers map[string]string, payload []byte) (responseCode int, body []byte, err error)
 	Put(url string, headers map[string]string, payload []byte) (responseCode int, body []byte, err error)
 	Delete(url string, headers map[string]string, payload []byte) (responseCode int, body []byte, err error)
+	Do(spec RequestSpec) (*Response, error)
+}
+
+// RequestSpec describes a request issued through HttpClient.Do
+type RequestSpec struct {
+	Method string
+	URL    string
+	Header http.Header
+	// Query is merged into the query string of URL
+	Query url.Values
+	// Body is read completely before the first attempt so that it can be replayed on retries
+	Body io.Reader
+}
+
+// Response is returned by HttpClient.Do, the caller must close Body
+type Response struct {
+	StatusCode int
+	Header     http.Header
+	Body       io.ReadCloser
 }
 
 // for testing
@@ -99,36 +122,29 @@ func IsSuccessStatusCode(statusCode int) bool {
 	}
 }
 
+// NewSecureHttpClient returns a client with the TLS defaults of TLSOptions
 func NewSecureHttpClient(retryBehavior RetryBehavior) HttpClient {
 	if retryBehavior == nil {
 		panic("Retry policy must be specified")
 	}
 
-	tlsConfig := &tls.Config{
-		Renegotiation: tls.RenegotiateFreelyAsClient,
-	}
-
-	transport := &http.Transport{TLSClientConfig: tlsConfig}
+	// the default options can't fail to build
+	transport, _ := NewHttpTransport(TLSOptions{})
 	httpClient := &http.Client{Transport: transport}
 	return &Client{httpClient, retryBehavior}
 }
 
+// NewSecureHttpClientWithCertificates returns a client authenticating with the client certificate and key files,
+// with the TLS defaults of TLSOptions
 func NewSecureHttpClientWithCertificates(certificate string, key string, retryBehavior RetryBehavior) HttpClient {
 	if retryBehavior == nil {
 		panic("Retry policy must be specified")
 	}
 
-	cert, err := tls.LoadX509KeyPair(certificate, key)
+	transport, err := NewHttpTransport(TLSOptions{CertificateFile: certificate, KeyFile: key})
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	tlsConfig := &tls.Config{
-		Certificates:  []tls.Certificate{cert},
-		Renegotiation: tls.RenegotiateFreelyAsClient,
-	}
-
-	transport := &http.Transport{TLSClientConfig: tlsConfig}
 	httpClient := &http.Client{Transport: transport}
 	return &Client{httpClient, retryBehavior}
 }
@@ -138,18 +154,10 @@ func NewInsecureHttpClientWithCertificates(certificate string, key string, retry
 		panic("Retry policy must be specified")
 	}
 
-	cert, err := tls.LoadX509KeyPair(certificate, key)
+	transport, err := NewHttpTransport(TLSOptions{CertificateFile: certificate, KeyFile: key, InsecureSkipVerify: true})
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	tlsConfig := &tls.Config{
-		Certificates:       []tls.Certificate{cert},
-		InsecureSkipVerify: true,
-		Renegotiation:      tls.RenegotiateFreelyAsClient,
-	}
-
-	transport := &http.Transport{TLSClientConfig: tlsConfig}
 	httpClient := &http.Client{Transport: transport}
 
 	return &Client{httpClient, retryBehavior}
@@ -175,14 +183,11 @@ func (client *Client) Delete(url string, headers map[string]string, payload []by
 	return client.issueRequest(OperationDelete, url, headers, bytes.NewBuffer(payload))
 }
 
-func (client *Client) issueRequest(operation string, url string, headers map[string]string, payload *bytes.Buffer) (int, []byte, error) {
-	request, err := http.NewRequest(operation, url, nil)
-	if payload != nil && payload.Len() != 0 {
-		request, err = http.NewRequest(operation, url, payload)
-	}
-
-	for key, value := range headers {
-		request.Header.Add(key, value)
+// Do issues the request described by spec, retrying according to the client's retry behavior
+func (client *Client) Do(spec RequestSpec) (*Response, error) {
+	request, err := NewHttpRequest(spec)
+	if err != nil {
+		return nil, errorhelper.AddStackToError(err)
 	}
 
 	res, err := client.httpClient.Do(request)
@@ -192,6 +197,10 @@ func (client *Client) issueRequest(operation string, url string, headers map[str
 	} else if err == nil && res != nil {
 		// there was no error, so look at the status code to retry
 		for i := 1; client.retryBehavior(res.StatusCode, i); i++ {
+			res.Body.Close()
+			if err = RewindRequestBody(request); err != nil {
+				break
+			}
 			res, err = client.httpClient.Do(request)
 			if err != nil {
 				break
@@ -200,7 +209,15 @@ func (client *Client) issueRequest(operation string, url string, headers map[str
 	}
 
 	if err != nil {
-		return -1, nil, errorhelper.AddStackToError(err)
+		return nil, errorhelper.AddStackToError(err)
+	}
+	return &Response{StatusCode: res.StatusCode, Header: res.Header, Body: res.Body}, nil
+}
+
+func (client *Client) issueRequest(operation string, url string, headers map[string]string, payload *bytes.Buffer) (int, []byte, error) {
+	res, err := client.Do(newRequestSpec(operation, url, headers, payload))
+	if err != nil {
+		return -1, nil, err
 	}
 
 	body, err := ioutil.ReadAll(res.Body)
@@ -212,3 +229,85 @@ func (client *Client) issueRequest(operation string, url string, headers map[str
 
 	return code, body, nil
 }
+
+// NewHttpRequest builds an http.Request from spec. The body is buffered so that RewindRequestBody can replay it.
+func NewHttpRequest(spec RequestSpec) (*http.Request, error) {
+	requestUrl, err := url.Parse(spec.URL)
+	if err != nil {
+		return nil, err
+	}
+	if len(spec.Query) != 0 {
+		query := requestUrl.Query()
+		for key, values := range spec.Query {
+			for _, value := range values {
+				query.Add(key, value)
+			}
+		}
+		requestUrl.RawQuery = query.Encode()
+	}
+
+	var body io.Reader
+	if spec.Body != nil {
+		payload, err := ioutil.ReadAll(spec.Body)
+		if err != nil {
+			return nil, err
+		}
+		if len(payload) != 0 {
+			body = bytes.NewReader(payload)
+		}
+	}
+
+	request, err := http.NewRequest(spec.Method, requestUrl.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range spec.Header {
+		for _, value := range values {
+			request.Header.Add(key, value)
+		}
+	}
+	return request, nil
+}
+
+// RewindRequestBody resets the body of a request built by NewHttpRequest so that it can be sent again
+func RewindRequestBody(request *http.Request) error {
+	if request.GetBody == nil {
+		return nil
+	}
+	body, err := request.GetBody()
+	if err != nil {
+		return err
+	}
+	request.Body = body
+	return nil
+}
+
+func newRequestSpec(operation string, url string, headers map[string]string, payload *bytes.Buffer) RequestSpec {
+	spec := RequestSpec{Method: operation, URL: url, Header: http.Header{}}
+	for key, value := range headers {
+		spec.Header.Add(key, value)
+	}
+	if payload != nil && payload.Len() != 0 {
+		spec.Body = payload
+	}
+	return spec
+}
+
+// ParseRetryAfter returns the delay requested by a Retry-After header, given either in seconds or as an HTTP date
+func ParseRetryAfter(header http.Header) (time.Duration, bool) {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		delay := time.Until(date)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+	return 0, false
+}
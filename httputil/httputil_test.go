@@ -5,7 +5,10 @@ package httputil
 
 import (
 	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
 	"testing"
 )
 
@@ -49,3 +52,61 @@ func TestRetryThrice(t *testing.T) {
 		t.Fatal("httpclient didn't retry thrice")
 	}
 }
+
+func TestDoSendsSpecAndExposesResponseHeaders(t *testing.T) {
+	attemptCount := 0
+	mockClient := mockHttpClient{&attemptCount, func(i *int, req *http.Request) (*http.Response, error) {
+		if req.Method != OperationPatch {
+			t.Fatalf("unexpected method %s", req.Method)
+		}
+		if req.URL.Query().Get("existing") != "1" || req.URL.Query().Get("added") != "2" {
+			t.Fatalf("query was not merged: %s", req.URL.RawQuery)
+		}
+		if values := req.Header.Values("X-Multi"); len(values) != 2 {
+			t.Fatalf("multi valued header was not sent, got %v", values)
+		}
+		payload, _ := ioutil.ReadAll(req.Body)
+		if string(payload) != "patch body" {
+			t.Fatalf("unexpected body %q", payload)
+		}
+		return &http.Response{StatusCode: 200, Header: http.Header{"Etag": {"abc"}}, Body: noBody{}}, nil
+	}}
+	client := Client{&mockClient, NoRetry}
+
+	res, err := client.Do(RequestSpec{
+		Method: OperationPatch,
+		URL:    "http://foo.bar/path?existing=1",
+		Header: http.Header{"X-Multi": {"a", "b"}},
+		Query:  url.Values{"added": {"2"}},
+		Body:   strings.NewReader("patch body"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 || res.Header.Get("Etag") != "abc" {
+		t.Fatalf("unexpected response %d %v", res.StatusCode, res.Header)
+	}
+}
+
+func TestDoReplaysBodyOnRetry(t *testing.T) {
+	attemptCount := 0
+	mockClient := mockHttpClient{&attemptCount, func(i *int, req *http.Request) (*http.Response, error) {
+		payload, _ := ioutil.ReadAll(req.Body)
+		if string(payload) != "payload" {
+			t.Fatalf("attempt %d sent body %q", *i, payload)
+		}
+		return &http.Response{StatusCode: 429, Body: noBody{}}, nil
+	}}
+	retryOnce := func(statusCode int, i int) bool { return i < 2 }
+	client := Client{&mockClient, retryOnce}
+
+	res, err := client.Do(RequestSpec{Method: OperationPost, URL: "http://foo.bar", Body: strings.NewReader("payload")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if attemptCount != 2 {
+		t.Fatalf("expected 2 attempts, got %d", attemptCount)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package httputil
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/Azure/azure-extension-foundation/errorhelper"
+)
+
+const jsonContentType = "application/json"
+
+type jsonOptions struct {
+	isSuccessStatusCode func(statusCode int) bool
+}
+
+// JSONOption customizes GetJSON, PostJSON and PutJSON
+type JSONOption func(options *jsonOptions)
+
+// AcceptAnySuccessStatusCode makes the JSON helpers treat every 2xx status code as success instead of only 200
+// and 201. Responses without a body (e.g. 204) decode to the zero value.
+func AcceptAnySuccessStatusCode() JSONOption {
+	return func(options *jsonOptions) {
+		options.isSuccessStatusCode = IsAnySuccessStatusCode
+	}
+}
+
+// IsAnySuccessStatusCode returns true for the whole 2xx range
+func IsAnySuccessStatusCode(statusCode int) bool {
+	return statusCode >= 200 && statusCode <= 299
+}
+
+// GetJSON issues a get request and decodes the JSON response into a T.
+// A response with an unexpected status code is returned as an *HTTPError.
+func GetJSON[T any](client HttpClient, url string, headers map[string]string, options ...JSONOption) (T, error) {
+	return doJSON[T](client, RequestSpec{Method: OperationGet, URL: url, Header: jsonHeaders(headers, false)}, options)
+}
+
+// PostJSON encodes payload as JSON, issues a post request and decodes the JSON response into a T.
+// A response with an unexpected status code is returned as an *HTTPError.
+func PostJSON[T any](client HttpClient, url string, headers map[string]string, payload interface{}, options ...JSONOption) (T, error) {
+	var retval T
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return retval, errorhelper.AddStackToError(fmt.Errorf("unable to serialize request payload: %v", err))
+	}
+	return doJSON[T](client, RequestSpec{Method: OperationPost, URL: url, Header: jsonHeaders(headers, true), Body: bytes.NewReader(encoded)}, options)
+}
+
+// PutJSON encodes payload as JSON, issues a put request and decodes the JSON response into a T.
+// A response with an unexpected status code is returned as an *HTTPError.
+func PutJSON[T any](client HttpClient, url string, headers map[string]string, payload interface{}, options ...JSONOption) (T, error) {
+	var retval T
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return retval, errorhelper.AddStackToError(fmt.Errorf("unable to serialize request payload: %v", err))
+	}
+	return doJSON[T](client, RequestSpec{Method: OperationPut, URL: url, Header: jsonHeaders(headers, true), Body: bytes.NewReader(encoded)}, options)
+}
+
+// jsonHeaders copies headers and adds the JSON content negotiation headers the caller didn't set
+func jsonHeaders(headers map[string]string, hasPayload bool) http.Header {
+	retval := http.Header{}
+	retval.Set("Accept", jsonContentType)
+	if hasPayload {
+		retval.Set("Content-Type", jsonContentType)
+	}
+	for key, value := range headers {
+		retval.Set(key, value)
+	}
+	return retval
+}
+
+func doJSON[T any](client HttpClient, spec RequestSpec, options []JSONOption) (T, error) {
+	var retval T
+	res, err := client.Do(spec)
+	if err != nil {
+		return retval, err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return retval, errorhelper.AddStackToError(err)
+	}
+	code := res.StatusCode
+
+	opts := jsonOptions{isSuccessStatusCode: IsSuccessStatusCode}
+	for _, option := range options {
+		option(&opts)
+	}
+	if !opts.isSuccessStatusCode(code) {
+		return retval, NewHTTPError(code, res.Header, body)
+	}
+
+	if len(body) == 0 {
+		return retval, nil
+	}
+	if err := json.Unmarshal(body, &retval); err != nil {
+		return retval, errorhelper.AddStackToError(fmt.Errorf("unable to deserialize response: %v", err))
+	}
+	return retval, nil
+}
@@ -0,0 +1,106 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package httputil
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+type jsonTestPayload struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func TestGetJSONDecodesResponse(t *testing.T) {
+	client := &MockHttpClient{Getfunc: func(url string, headers map[string]string) (int, []byte, error) {
+		if headers["Accept"] != "application/json" {
+			t.Fatalf("accept header was not set, headers: %v", headers)
+		}
+		if headers["Metadata"] != "true" {
+			t.Fatal("caller headers were not forwarded")
+		}
+		return 200, []byte(`{"name":"foo","count":3}`), nil
+	}}
+
+	payload, err := GetJSON[jsonTestPayload](client, "http://foo.bar", map[string]string{"Metadata": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload.Name != "foo" || payload.Count != 3 {
+		t.Fatalf("unexpected payload %+v", payload)
+	}
+}
+
+func TestPostJSONEncodesPayload(t *testing.T) {
+	client := &MockHttpClient{Postfunc: func(url string, headers map[string]string, payload []byte) (int, []byte, error) {
+		if headers["Content-Type"] != "application/json" {
+			t.Fatalf("content type was not set, headers: %v", headers)
+		}
+		var received jsonTestPayload
+		if err := json.Unmarshal(payload, &received); err != nil || received.Name != "in" {
+			t.Fatalf("unexpected request payload %s", payload)
+		}
+		return 201, []byte(`{"name":"out"}`), nil
+	}}
+
+	payload, err := PostJSON[jsonTestPayload](client, "http://foo.bar", nil, jsonTestPayload{Name: "in"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload.Name != "out" {
+		t.Fatalf("unexpected payload %+v", payload)
+	}
+}
+
+func TestGetJSONReturnsAzureErrorEnvelope(t *testing.T) {
+	client := &MockHttpClient{Getfunc: func(url string, headers map[string]string) (int, []byte, error) {
+		return 403, []byte(`{"error":{"code":"AuthorizationFailed","message":"no access"}}`), nil
+	}}
+
+	_, err := GetJSON[jsonTestPayload](client, "http://foo.bar", nil)
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) {
+		t.Fatalf("expected *HTTPError, got %v", err)
+	}
+	if httpErr.StatusCode != 403 || httpErr.Code != "AuthorizationFailed" || httpErr.Message != "no access" {
+		t.Fatalf("unexpected error %+v", httpErr)
+	}
+	if !strings.Contains(err.Error(), "AuthorizationFailed") {
+		t.Fatalf("error message doesn't contain the error code: %s", err.Error())
+	}
+}
+
+func TestHTTPErrorParsesOAuthErrorBody(t *testing.T) {
+	httpErr := NewHTTPError(400, nil, []byte(`{"error":"invalid_request","error_description":"Identity not found"}`))
+	if httpErr.Code != "invalid_request" || httpErr.Message != "Identity not found" {
+		t.Fatalf("unexpected error %+v", httpErr)
+	}
+}
+
+func TestHTTPErrorTruncatesBody(t *testing.T) {
+	httpErr := NewHTTPError(500, nil, []byte(strings.Repeat("x", 5000)))
+	if len(httpErr.Body) != maxErrorBodySnippetLength {
+		t.Fatalf("body snippet has length %d", len(httpErr.Body))
+	}
+}
+
+func TestGetJSONAcceptsAnySuccessStatusCodeWhenOptedIn(t *testing.T) {
+	client := &MockHttpClient{Getfunc: func(url string, headers map[string]string) (int, []byte, error) {
+		return 204, nil, nil
+	}}
+
+	if _, err := GetJSON[jsonTestPayload](client, "http://foo.bar", nil); err == nil {
+		t.Fatal("204 was accepted without opting in")
+	}
+	payload, err := GetJSON[jsonTestPayload](client, "http://foo.bar", nil, AcceptAnySuccessStatusCode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload != (jsonTestPayload{}) {
+		t.Fatalf("expected zero value for empty body, got %+v", payload)
+	}
+}
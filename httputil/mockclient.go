@@ -3,12 +3,20 @@
 
 package httputil
 
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+)
+
 type MockHttpClient struct {
 	// overwrite these methods to get the desired output
 	Getfunc    func(url string, headers map[string]string) (responseCode int, body []byte, err error)
 	Postfunc   func(url string, headers map[string]string, payload []byte) (responseCode int, body []byte, err error)
 	Putfunc    func(url string, headers map[string]string, payload []byte) (responseCode int, body []byte, err error)
 	Deletefunc func(url string, headers map[string]string, payload []byte) (responseCode int, body []byte, err error)
+	// when Dofunc is not set Do dispatches GET, POST, PUT and DELETE requests to the functions above
+	Dofunc func(spec RequestSpec) (*Response, error)
 }
 
 func (client *MockHttpClient) Get(url string, headers map[string]string) (responseCode int, body []byte, err error) {
@@ -24,3 +32,44 @@ func (client *MockHttpClient) Put(url string, headers map[string]string, payload
 func (client *MockHttpClient) Delete(url string, headers map[string]string, payload []byte) (responseCode int, body []byte, err error) {
 	return client.Deletefunc(url, headers, payload)
 }
+
+func (client *MockHttpClient) Do(spec RequestSpec) (*Response, error) {
+	if client.Dofunc != nil {
+		return client.Dofunc(spec)
+	}
+
+	request, err := NewHttpRequest(spec)
+	if err != nil {
+		return nil, err
+	}
+	headers := make(map[string]string)
+	for key := range request.Header {
+		headers[key] = request.Header.Get(key)
+	}
+	var payload []byte
+	if request.Body != nil {
+		payload, err = ioutil.ReadAll(request.Body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var code int
+	var body []byte
+	switch {
+	case spec.Method == OperationGet && client.Getfunc != nil:
+		code, body, err = client.Getfunc(request.URL.String(), headers)
+	case spec.Method == OperationPost && client.Postfunc != nil:
+		code, body, err = client.Postfunc(request.URL.String(), headers, payload)
+	case spec.Method == OperationPut && client.Putfunc != nil:
+		code, body, err = client.Putfunc(request.URL.String(), headers, payload)
+	case spec.Method == OperationDelete && client.Deletefunc != nil:
+		code, body, err = client.Deletefunc(request.URL.String(), headers, payload)
+	default:
+		return nil, fmt.Errorf("mock http client has no handler for %s requests", spec.Method)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Response{StatusCode: code, Body: ioutil.NopCloser(bytes.NewReader(body))}, nil
+}
@@ -0,0 +1,123 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package httputil
+
+import (
+	"sync"
+	"time"
+)
+
+// The instance metadata service throttles callers at roughly 5 requests per second per VM
+const (
+	imdsRequestsPerSecond = 5
+	imdsBurst             = 5
+)
+
+// ImdsRateLimiter is shared by every client talking to the instance metadata service on this VM
+var ImdsRateLimiter = NewHostRateLimiter(imdsRequestsPerSecond, imdsBurst)
+
+// RateLimiter is a token bucket refilled at a fixed rate up to burst tokens
+type RateLimiter struct {
+	mu                sync.Mutex
+	requestsPerSecond float64
+	burst             float64
+	tokens            float64
+	last              time.Time
+}
+
+func NewRateLimiter(requestsPerSecond float64, burst int) *RateLimiter {
+	if requestsPerSecond <= 0 {
+		panic("requestsPerSecond must be positive")
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		requestsPerSecond: requestsPerSecond,
+		burst:             float64(burst),
+		tokens:            float64(burst),
+		last:              time.Now(),
+	}
+}
+
+// Allow takes a token if one is available without blocking, a denied call leaves the bucket unchanged
+func (limiter *RateLimiter) Allow() bool {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	limiter.refill()
+	if limiter.tokens < 1 {
+		return false
+	}
+	limiter.tokens--
+	return true
+}
+
+// Wait blocks until a token is available and takes it
+func (limiter *RateLimiter) Wait() {
+	if delay := limiter.reserve(); delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// reserve takes a token, going into debt if the bucket is empty, and returns how long the caller has to wait
+// before the token it was given becomes valid
+func (limiter *RateLimiter) reserve() time.Duration {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	limiter.refill()
+
+	if limiter.tokens >= 1 {
+		limiter.tokens--
+		return 0
+	}
+	deficit := 1 - limiter.tokens
+	limiter.tokens--
+	return time.Duration(deficit / limiter.requestsPerSecond * float64(time.Second))
+}
+
+// refill adds the tokens accumulated since the last call, limiter.mu must be held
+func (limiter *RateLimiter) refill() {
+	now := time.Now()
+	limiter.tokens += now.Sub(limiter.last).Seconds() * limiter.requestsPerSecond
+	if limiter.tokens > limiter.burst {
+		limiter.tokens = limiter.burst
+	}
+	limiter.last = now
+}
+
+// HostRateLimiter keeps an independent token bucket for every host
+type HostRateLimiter struct {
+	mu                sync.Mutex
+	requestsPerSecond float64
+	burst             int
+	limiters          map[string]*RateLimiter
+}
+
+func NewHostRateLimiter(requestsPerSecond float64, burst int) *HostRateLimiter {
+	if requestsPerSecond <= 0 {
+		panic("requestsPerSecond must be positive")
+	}
+	return &HostRateLimiter{
+		requestsPerSecond: requestsPerSecond,
+		burst:             burst,
+		limiters:          make(map[string]*RateLimiter),
+	}
+}
+
+// ForHost returns the token bucket used for host, creating it on first use
+func (hostLimiter *HostRateLimiter) ForHost(host string) *RateLimiter {
+	hostLimiter.mu.Lock()
+	defer hostLimiter.mu.Unlock()
+	limiter, ok := hostLimiter.limiters[host]
+	if !ok {
+		limiter = NewRateLimiter(hostLimiter.requestsPerSecond, hostLimiter.burst)
+		hostLimiter.limiters[host] = limiter
+	}
+	return limiter
+}
+
+// Wait blocks until a request to host is allowed
+func (hostLimiter *HostRateLimiter) Wait(host string) {
+	hostLimiter.ForHost(host).Wait()
+}
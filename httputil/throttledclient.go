@@ -0,0 +1,113 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package httputil
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+type throttledHttpClient struct {
+	httpClient HttpClient
+	limiter    *HostRateLimiter
+	breaker    *HostCircuitBreaker
+}
+
+// NewThrottledHttpClient wraps client so that every request first waits on the per host rate limiter and is
+// refused while the circuit for its host is open. Either limiter or breaker may be nil to disable it.
+// Every attempt of the clients of this package, including their retries, waits on the limiter. Other
+// implementations are only throttled once per call.
+func NewThrottledHttpClient(client HttpClient, limiter *HostRateLimiter, breaker *HostCircuitBreaker) HttpClient {
+	if client == nil {
+		panic("client must be specified")
+	}
+	if retrying, ok := client.(*Client); ok && limiter != nil {
+		rateLimited := &Client{httpClient: &rateLimitedHttpClient{httpClient: retrying.httpClient, limiter: limiter}, retryBehavior: retrying.retryBehavior}
+		return &throttledHttpClient{httpClient: rateLimited, breaker: breaker}
+	}
+	return &throttledHttpClient{httpClient: client, limiter: limiter, breaker: breaker}
+}
+
+// rateLimitedHttpClient waits on the limiter before each request, so that the retry loop of Client is throttled
+type rateLimitedHttpClient struct {
+	httpClient httpClientInterface
+	limiter    *HostRateLimiter
+}
+
+func (client *rateLimitedHttpClient) Do(request *http.Request) (*http.Response, error) {
+	client.limiter.Wait(request.URL.Host)
+	return client.httpClient.Do(request)
+}
+
+func (client *throttledHttpClient) Get(url string, headers map[string]string) (responseCode int, body []byte, err error) {
+	return client.issueRequest(url, func() (int, []byte, error) {
+		return client.httpClient.Get(url, headers)
+	})
+}
+
+func (client *throttledHttpClient) Post(url string, headers map[string]string, payload []byte) (responseCode int, body []byte, err error) {
+	return client.issueRequest(url, func() (int, []byte, error) {
+		return client.httpClient.Post(url, headers, payload)
+	})
+}
+
+func (client *throttledHttpClient) Put(url string, headers map[string]string, payload []byte) (responseCode int, body []byte, err error) {
+	return client.issueRequest(url, func() (int, []byte, error) {
+		return client.httpClient.Put(url, headers, payload)
+	})
+}
+
+func (client *throttledHttpClient) Delete(url string, headers map[string]string, payload []byte) (responseCode int, body []byte, err error) {
+	return client.issueRequest(url, func() (int, []byte, error) {
+		return client.httpClient.Delete(url, headers, payload)
+	})
+}
+
+func (client *throttledHttpClient) Do(spec RequestSpec) (*Response, error) {
+	var res *Response
+	_, _, err := client.issueRequest(spec.URL, func() (int, []byte, error) {
+		var err error
+		res, err = client.httpClient.Do(spec)
+		if err != nil {
+			return -1, nil, err
+		}
+		return res.StatusCode, nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (client *throttledHttpClient) issueRequest(requestUrl string, send func() (int, []byte, error)) (int, []byte, error) {
+	host := hostOf(requestUrl)
+	if client.breaker != nil {
+		if err := client.breaker.ForHost(host).Allow(); err != nil {
+			return -1, nil, fmt.Errorf("%s: %w", host, err)
+		}
+	}
+	if client.limiter != nil {
+		client.limiter.Wait(host)
+	}
+
+	code, body, err := send()
+
+	if client.breaker != nil {
+		if err != nil || isTransientHttpStatusCode(code) {
+			client.breaker.ForHost(host).RecordFailure()
+		} else {
+			client.breaker.ForHost(host).RecordSuccess()
+		}
+	}
+	return code, body, err
+}
+
+func hostOf(requestUrl string) string {
+	u, err := url.Parse(requestUrl)
+	if err != nil {
+		return requestUrl
+	}
+	return u.Host
+}
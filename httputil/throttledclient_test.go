@@ -0,0 +1,145 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package httputil
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllowsBurstThenThrottles(t *testing.T) {
+	limiter := NewRateLimiter(1, 3)
+	for i := 0; i < 3; i++ {
+		if !limiter.Allow() {
+			t.Fatalf("request %d within burst was throttled", i+1)
+		}
+	}
+	if limiter.Allow() {
+		t.Fatal("request beyond burst was allowed")
+	}
+}
+
+func TestRateLimiterWaitBlocksUntilRefill(t *testing.T) {
+	limiter := NewRateLimiter(20, 1)
+	limiter.Wait()
+	start := time.Now()
+	limiter.Wait()
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Fatalf("second request was not delayed, waited %v", elapsed)
+	}
+}
+
+func TestDeniedAllowDoesNotDrainBucket(t *testing.T) {
+	limiter := NewRateLimiter(20, 1)
+	limiter.Wait()
+	for i := 0; i < 100; i++ {
+		limiter.Allow()
+	}
+	start := time.Now()
+	limiter.Wait()
+	// a single token refills within 50ms, denied calls must not have gone into debt
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("denied calls delayed the next request by %v", elapsed)
+	}
+}
+
+func TestHostRateLimiterIsolatesHosts(t *testing.T) {
+	limiter := NewHostRateLimiter(1, 1)
+	if !limiter.ForHost("a").Allow() {
+		t.Fatal("first request to host a was throttled")
+	}
+	if !limiter.ForHost("b").Allow() {
+		t.Fatal("request to host b was throttled by host a")
+	}
+	if limiter.ForHost("a").Allow() {
+		t.Fatal("second request to host a was allowed")
+	}
+}
+
+func TestCircuitBreakerOpensAndProbes(t *testing.T) {
+	breaker := NewCircuitBreaker(2, 50*time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if err := breaker.Allow(); err != nil {
+			t.Fatalf("closed circuit refused request: %v", err)
+		}
+		breaker.RecordFailure()
+	}
+	if breaker.State() != CircuitOpen {
+		t.Fatalf("expected open circuit, got %v", breaker.State())
+	}
+	if err := breaker.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("open circuit allowed request, err: %v", err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if err := breaker.Allow(); err != nil {
+		t.Fatalf("half-open circuit refused probe: %v", err)
+	}
+	if err := breaker.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatal("half-open circuit allowed a second concurrent probe")
+	}
+	breaker.RecordFailure()
+	if breaker.State() != CircuitOpen {
+		t.Fatalf("failed probe did not reopen circuit, state %v", breaker.State())
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if err := breaker.Allow(); err != nil {
+		t.Fatalf("half-open circuit refused probe: %v", err)
+	}
+	breaker.RecordSuccess()
+	if breaker.State() != CircuitClosed {
+		t.Fatalf("successful probe did not close circuit, state %v", breaker.State())
+	}
+}
+
+func TestThrottledHttpClientStopsCallingFailingHost(t *testing.T) {
+	calls := 0
+	mock := &MockHttpClient{Getfunc: func(url string, headers map[string]string) (int, []byte, error) {
+		calls++
+		return 503, nil, nil
+	}}
+	client := NewThrottledHttpClient(mock, nil, NewHostCircuitBreaker(2, time.Minute))
+
+	for i := 0; i < 2; i++ {
+		code, _, err := client.Get("http://storage.example/blob", nil)
+		if err != nil || code != 503 {
+			t.Fatalf("unexpected result %d %v", code, err)
+		}
+	}
+	_, _, err := client.Get("http://storage.example/other", nil)
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected ErrCircuitOpen, got %v", err)
+	}
+	if calls != 2 {
+		t.Fatalf("request was sent while circuit was open, calls: %d", calls)
+	}
+
+	code, _, err := client.Get("http://other.example/", nil)
+	if err != nil || code != 503 {
+		t.Fatal("circuit for one host blocked requests to another host")
+	}
+}
+
+func TestThrottledHttpClientLimitsRetries(t *testing.T) {
+	attempts := 0
+	retrying := &Client{
+		httpClient: &mockHttpClient{AttemptCount: &attempts, DoFunc: return429},
+		retryBehavior: func(statusCode int, i int) bool {
+			return statusCode == 429 && i < 3
+		},
+	}
+	client := NewThrottledHttpClient(retrying, NewHostRateLimiter(20, 1), nil)
+
+	start := time.Now()
+	code, _, err := client.Get("http://169.254.169.254/metadata/instance", nil)
+	if err != nil || code != 429 {
+		t.Fatalf("unexpected result %d %v", code, err)
+	}
+	// the first attempt takes the burst, each of the two retries waits for a token refilled every 50ms
+	if elapsed := time.Since(start); attempts != 3 || elapsed < 90*time.Millisecond {
+		t.Fatalf("retries bypassed the rate limiter, %d attempts in %v", attempts, elapsed)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package httputil
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/Azure/azure-extension-foundation/errorhelper"
+)
+
+// TLSOptions configures the TLS client of a transport. The zero value requires TLS 1.2 or later, uses the Go
+// default cipher suites and system roots, and refuses renegotiation.
+type TLSOptions struct {
+	// MinVersion defaults to tls.VersionTLS12
+	MinVersion uint16
+	// CipherSuites restricts the TLS 1.2 cipher suites offered, TLS 1.3 suites are not configurable
+	CipherSuites []uint16
+	// RootCAFile is a PEM bundle of certificate authorities trusted in addition to the system roots
+	RootCAFile string
+	// PinnedPublicKeys holds base64 encoded SHA-256 hashes of SubjectPublicKeyInfo. When set, the connection is
+	// refused unless a certificate of the server chain matches one of them.
+	PinnedPublicKeys []string
+	// CertificateFile and KeyFile are the PEM encoded client certificate and key used for mutual TLS
+	CertificateFile string
+	KeyFile         string
+	// AllowRenegotiation lets the server renegotiate repeatedly, some legacy endpoints require it
+	AllowRenegotiation bool
+	InsecureSkipVerify bool
+}
+
+type HttpClientOptions struct {
+	RetryBehavior RetryBehavior
+	TLS           TLSOptions
+	// Timeout bounds every attempt including reading the response body, zero means no timeout
+	Timeout time.Duration
+}
+
+// NewTLSConfig builds a tls.Config from options
+func NewTLSConfig(options TLSOptions) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		CipherSuites:       options.CipherSuites,
+		InsecureSkipVerify: options.InsecureSkipVerify,
+		Renegotiation:      tls.RenegotiateNever,
+	}
+	if options.MinVersion != 0 {
+		if options.MinVersion < tls.VersionTLS12 {
+			return nil, errorhelper.AddStackToError(fmt.Errorf("minimum tls version 0x%04x is not supported", options.MinVersion))
+		}
+		tlsConfig.MinVersion = options.MinVersion
+	}
+	if options.AllowRenegotiation {
+		tlsConfig.Renegotiation = tls.RenegotiateFreelyAsClient
+	}
+
+	if options.RootCAFile != "" {
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil {
+			rootCAs = x509.NewCertPool()
+		}
+		bundle, err := os.ReadFile(options.RootCAFile)
+		if err != nil {
+			return nil, errorhelper.AddStackToError(fmt.Errorf("unable to read ca bundle %s: %v", options.RootCAFile, err))
+		}
+		if !rootCAs.AppendCertsFromPEM(bundle) {
+			return nil, errorhelper.AddStackToError(fmt.Errorf("no certificates found in ca bundle %s", options.RootCAFile))
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	if options.CertificateFile != "" || options.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(options.CertificateFile, options.KeyFile)
+		if err != nil {
+			return nil, errorhelper.AddStackToError(err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(options.PinnedPublicKeys) != 0 {
+		pins := make(map[string]bool, len(options.PinnedPublicKeys))
+		for _, pin := range options.PinnedPublicKeys {
+			decoded, err := base64.StdEncoding.DecodeString(pin)
+			if err != nil || len(decoded) != sha256.Size {
+				return nil, errorhelper.AddStackToError(fmt.Errorf("pinned public key %q is not a base64 encoded sha256 hash", pin))
+			}
+			pins[pin] = true
+		}
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			return verifyPinnedPublicKeys(state, pins)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// verifyPinnedPublicKeys checks the verified chains, or the presented certificates when verification is disabled
+func verifyPinnedPublicKeys(state tls.ConnectionState, pins map[string]bool) error {
+	chains := state.VerifiedChains
+	if len(chains) == 0 {
+		chains = [][]*x509.Certificate{state.PeerCertificates}
+	}
+	for _, chain := range chains {
+		for _, cert := range chain {
+			if pins[PublicKeyPin(cert)] {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no certificate presented by %s matches a pinned public key", state.ServerName)
+}
+
+// PublicKeyPin returns the base64 encoded SHA-256 hash of the certificate's SubjectPublicKeyInfo
+func PublicKeyPin(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// NewHttpTransport returns a transport using the TLS configuration built from options
+func NewHttpTransport(options TLSOptions) (*http.Transport, error) {
+	tlsConfig, err := NewTLSConfig(options)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Transport{TLSClientConfig: tlsConfig}, nil
+}
+
+// NewHttpClientWithOptions returns a client with hardened TLS defaults, see TLSOptions
+func NewHttpClientWithOptions(options HttpClientOptions) (HttpClient, error) {
+	if options.RetryBehavior == nil {
+		panic("Retry policy must be specified")
+	}
+	transport, err := NewHttpTransport(options.TLS)
+	if err != nil {
+		return nil, err
+	}
+	httpClient := &http.Client{Transport: transport, Timeout: options.Timeout}
+	return &Client{httpClient, options.RetryBehavior}, nil
+}
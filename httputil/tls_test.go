@@ -0,0 +1,108 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package httputil
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTLSTestServer(t *testing.T) (*httptest.Server, string) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	t.Cleanup(server.Close)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, pemBytes, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return server, caFile
+}
+
+func TestTLSConfigDefaults(t *testing.T) {
+	tlsConfig, err := NewTLSConfig(TLSOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.MinVersion != tls.VersionTLS12 {
+		t.Fatalf("unexpected minimum version 0x%04x", tlsConfig.MinVersion)
+	}
+	if tlsConfig.Renegotiation != tls.RenegotiateNever {
+		t.Fatal("renegotiation is allowed by default")
+	}
+	if _, err := NewTLSConfig(TLSOptions{MinVersion: tls.VersionTLS10}); err == nil {
+		t.Fatal("tls 1.0 was accepted as minimum version")
+	}
+}
+
+func TestSecureHttpClientUsesTLSDefaults(t *testing.T) {
+	client := NewSecureHttpClient(NoRetry).(*Client)
+	tlsConfig := client.httpClient.(*http.Client).Transport.(*http.Transport).TLSClientConfig
+	if tlsConfig.MinVersion != tls.VersionTLS12 || tlsConfig.Renegotiation != tls.RenegotiateNever {
+		t.Fatalf("legacy client doesn't use the tls defaults: 0x%04x %v", tlsConfig.MinVersion, tlsConfig.Renegotiation)
+	}
+}
+
+func TestHttpClientWithCustomCABundle(t *testing.T) {
+	server, caFile := newTLSTestServer(t)
+
+	client, err := NewHttpClientWithOptions(HttpClientOptions{RetryBehavior: NoRetry})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client.Get(server.URL, nil); err == nil {
+		t.Fatal("untrusted server certificate was accepted")
+	}
+
+	client, err = NewHttpClientWithOptions(HttpClientOptions{RetryBehavior: NoRetry, TLS: TLSOptions{RootCAFile: caFile}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _, err := client.Get(server.URL, nil)
+	if err != nil || code != 200 {
+		t.Fatalf("request to server trusted through ca bundle failed: %d %v", code, err)
+	}
+}
+
+func TestHttpClientWithPinnedPublicKey(t *testing.T) {
+	server, caFile := newTLSTestServer(t)
+
+	client, err := NewHttpClientWithOptions(HttpClientOptions{RetryBehavior: NoRetry, TLS: TLSOptions{
+		RootCAFile:       caFile,
+		PinnedPublicKeys: []string{PublicKeyPin(server.Certificate())},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _, err := client.Get(server.URL, nil); err != nil || code != 200 {
+		t.Fatalf("request to pinned server failed: %d %v", code, err)
+	}
+
+	otherPin := sha256.Sum256([]byte("some other key"))
+	client, err = NewHttpClientWithOptions(HttpClientOptions{RetryBehavior: NoRetry, TLS: TLSOptions{
+		RootCAFile:       caFile,
+		PinnedPublicKeys: []string{base64.StdEncoding.EncodeToString(otherPin[:])},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client.Get(server.URL, nil); err == nil {
+		t.Fatal("server not matching the pin was accepted")
+	}
+}
+
+func TestTLSConfigRejectsMalformedPin(t *testing.T) {
+	if _, err := NewTLSConfig(TLSOptions{PinnedPublicKeys: []string{"not a pin"}}); err == nil {
+		t.Fatal("malformed pin was accepted")
+	}
+}
@@ -0,0 +1,508 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+// Package imdstest emulates the instance metadata service and its managed identity endpoint for integration tests
+// of the metadata, msi and msihttpclient packages.
+package imdstest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-extension-foundation/errorhelper"
+	"github.com/Azure/azure-extension-foundation/metadata"
+	"github.com/Azure/azure-extension-foundation/msi"
+	"github.com/smallstep/pkcs7"
+)
+
+const (
+	instancePath        = "/metadata/instance"
+	userDataPath        = "/metadata/instance/compute/userData"
+	loadBalancerPath    = "/metadata/loadbalancer"
+	identityPath        = "/metadata/identity/oauth2/token"
+	scheduledEventsPath = "/metadata/scheduledevents"
+	attestedPath        = "/metadata/attested/document"
+
+	defaultTokenLifetime = time.Hour
+	defaultTenantId      = "00000000-0000-0000-0000-000000000000"
+
+	// layout of the timestamps of the attested document
+	attestedTimestampLayout  = "01/02/06 15:04:05 -0700"
+	attestedDocumentLifetime = 6 * time.Hour
+)
+
+var (
+	identityApiVersions        = []string{"2018-02-01", "2019-08-01"}
+	scheduledEventsApiVersions = []string{"2019-08-01", "2020-07-01"}
+	attestedApiVersions        = []string{"2018-10-01", "2020-09-01", "2021-02-01"}
+)
+
+// Identity is a managed identity assigned to the emulated machine
+type Identity struct {
+	ClientId   string
+	ObjectId   string
+	ResourceId string
+}
+
+// Options configures the documents the emulator serves
+type Options struct {
+	Metadata     metadata.Metadata
+	UserData     []byte
+	LoadBalancer metadata.LoadBalancerMetadata
+	// ApiVersions are the versions of the instance, user data, load balancer and attested endpoints the emulator
+	// accepts, defaults to metadata.SupportedApiVersions. Other versions are rejected with 400 Bad Request like an
+	// older instance metadata service does.
+	ApiVersions []string
+
+	// SystemAssignedIdentity defaults to an identity with generated ids unless DisableSystemAssignedIdentity is set
+	SystemAssignedIdentity        Identity
+	DisableSystemAssignedIdentity bool
+	UserAssignedIdentities        []Identity
+	TenantId                      string
+	// TokenLifetime is how long issued tokens are valid, defaults to an hour
+	TokenLifetime time.Duration
+	// TokenHook changes token responses before they are sent, e.g. to set the access token or the expires_on format
+	// of another identity endpoint such as "1/2/2006 3:04:05 PM -07:00"
+	TokenHook func(token *msi.Msi)
+}
+
+// Fault replaces or delays the responses of the emulator
+type Fault struct {
+	// PathPrefix selects the requests the fault applies to, e.g. /metadata/identity. Empty applies to all requests.
+	PathPrefix string
+	// StatusCode answers the requests instead of serving them, e.g. 404 while an identity is being assigned, 410 while
+	// the instance metadata service is updated or 429 when throttling. Zero serves the requests after Delay.
+	StatusCode int
+	// RetryAfter is sent in the Retry-After header when set
+	RetryAfter time.Duration
+	Delay      time.Duration
+	// Count is how many requests the fault applies to, zero applies it until ClearFaults is called
+	Count int
+}
+
+// Emulator is an http.Handler emulating the instance metadata service, it is safe for concurrent use
+type Emulator struct {
+	mu              sync.Mutex
+	options         Options
+	scheduledEvents metadata.ScheduledEvents
+	faults          []*Fault
+	requests        map[string]int
+
+	attestedRoots  *x509.CertPool
+	attestedSigner *x509.Certificate
+	attestedKey    crypto.Signer
+}
+
+// NewEmulator returns an emulator serving the documents of options
+func NewEmulator(options Options) (*Emulator, error) {
+	if len(options.ApiVersions) == 0 {
+		options.ApiVersions = metadata.SupportedApiVersions
+	}
+	if options.TokenLifetime == 0 {
+		options.TokenLifetime = defaultTokenLifetime
+	}
+	if options.TenantId == "" {
+		options.TenantId = defaultTenantId
+	}
+	if !options.DisableSystemAssignedIdentity {
+		if options.SystemAssignedIdentity.ClientId == "" {
+			options.SystemAssignedIdentity.ClientId = newGuid()
+		}
+		if options.SystemAssignedIdentity.ObjectId == "" {
+			options.SystemAssignedIdentity.ObjectId = newGuid()
+		}
+	}
+	emulator := &Emulator{options: options, requests: make(map[string]int)}
+	if err := emulator.newAttestedSigner(); err != nil {
+		return nil, err
+	}
+	return emulator, nil
+}
+
+// SetMetadata replaces the instance metadata served
+func (emulator *Emulator) SetMetadata(metadata metadata.Metadata) {
+	emulator.mu.Lock()
+	defer emulator.mu.Unlock()
+	emulator.options.Metadata = metadata
+}
+
+// SetScheduledEvents replaces the scheduled events and increments the document incarnation
+func (emulator *Emulator) SetScheduledEvents(events ...metadata.ScheduledEvent) {
+	emulator.mu.Lock()
+	defer emulator.mu.Unlock()
+	emulator.scheduledEvents.Events = events
+	emulator.scheduledEvents.DocumentIncarnation++
+}
+
+// ScheduledEvents returns the scheduled events not started yet
+func (emulator *Emulator) ScheduledEvents() metadata.ScheduledEvents {
+	emulator.mu.Lock()
+	defer emulator.mu.Unlock()
+	return emulator.scheduledEvents
+}
+
+// InjectFault applies fault to the following requests, faults apply in the order they were injected
+func (emulator *Emulator) InjectFault(fault Fault) {
+	emulator.mu.Lock()
+	defer emulator.mu.Unlock()
+	emulator.faults = append(emulator.faults, &fault)
+}
+
+// ClearFaults removes all faults
+func (emulator *Emulator) ClearFaults() {
+	emulator.mu.Lock()
+	defer emulator.mu.Unlock()
+	emulator.faults = nil
+}
+
+// RequestCount returns how many requests were received for paths starting with pathPrefix, including rejected ones
+func (emulator *Emulator) RequestCount(pathPrefix string) int {
+	emulator.mu.Lock()
+	defer emulator.mu.Unlock()
+	count := 0
+	for path, requests := range emulator.requests {
+		if strings.HasPrefix(path, pathPrefix) {
+			count += requests
+		}
+	}
+	return count
+}
+
+// AttestedRoots returns the pool verifying the documents of the attested endpoint, see
+// metadata.AttestedDataOptions
+func (emulator *Emulator) AttestedRoots() *x509.CertPool {
+	return emulator.attestedRoots
+}
+
+func (emulator *Emulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	emulator.mu.Lock()
+	emulator.requests[r.URL.Path]++
+	fault := emulator.nextFault(r.URL.Path)
+	emulator.mu.Unlock()
+
+	if fault.Delay > 0 {
+		select {
+		case <-time.After(fault.Delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if fault.StatusCode != 0 {
+		if fault.RetryAfter > 0 {
+			// the header has a resolution of seconds, shorter delays must not turn into an immediate retry
+			w.Header().Set("Retry-After", strconv.Itoa(int((fault.RetryAfter+time.Second-1)/time.Second)))
+		}
+		writeError(w, fault.StatusCode, "fault_injected", http.StatusText(fault.StatusCode))
+		return
+	}
+
+	// like the instance metadata service, reject requests without the header or forwarded by a proxy
+	if r.Header.Get("Metadata") != "true" {
+		writeError(w, http.StatusBadRequest, "bad_request", "Required metadata header not specified")
+		return
+	}
+	if r.Header.Get("X-Forwarded-For") != "" {
+		writeError(w, http.StatusForbidden, "forbidden", "Requests with X-Forwarded-For header are not allowed")
+		return
+	}
+
+	switch {
+	case r.URL.Path == instancePath && r.Method == http.MethodGet:
+		emulator.serveInstance(w, r)
+	case r.URL.Path == userDataPath && r.Method == http.MethodGet:
+		emulator.serveUserData(w, r)
+	case r.URL.Path == loadBalancerPath && r.Method == http.MethodGet:
+		emulator.serveLoadBalancer(w, r)
+	case r.URL.Path == identityPath && r.Method == http.MethodGet:
+		emulator.serveToken(w, r)
+	case r.URL.Path == scheduledEventsPath && (r.Method == http.MethodGet || r.Method == http.MethodPost):
+		emulator.serveScheduledEvents(w, r)
+	case r.URL.Path == attestedPath && r.Method == http.MethodGet:
+		emulator.serveAttestedDocument(w, r)
+	default:
+		writeError(w, http.StatusNotFound, "not_found", "Resource not found")
+	}
+}
+
+// nextFault returns the first fault applying to path and consumes it, emulator.mu must be held
+func (emulator *Emulator) nextFault(path string) Fault {
+	for i, fault := range emulator.faults {
+		if !strings.HasPrefix(path, fault.PathPrefix) {
+			continue
+		}
+		applied := *fault
+		if fault.Count > 0 {
+			fault.Count--
+			if fault.Count == 0 {
+				emulator.faults = append(emulator.faults[:i], emulator.faults[i+1:]...)
+			}
+		}
+		return applied
+	}
+	return Fault{}
+}
+
+func (emulator *Emulator) checkApiVersion(w http.ResponseWriter, r *http.Request, supported []string, minimum string) bool {
+	version := r.URL.Query().Get("api-version")
+	if version >= minimum {
+		for _, candidate := range supported {
+			if candidate == version {
+				return true
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":           "Bad request. api-version is invalid or was not specified in the request.",
+		"newest-versions": supported,
+	})
+	return false
+}
+
+func (emulator *Emulator) serveInstance(w http.ResponseWriter, r *http.Request) {
+	if !emulator.checkApiVersion(w, r, emulator.options.ApiVersions, "") {
+		return
+	}
+	emulator.mu.Lock()
+	document := emulator.options.Metadata
+	emulator.mu.Unlock()
+	writeJson(w, document)
+}
+
+func (emulator *Emulator) serveUserData(w http.ResponseWriter, r *http.Request) {
+	if !emulator.checkApiVersion(w, r, emulator.options.ApiVersions, "2021-01-01") {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(base64.StdEncoding.EncodeToString(emulator.options.UserData)))
+}
+
+func (emulator *Emulator) serveLoadBalancer(w http.ResponseWriter, r *http.Request) {
+	if !emulator.checkApiVersion(w, r, emulator.options.ApiVersions, "2020-10-01") {
+		return
+	}
+	writeJson(w, map[string]interface{}{"loadbalancer": emulator.options.LoadBalancer})
+}
+
+func (emulator *Emulator) serveScheduledEvents(w http.ResponseWriter, r *http.Request) {
+	if !emulator.checkApiVersion(w, r, scheduledEventsApiVersions, "") {
+		return
+	}
+	emulator.mu.Lock()
+	defer emulator.mu.Unlock()
+	if r.Method == http.MethodGet {
+		writeJson(w, emulator.scheduledEvents)
+		return
+	}
+
+	var request struct {
+		StartRequests []struct {
+			EventId string `json:"EventId"`
+		} `json:"StartRequests"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	started := map[string]bool{}
+	for _, start := range request.StartRequests {
+		started[start.EventId] = true
+	}
+	var remaining []metadata.ScheduledEvent
+	for _, event := range emulator.scheduledEvents.Events {
+		if !started[event.EventId] {
+			remaining = append(remaining, event)
+		}
+	}
+	if len(remaining) != len(emulator.scheduledEvents.Events) {
+		emulator.scheduledEvents.Events = remaining
+		emulator.scheduledEvents.DocumentIncarnation++
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (emulator *Emulator) serveToken(w http.ResponseWriter, r *http.Request) {
+	if !emulator.checkApiVersion(w, r, identityApiVersions, "") {
+		return
+	}
+	query := r.URL.Query()
+	resource := query.Get("resource")
+	if resource == "" {
+		writeError(w, http.StatusBadRequest, "invalid_request", "Required audience parameter not specified")
+		return
+	}
+	identity, ok := emulator.selectIdentity(query.Get("client_id"), query.Get("object_id"), query.Get("msi_res_id"))
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid_request", "Identity not found")
+		return
+	}
+
+	now := time.Now()
+	expiresOn := now.Add(emulator.options.TokenLifetime)
+	claims := msi.TokenClaims{
+		TenantId:     emulator.options.TenantId,
+		ObjectId:     identity.ObjectId,
+		AppId:        identity.ClientId,
+		Audience:     msi.ClaimStrings{resource},
+		MiResourceId: identity.ResourceId,
+		Issuer:       fmt.Sprintf("https://sts.windows.net/%s/", emulator.options.TenantId),
+		IssuedAt:     now.Unix(),
+		NotBefore:    now.Unix(),
+		ExpiresAt:    expiresOn.Unix(),
+	}
+	payload, _ := json.Marshal(claims)
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	lifetime := strconv.FormatInt(int64(emulator.options.TokenLifetime/time.Second), 10)
+	token := msi.Msi{
+		AccessToken:  header + "." + base64.RawURLEncoding.EncodeToString(payload) + ".emulated",
+		ClientID:     identity.ClientId,
+		ExpiresIn:    lifetime,
+		ExpiresOn:    strconv.FormatInt(expiresOn.Unix(), 10),
+		ExtExpiresIn: lifetime,
+		NotBefore:    strconv.FormatInt(now.Unix(), 10),
+		Resource:     resource,
+		TokenType:    "Bearer",
+	}
+	if emulator.options.TokenHook != nil {
+		emulator.options.TokenHook(&token)
+	}
+	writeJson(w, token)
+}
+
+// selectIdentity returns the identity matching one of the ids, or the system assigned identity if none is set
+func (emulator *Emulator) selectIdentity(clientId string, objectId string, resourceId string) (Identity, bool) {
+	if clientId == "" && objectId == "" && resourceId == "" {
+		if !emulator.options.DisableSystemAssignedIdentity {
+			return emulator.options.SystemAssignedIdentity, true
+		}
+		// like the instance metadata service, a single user assigned identity is used by default
+		if len(emulator.options.UserAssignedIdentities) == 1 {
+			return emulator.options.UserAssignedIdentities[0], true
+		}
+		return Identity{}, false
+	}
+	for _, identity := range emulator.options.UserAssignedIdentities {
+		if (clientId != "" && strings.EqualFold(identity.ClientId, clientId)) ||
+			(objectId != "" && strings.EqualFold(identity.ObjectId, objectId)) ||
+			(resourceId != "" && strings.EqualFold(identity.ResourceId, resourceId)) {
+			return identity, true
+		}
+	}
+	return Identity{}, false
+}
+
+func (emulator *Emulator) serveAttestedDocument(w http.ResponseWriter, r *http.Request) {
+	if !emulator.checkApiVersion(w, r, emulator.options.ApiVersions, attestedApiVersions[0]) {
+		return
+	}
+	emulator.mu.Lock()
+	compute := emulator.options.Metadata.Compute
+	emulator.mu.Unlock()
+
+	now := time.Now().UTC()
+	document := metadata.AttestedDocument{
+		LicenseType:    compute.LicenseType,
+		Nonce:          r.URL.Query().Get("nonce"),
+		Plan:           compute.Plan,
+		TimeStamp:      metadata.AttestedTimeStamp{CreatedOn: now.Format(attestedTimestampLayout), ExpiresOn: now.Add(attestedDocumentLifetime).Format(attestedTimestampLayout)},
+		VmId:           compute.VmId,
+		SubscriptionId: compute.SubscriptionId,
+		Sku:            compute.Sku,
+	}
+	content, _ := json.Marshal(document)
+	signedData, err := pkcs7.NewSignedData(content)
+	if err == nil {
+		err = signedData.AddSigner(emulator.attestedSigner, emulator.attestedKey, pkcs7.SignerInfoConfig{})
+	}
+	var der []byte
+	if err == nil {
+		der, err = signedData.Finish()
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", err.Error())
+		return
+	}
+	writeJson(w, map[string]string{"encoding": "pkcs7", "signature": base64.StdEncoding.EncodeToString(der)})
+}
+
+// newAttestedSigner issues the certificate signing attested documents from a root only the emulator trusts
+func (emulator *Emulator) newAttestedSigner() error {
+	now := time.Now()
+	rootKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return errorhelper.AddStackToError(err)
+	}
+	rootTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "IMDS Emulator Root"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(10 * 365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	rootDer, err := x509.CreateCertificate(rand.Reader, rootTemplate, rootTemplate, &rootKey.PublicKey, rootKey)
+	if err != nil {
+		return errorhelper.AddStackToError(err)
+	}
+	root, err := x509.ParseCertificate(rootDer)
+	if err != nil {
+		return errorhelper.AddStackToError(err)
+	}
+
+	signerKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return errorhelper.AddStackToError(err)
+	}
+	signerDer, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "metadata.azure.com"},
+		DNSNames:     []string{"metadata.azure.com"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}, root, &signerKey.PublicKey, rootKey)
+	if err != nil {
+		return errorhelper.AddStackToError(err)
+	}
+	signer, err := x509.ParseCertificate(signerDer)
+	if err != nil {
+		return errorhelper.AddStackToError(err)
+	}
+
+	emulator.attestedRoots = x509.NewCertPool()
+	emulator.attestedRoots.AddCert(root)
+	emulator.attestedSigner = signer
+	emulator.attestedKey = signerKey
+	return nil
+}
+
+func writeJson(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, statusCode int, code string, description string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]string{"error": code, "error_description": description})
+}
+
+func newGuid() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
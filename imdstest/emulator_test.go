@@ -0,0 +1,264 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package imdstest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-extension-foundation/httputil"
+	"github.com/Azure/azure-extension-foundation/metadata"
+	"github.com/Azure/azure-extension-foundation/msi"
+	"github.com/Azure/azure-extension-foundation/msihttpclient"
+)
+
+var testRetryPolicy = msi.RetryPolicy{MaxElapsedTime: time.Second, InitialDelay: 10 * time.Millisecond, MaxDelay: 10 * time.Millisecond}
+
+var testUserAssignedIdentity = Identity{
+	ClientId:   "cccc0000-cc00-cc00-cc00-cccccc000000",
+	ObjectId:   "dddd0000-dd00-dd00-dd00-dddddd000000",
+	ResourceId: "/subscriptions/aaaa0000-aa00-aa00-aa00-aaaaaa000000/resourceGroups/rg/providers/Microsoft.ManagedIdentity/userAssignedIdentities/id",
+}
+
+func newTestServer(t *testing.T, options Options) *Server {
+	if options.Metadata.Compute.Name == "" {
+		options.Metadata.Compute = metadata.MetadataCompute{
+			Name:              "some-computer",
+			SubscriptionId:    "aaaa0000-aa00-aa00-aa00-aaaaaa000000",
+			ResourceGroupName: "rg",
+			VmId:              "bbbb0000-bb00-bb00-bb00-bbbbbb000000",
+		}
+	}
+	server, err := NewServer(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	for name, value := range server.Environment() {
+		t.Setenv(name, value)
+	}
+	return server
+}
+
+func newTestMsiProvider() msi.MsiProvider {
+	provider := msi.NewMsiProviderForIdentitySource(httputil.NewSecureHttpClient(httputil.NoRetry), msi.IdentitySourceImds, testRetryPolicy)
+	return &provider
+}
+
+func TestMetadataFromEmulator(t *testing.T) {
+	server := newTestServer(t, Options{
+		UserData:     []byte("#cloud-config"),
+		LoadBalancer: metadata.LoadBalancerMetadata{PublicIpAddresses: []metadata.LoadBalancerIpAddress{{FrontendIpAddress: "2603:1030::1", PrivateIpAddress: "ace:cab:deca::4"}}},
+		ApiVersions:  []string{"2021-02-01", "2020-09-01"},
+	})
+	provider := metadata.NewMetadataProvider(httputil.NewSecureHttpClient(httputil.NoRetry))
+
+	document, err := provider.GetMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if document.Compute.Name != "some-computer" {
+		t.Fatalf("unexpected metadata %+v", document.Compute)
+	}
+	// the default api version is rejected before falling back to a supported one
+	if server.RequestCount("/metadata/instance") != 2 {
+		t.Fatalf("unexpected request count %d", server.RequestCount("/metadata/instance"))
+	}
+
+	userData, err := provider.GetUserData()
+	if err != nil || string(userData) != "#cloud-config" {
+		t.Fatalf("unexpected user data %q: %v", userData, err)
+	}
+	lb, err := provider.GetLoadBalancerMetadata()
+	if err != nil || len(lb.PublicIpAddresses) != 1 || !lb.PublicIpAddresses[0].IsIPv6() {
+		t.Fatalf("unexpected load balancer metadata %+v: %v", lb, err)
+	}
+}
+
+func TestEmulatorEnforcesHeaderAndApiVersion(t *testing.T) {
+	server := newTestServer(t, Options{})
+	for _, test := range []struct {
+		url    string
+		header string
+	}{
+		{server.URL + "/metadata/instance?api-version=2021-02-01", ""},
+		{server.URL + "/metadata/instance?api-version=2015-01-01", "true"},
+		{server.URL + "/metadata/instance", "true"},
+		{server.URL + "/metadata/identity/oauth2/token?api-version=2018-02-01", "true"},
+	} {
+		request, _ := http.NewRequest(http.MethodGet, test.url, nil)
+		if test.header != "" {
+			request.Header.Set("Metadata", test.header)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s was answered with %d", test.url, response.StatusCode)
+		}
+	}
+}
+
+func TestTokensFromEmulator(t *testing.T) {
+	server := newTestServer(t, Options{
+		SystemAssignedIdentity: Identity{ClientId: "system-client", ObjectId: "system-object"},
+		UserAssignedIdentities: []Identity{testUserAssignedIdentity},
+		TokenLifetime:          10 * time.Minute,
+	})
+	provider := newTestMsiProvider()
+
+	token, err := provider.GetMsiForResource("https://vault.azure.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := token.GetClaims()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.ObjectId != "system-object" || claims.Audience[0] != "https://vault.azure.net" || token.ClientID != "system-client" {
+		t.Fatalf("unexpected token %+v with claims %+v", token, claims)
+	}
+	expiresOn, err := token.GetExpiryTime()
+	if err != nil || time.Until(expiresOn) > 10*time.Minute || time.Until(expiresOn) < 9*time.Minute {
+		t.Fatalf("unexpected expiry %v: %v", expiresOn, err)
+	}
+
+	token, err = provider.GetMsiUsingResourceId(testUserAssignedIdentity.ResourceId, "https://vault.azure.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims, _ := token.GetClaims(); claims.MiResourceId != testUserAssignedIdentity.ResourceId {
+		t.Fatalf("unexpected claims %+v", claims)
+	}
+	if _, err := provider.GetMsiUsingClientId("unknown", "https://vault.azure.net"); err == nil {
+		t.Fatal("token of an unknown identity was issued")
+	}
+
+	server.InjectFault(Fault{PathPrefix: "/metadata/identity", StatusCode: http.StatusNotFound, Count: 2})
+	server.InjectFault(Fault{PathPrefix: "/metadata/identity", StatusCode: http.StatusGone, Count: 1})
+	before := server.RequestCount("/metadata/identity")
+	if _, err := provider.GetMsi(); err != nil {
+		t.Fatalf("token request wasn't retried: %v", err)
+	}
+	if requests := server.RequestCount("/metadata/identity") - before; requests != 4 {
+		t.Fatalf("expected 4 requests, got %d", requests)
+	}
+
+	server.InjectFault(Fault{PathPrefix: "/metadata/identity", StatusCode: http.StatusTooManyRequests, RetryAfter: 5 * time.Second})
+	if _, err := provider.GetMsi(); err == nil {
+		t.Fatal("token was issued while throttled beyond the retry policy")
+	}
+	server.ClearFaults()
+	if _, err := provider.GetMsi(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTokenHookChangesResponse(t *testing.T) {
+	expiresOn := time.Now().Add(30 * time.Minute).UTC().Truncate(time.Second)
+	newTestServer(t, Options{TokenHook: func(token *msi.Msi) {
+		token.AccessToken = "opaque"
+		token.ExpiresOn = expiresOn.Format("1/2/2006 3:04:05 PM -07:00")
+	}})
+	token, err := newTestMsiProvider().GetMsi()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "opaque" {
+		t.Fatalf("unexpected access token %q", token.AccessToken)
+	}
+	if expiry, err := token.GetExpiryTime(); err != nil || !expiry.Equal(expiresOn) {
+		t.Fatalf("unexpected expiry %v: %v", expiry, err)
+	}
+}
+
+func TestSubSecondRetryAfterIsRoundedUp(t *testing.T) {
+	server := newTestServer(t, Options{})
+	server.InjectFault(Fault{PathPrefix: "/metadata/identity", StatusCode: http.StatusTooManyRequests, RetryAfter: 200 * time.Millisecond, Count: 1})
+	response, err := http.Get(server.URL + "/metadata/identity/oauth2/token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if retryAfter := response.Header.Get("Retry-After"); retryAfter != "1" {
+		t.Fatalf("unexpected Retry-After %q", retryAfter)
+	}
+}
+
+func TestSlowEmulatorResponse(t *testing.T) {
+	server := newTestServer(t, Options{})
+	server.InjectFault(Fault{PathPrefix: "/metadata/instance", Delay: 200 * time.Millisecond, Count: 1})
+
+	client, err := httputil.NewHttpClientWithOptions(httputil.HttpClientOptions{RetryBehavior: httputil.NoRetry, Timeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := metadata.NewMetadataProvider(client)
+	if _, err := provider.GetMetadata(); err == nil {
+		t.Fatal("slow response didn't time out")
+	}
+	if _, err := provider.GetMetadata(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMsiHttpClientWithEmulator(t *testing.T) {
+	newTestServer(t, Options{})
+	var authorization, vmResourceId string
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		vmResourceId = r.URL.Query().Get("vmResourceId")
+	}))
+	defer service.Close()
+
+	imds := metadata.NewMetadataProvider(httputil.NewSecureHttpClient(httputil.NoRetry))
+	client, err := msihttpclient.NewMsiHttpClientWithOptions(newTestMsiProvider(), nil, httputil.NoRetry, msihttpclient.MsiHttpClientOptions{
+		MetadataProvider: metadata.NewCachingMetadataProvider(&imds, metadata.CacheOptions{DisableSnapshot: true}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _, err := client.Get(service.URL+"/path", nil); err != nil || code != http.StatusOK {
+		t.Fatalf("request failed with %d: %v", code, err)
+	}
+	if len(authorization) < len("Bearer ")+1 || authorization[:len("Bearer ")] != "Bearer " {
+		t.Fatalf("unexpected authorization %q", authorization)
+	}
+	if vmResourceId != "/subscriptions/aaaa0000-aa00-aa00-aa00-aaaaaa000000/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/some-computer" {
+		t.Fatalf("unexpected vm resource id %q", vmResourceId)
+	}
+}
+
+func TestScheduledEventsFromEmulator(t *testing.T) {
+	server := newTestServer(t, Options{})
+	server.SetScheduledEvents(metadata.ScheduledEvent{EventId: "event", EventType: metadata.EventTypeReboot, Resources: []string{"some-computer"}})
+	client := metadata.NewScheduledEventsClient(httputil.NewSecureHttpClient(httputil.NoRetry))
+
+	events, err := client.GetScheduledEvents()
+	if err != nil || len(events.ForVm("some-computer")) != 1 {
+		t.Fatalf("unexpected events %+v: %v", events, err)
+	}
+	if err := client.StartEvents("event"); err != nil {
+		t.Fatal(err)
+	}
+	if started := server.ScheduledEvents(); len(started.Events) != 0 || started.DocumentIncarnation != events.DocumentIncarnation+1 {
+		t.Fatalf("event wasn't started: %+v", started)
+	}
+}
+
+func TestAttestedDocumentFromEmulator(t *testing.T) {
+	server := newTestServer(t, Options{})
+	client := metadata.NewAttestedDataClient(httputil.NewSecureHttpClient(httputil.NoRetry), metadata.AttestedDataOptions{Roots: server.AttestedRoots()})
+	document, _, err := client.GetAttestedDocument("1234567890")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if document.VmId != "bbbb0000-bb00-bb00-bb00-bbbbbb000000" {
+		t.Fatalf("unexpected document %+v", document)
+	}
+}
@@ -0,0 +1,32 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package imdstest
+
+import (
+	"net/http/httptest"
+
+	"github.com/Azure/azure-extension-foundation/metadata"
+)
+
+// Server is an emulator listening on a local address, see httptest.Server
+type Server struct {
+	*httptest.Server
+	*Emulator
+}
+
+// NewServer starts an emulator serving the documents of options. Point the packages to it by setting the variables
+// of Environment.
+func NewServer(options Options) (*Server, error) {
+	emulator, err := NewEmulator(options)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{Server: httptest.NewServer(emulator), Emulator: emulator}, nil
+}
+
+// Environment returns the environment variables pointing the metadata, msi and msihttpclient packages to the
+// emulator
+func (server *Server) Environment() map[string]string {
+	return map[string]string{metadata.ImdsEndpointEnvVar: server.URL}
+}
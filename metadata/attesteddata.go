@@ -0,0 +1,193 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package metadata
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-extension-foundation/errorhelper"
+	"github.com/Azure/azure-extension-foundation/httputil"
+	"github.com/smallstep/pkcs7"
+)
+
+const (
+	attestedDocumentPath = "/metadata/attested/document?api-version=2020-09-01"
+
+	// layout of the timestamps of the attested document, e.g. 11/28/18 00:16:17 -0000
+	attestedTimestampLayout = "01/02/06 15:04:05 -0700"
+	// allowed clock skew between the machine and the verifier
+	attestedClockSkew = 5 * time.Minute
+)
+
+// DefaultAttestedSignerNames are the names of the certificates signing attested documents in the public and
+// sovereign clouds
+var DefaultAttestedSignerNames = []string{"metadata.azure.com", "metadata.azure.us", "metadata.azure.cn", "metadata.microsoftazure.de"}
+
+// AttestedDocument is the signed payload of the attested data endpoint
+type AttestedDocument struct {
+	LicenseType    string            `json:"licenseType"`
+	Nonce          string            `json:"nonce"`
+	Plan           Plan              `json:"plan"`
+	TimeStamp      AttestedTimeStamp `json:"timeStamp"`
+	VmId           string            `json:"vmId"`
+	SubscriptionId string            `json:"subscriptionId"`
+	Sku            string            `json:"sku"`
+}
+
+type AttestedTimeStamp struct {
+	CreatedOn string `json:"createdOn"`
+	ExpiresOn string `json:"expiresOn"`
+}
+
+// AttestedDataOptions configures how attested documents are verified
+type AttestedDataOptions struct {
+	// Roots are the trusted root certificates, defaults to the system pool
+	Roots *x509.CertPool
+	// Intermediates completes the chain of the signing certificate when the document doesn't embed it
+	Intermediates *x509.CertPool
+	// SignerNames are the accepted names of the signing certificate, defaults to DefaultAttestedSignerNames. Each
+	// name also accepts its subdomains.
+	SignerNames []string
+	// Now returns the verification time, defaults to time.Now
+	Now func() time.Time
+}
+
+type attestedDataResponse struct {
+	Encoding  string `json:"encoding"`
+	Signature string `json:"signature"`
+}
+
+type attestedDataClient struct {
+	httpClient httputil.HttpClient
+	options    AttestedDataOptions
+}
+
+// NewAttestedDataClient returns a client of the attested data endpoint issuing its requests through client,
+// throttled by the shared instance metadata service rate limiter
+func NewAttestedDataClient(client httputil.HttpClient, options AttestedDataOptions) attestedDataClient {
+	return attestedDataClient{httpClient: httputil.NewThrottledHttpClient(client, httputil.ImdsRateLimiter, nil), options: options}
+}
+
+// NewAttestedNonce returns a random nonce in the format accepted by the attested data endpoint, at most 10 digits
+func NewAttestedNonce() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(10000000000))
+	if err != nil {
+		return "", errorhelper.AddStackToError(err)
+	}
+	return fmt.Sprintf("%010d", n), nil
+}
+
+// GetAttestedDocument requests the attested document for nonce, verifies it and returns its payload. The signature
+// is returned as well so it can be forwarded to a backend verifying it with VerifyAttestedDocument.
+func (client *attestedDataClient) GetAttestedDocument(nonce string) (AttestedDocument, string, error) {
+	requestUrl := imdsUrl(attestedDocumentPath) + "&nonce=" + url.QueryEscape(nonce)
+	responseCode, responseBody, err := client.httpClient.Get(requestUrl, map[string]string{"Metadata": "true"})
+	if err != nil {
+		return AttestedDocument{}, "", err
+	}
+	if responseCode != 200 {
+		return AttestedDocument{}, "", errorhelper.AddStackToError(
+			fmt.Errorf("Get request for attested data returned return code %v.\nResponse Body: %s", responseCode, string(responseBody)))
+	}
+	var response attestedDataResponse
+	if err := json.Unmarshal(responseBody, &response); err != nil {
+		return AttestedDocument{}, "", errorhelper.AddStackToError(err)
+	}
+	if response.Encoding != "" && !strings.EqualFold(response.Encoding, "pkcs7") {
+		return AttestedDocument{}, "", errorhelper.AddStackToError(fmt.Errorf("unsupported attested data encoding %s", response.Encoding))
+	}
+	document, err := VerifyAttestedDocument(response.Signature, nonce, client.options)
+	return document, response.Signature, err
+}
+
+// VerifyAttestedDocument verifies the base64 PKCS#7 signature returned by the attested data endpoint: the signature,
+// the certificate chain and name of the signer, the nonce and the validity period of the document
+func VerifyAttestedDocument(signature string, nonce string, options AttestedDataOptions) (AttestedDocument, error) {
+	var document AttestedDocument
+	now := time.Now()
+	if options.Now != nil {
+		now = options.Now()
+	}
+
+	der, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return document, errorhelper.AddStackToError(fmt.Errorf("attested data signature is not base64: %v", err))
+	}
+	p7, err := pkcs7.Parse(der)
+	if err != nil {
+		return document, errorhelper.AddStackToError(fmt.Errorf("unable to parse attested data signature: %v", err))
+	}
+	if err := p7.Verify(); err != nil {
+		return document, errorhelper.AddStackToError(fmt.Errorf("attested data signature is invalid: %v", err))
+	}
+	if err := verifyAttestedSigner(p7, now, options); err != nil {
+		return document, err
+	}
+
+	if err := json.Unmarshal(p7.Content, &document); err != nil {
+		return document, errorhelper.AddStackToError(fmt.Errorf("unable to deserialize attested document: %v", err))
+	}
+	if document.Nonce != nonce {
+		return document, errorhelper.AddStackToError(fmt.Errorf("attested document nonce %q doesn't match %q", document.Nonce, nonce))
+	}
+	createdOn, err := time.Parse(attestedTimestampLayout, document.TimeStamp.CreatedOn)
+	if err != nil {
+		return document, errorhelper.AddStackToError(fmt.Errorf("invalid attested document creation time: %v", err))
+	}
+	expiresOn, err := time.Parse(attestedTimestampLayout, document.TimeStamp.ExpiresOn)
+	if err != nil {
+		return document, errorhelper.AddStackToError(fmt.Errorf("invalid attested document expiry time: %v", err))
+	}
+	if now.Add(attestedClockSkew).Before(createdOn) || !now.Before(expiresOn) {
+		return document, errorhelper.AddStackToError(fmt.Errorf("attested document is only valid from %v to %v", createdOn, expiresOn))
+	}
+	return document, nil
+}
+
+func verifyAttestedSigner(p7 *pkcs7.PKCS7, now time.Time, options AttestedDataOptions) error {
+	signer := p7.GetOnlySigner()
+	if signer == nil {
+		return errorhelper.AddStackToError(fmt.Errorf("attested data must have exactly one signer"))
+	}
+	intermediates := x509.NewCertPool()
+	if options.Intermediates != nil {
+		intermediates = options.Intermediates.Clone()
+	}
+	for _, certificate := range p7.Certificates {
+		intermediates.AddCert(certificate)
+	}
+	_, err := signer.Verify(x509.VerifyOptions{
+		Roots:         options.Roots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return errorhelper.AddStackToError(fmt.Errorf("attested data signer is not trusted: %v", err))
+	}
+
+	signerNames := options.SignerNames
+	if len(signerNames) == 0 {
+		signerNames = DefaultAttestedSignerNames
+	}
+	names := append([]string{signer.Subject.CommonName}, signer.DNSNames...)
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimPrefix(name, "*."))
+		for _, allowed := range signerNames {
+			allowed = strings.ToLower(allowed)
+			if name == allowed || strings.HasSuffix(name, "."+allowed) {
+				return nil
+			}
+		}
+	}
+	return errorhelper.AddStackToError(fmt.Errorf("attested data signer %v is not one of %v", names, signerNames))
+}
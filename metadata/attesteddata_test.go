@@ -0,0 +1,170 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package metadata
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-extension-foundation/httputil"
+	"github.com/smallstep/pkcs7"
+)
+
+var attestedTestTime = time.Date(2018, 11, 28, 1, 0, 0, 0, time.UTC)
+
+type attestedTestPki struct {
+	roots   *x509.CertPool
+	signer  *x509.Certificate
+	signKey *rsa.PrivateKey
+}
+
+func newTestCertificate(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate, key
+}
+
+func newAttestedTestPki(t *testing.T, signerName string) attestedTestPki {
+	root, rootKey := newTestCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Root"},
+		NotBefore:             attestedTestTime.Add(-24 * time.Hour),
+		NotAfter:              attestedTestTime.Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	signer, signKey := newTestCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: signerName},
+		DNSNames:     []string{signerName},
+		NotBefore:    attestedTestTime.Add(-time.Hour),
+		NotAfter:     attestedTestTime.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}, root, rootKey)
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	return attestedTestPki{roots: roots, signer: signer, signKey: signKey}
+}
+
+func (pki attestedTestPki) sign(t *testing.T, document AttestedDocument) string {
+	content, _ := json.Marshal(document)
+	signedData, err := pkcs7.NewSignedData(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// without signed attributes, the signing time would be outside of the validity of the test certificates
+	if err := signedData.SignWithoutAttr(pki.signer, pki.signKey, pkcs7.SignerInfoConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	der, err := signedData.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(der)
+}
+
+func newTestAttestedDocument(nonce string) AttestedDocument {
+	return AttestedDocument{
+		LicenseType:    "Windows_Server",
+		Nonce:          nonce,
+		Plan:           Plan{Name: "plan", Product: "product", Publisher: "publisher"},
+		TimeStamp:      AttestedTimeStamp{CreatedOn: "11/28/18 00:16:17 -0000", ExpiresOn: "11/28/18 06:16:17 -0000"},
+		VmId:           "bbbb0000-bb00-bb00-bb00-bbbbbb000000",
+		SubscriptionId: "aaaa0000-aa00-aa00-aa00-aaaaaa000000",
+		Sku:            "2019-Datacenter",
+	}
+}
+
+func TestVerifyAttestedDocument(t *testing.T) {
+	pki := newAttestedTestPki(t, "metadata.azure.com")
+	options := AttestedDataOptions{Roots: pki.roots, Now: func() time.Time { return attestedTestTime }}
+
+	document, err := VerifyAttestedDocument(pki.sign(t, newTestAttestedDocument("1234567890")), "1234567890", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if document.VmId != "bbbb0000-bb00-bb00-bb00-bbbbbb000000" || document.Plan.Product != "product" || document.LicenseType != "Windows_Server" {
+		t.Fatalf("unexpected document %+v", document)
+	}
+}
+
+func TestVerifyAttestedDocumentRejectsInvalidDocuments(t *testing.T) {
+	pki := newAttestedTestPki(t, "metadata.azure.com")
+	options := AttestedDataOptions{Roots: pki.roots, Now: func() time.Time { return attestedTestTime }}
+	signature := pki.sign(t, newTestAttestedDocument("1234567890"))
+
+	if _, err := VerifyAttestedDocument(signature, "0987654321", options); err == nil {
+		t.Fatal("document with another nonce was accepted")
+	}
+
+	expired := options
+	expired.Now = func() time.Time { return attestedTestTime.Add(6 * time.Hour) }
+	if _, err := VerifyAttestedDocument(signature, "1234567890", expired); err == nil {
+		t.Fatal("expired document was accepted")
+	}
+
+	if _, err := VerifyAttestedDocument(signature, "1234567890", AttestedDataOptions{Roots: x509.NewCertPool(), Now: options.Now}); err == nil {
+		t.Fatal("document signed by an untrusted root was accepted")
+	}
+
+	impostor := newAttestedTestPki(t, "metadata.example.com")
+	if _, err := VerifyAttestedDocument(impostor.sign(t, newTestAttestedDocument("1234567890")), "1234567890",
+		AttestedDataOptions{Roots: impostor.roots, Now: options.Now}); err == nil {
+		t.Fatal("document signed by another name was accepted")
+	}
+
+	der, _ := base64.StdEncoding.DecodeString(signature)
+	i := bytes.Index(der, []byte(`"1234567890"`))
+	if i < 0 {
+		t.Fatal("nonce not found in signed data")
+	}
+	copy(der[i:], `"1234567891"`)
+	if _, err := VerifyAttestedDocument(base64.StdEncoding.EncodeToString(der), "1234567891", options); err == nil {
+		t.Fatal("tampered document was accepted")
+	}
+}
+
+func TestGetAttestedDocument(t *testing.T) {
+	pki := newAttestedTestPki(t, "eastus.metadata.azure.com")
+	nonce, err := NewAttestedNonce()
+	if err != nil || len(nonce) != 10 {
+		t.Fatalf("unexpected nonce %q %v", nonce, err)
+	}
+	client := NewAttestedDataClient(&httputil.MockHttpClient{Getfunc: func(requestUrl string, headers map[string]string) (int, []byte, error) {
+		u, _ := url.Parse(requestUrl)
+		response, _ := json.Marshal(attestedDataResponse{Encoding: "pkcs7", Signature: pki.sign(t, newTestAttestedDocument(u.Query().Get("nonce")))})
+		return 200, response, nil
+	}}, AttestedDataOptions{Roots: pki.roots, Now: func() time.Time { return attestedTestTime }})
+
+	document, signature, err := client.GetAttestedDocument(nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if document.Nonce != nonce || signature == "" {
+		t.Fatalf("unexpected document %+v", document)
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-extension-foundation/errorhelper"
+	"github.com/Azure/azure-extension-foundation/settings"
+)
+
+const (
+	defaultMetadataCacheTtl = 5 * time.Minute
+	metadataSnapshotName    = "metadata.json"
+	snapshotFileMode        = os.FileMode(0600)
+)
+
+// MetadataProvider returns the instance metadata of the machine, implemented by NewMetadataProvider and
+// NewCachingMetadataProvider. Consumers accept it to inject fakes in tests.
+type MetadataProvider interface {
+	GetMetadata() (Metadata, error)
+}
+
+// CacheOptions configures how documents of the instance metadata service are cached
+type CacheOptions struct {
+	// Ttl is how long a document is served from memory, defaults to 5 minutes
+	Ttl time.Duration
+	// SnapshotDirectory holds the last document so that a handler starting while the instance metadata service is
+	// unreachable can use it. Defaults to the status folder of the handler environment, the state directory every
+	// handler process of the extension can write to.
+	SnapshotDirectory string
+	// DisableSnapshot keeps documents in memory only
+	DisableSnapshot bool
+}
+
+// Cached is a document with the time it was retrieved. Stale documents were served from memory or from the
+// snapshot after the instance metadata service couldn't be reached.
+type Cached[T any] struct {
+	Value       T         `json:"value"`
+	RetrievedAt time.Time `json:"retrievedAt"`
+	Stale       bool      `json:"-"`
+}
+
+// documentCache serves a document from memory for a ttl and falls back to the last document, in memory or in the
+// snapshot file, when it can't be fetched
+type documentCache[T any] struct {
+	fetch        func() (T, error)
+	ttl          time.Duration
+	snapshotPath string
+
+	// fetchMu serializes requests so that concurrent misses result in a single request, mu only guards cached so
+	// that a slow request doesn't block callers served from memory
+	fetchMu sync.Mutex
+	mu      sync.Mutex
+	cached  *Cached[T]
+}
+
+func newDocumentCache[T any](fetch func() (T, error), options CacheOptions, snapshotName string) *documentCache[T] {
+	if options.Ttl == 0 {
+		options.Ttl = defaultMetadataCacheTtl
+	}
+	cache := &documentCache[T]{fetch: fetch, ttl: options.Ttl}
+	if !options.DisableSnapshot {
+		directory := options.SnapshotDirectory
+		if directory == "" {
+			if environment, err := settings.GetHandlerEnvironment(); err == nil {
+				directory = environment.HandlerEnvironment.StatusFolder
+			}
+		}
+		if directory != "" {
+			cache.snapshotPath = filepath.Join(directory, snapshotName)
+		}
+	}
+	return cache
+}
+
+func (cache *documentCache[T]) get() (Cached[T], error) {
+	if cached, ok := cache.fresh(); ok {
+		return cached, nil
+	}
+	cache.fetchMu.Lock()
+	defer cache.fetchMu.Unlock()
+	// another caller may have fetched the document while this one waited
+	if cached, ok := cache.fresh(); ok {
+		return cached, nil
+	}
+	return cache.refreshLocked(true)
+}
+
+func (cache *documentCache[T]) refresh() (Cached[T], error) {
+	cache.fetchMu.Lock()
+	defer cache.fetchMu.Unlock()
+	return cache.refreshLocked(false)
+}
+
+// fresh returns the document in memory if it is younger than the ttl
+func (cache *documentCache[T]) fresh() (Cached[T], bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cache.cached != nil && time.Since(cache.cached.RetrievedAt) < cache.ttl {
+		return *cache.cached, true
+	}
+	return Cached[T]{}, false
+}
+
+// refreshLocked fetches the document, cache.fetchMu must be held
+func (cache *documentCache[T]) refreshLocked(allowStale bool) (Cached[T], error) {
+	value, err := cache.fetch()
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if err == nil {
+		cache.cached = &Cached[T]{Value: value, RetrievedAt: time.Now()}
+		// failing to write the snapshot only loses the fallback
+		cache.writeSnapshot(*cache.cached)
+		return *cache.cached, nil
+	}
+	if !allowStale {
+		return Cached[T]{}, err
+	}
+	if cache.cached != nil {
+		stale := *cache.cached
+		stale.Stale = true
+		return stale, nil
+	}
+	if snapshot, snapshotErr := cache.readSnapshot(); snapshotErr == nil {
+		snapshot.Stale = true
+		cache.cached = &snapshot
+		return snapshot, nil
+	}
+	return Cached[T]{}, err
+}
+
+func (cache *documentCache[T]) readSnapshot() (Cached[T], error) {
+	var snapshot Cached[T]
+	if cache.snapshotPath == "" {
+		return snapshot, errorhelper.AddStackToError(fmt.Errorf("no snapshot directory"))
+	}
+	data, err := ioutil.ReadFile(cache.snapshotPath)
+	if err != nil {
+		return snapshot, errorhelper.AddStackToError(err)
+	}
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return snapshot, errorhelper.AddStackToError(fmt.Errorf("unable to deserialize snapshot %s: %v", cache.snapshotPath, err))
+	}
+	return snapshot, nil
+}
+
+func (cache *documentCache[T]) writeSnapshot(snapshot Cached[T]) error {
+	if cache.snapshotPath == "" {
+		return nil
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return errorhelper.AddStackToError(err)
+	}
+	temp, err := ioutil.TempFile(filepath.Dir(cache.snapshotPath), filepath.Base(cache.snapshotPath)+".*")
+	if err != nil {
+		return errorhelper.AddStackToError(err)
+	}
+	defer os.Remove(temp.Name())
+	if err := temp.Chmod(snapshotFileMode); err != nil {
+		temp.Close()
+		return errorhelper.AddStackToError(err)
+	}
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return errorhelper.AddStackToError(err)
+	}
+	if err := temp.Close(); err != nil {
+		return errorhelper.AddStackToError(err)
+	}
+	return errorhelper.AddStackToError(os.Rename(temp.Name(), cache.snapshotPath))
+}
+
+// CachingMetadataProvider serves instance metadata from memory and from a snapshot file, it is safe for concurrent
+// use
+type CachingMetadataProvider struct {
+	cache *documentCache[Metadata]
+}
+
+// NewCachingMetadataProvider returns a provider caching the metadata returned by provider according to options
+func NewCachingMetadataProvider(provider MetadataProvider, options CacheOptions) *CachingMetadataProvider {
+	if provider == nil {
+		panic("provider must be specified")
+	}
+	return &CachingMetadataProvider{cache: newDocumentCache(provider.GetMetadata, options, metadataSnapshotName)}
+}
+
+// GetMetadata returns the cached metadata, possibly stale if the instance metadata service can't be reached
+func (provider *CachingMetadataProvider) GetMetadata() (Metadata, error) {
+	cached, err := provider.cache.get()
+	return cached.Value, err
+}
+
+// GetCachedMetadata returns the cached metadata with the time it was retrieved and whether it is stale
+func (provider *CachingMetadataProvider) GetCachedMetadata() (Cached[Metadata], error) {
+	return provider.cache.get()
+}
+
+// Refresh requests the metadata from the instance metadata service regardless of the ttl, it never returns stale
+// metadata
+func (provider *CachingMetadataProvider) Refresh() (Metadata, error) {
+	cached, err := provider.cache.refresh()
+	return cached.Value, err
+}
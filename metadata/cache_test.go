@@ -0,0 +1,135 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package metadata
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeMetadataProvider struct {
+	mu       sync.Mutex
+	calls    int
+	metadata Metadata
+	err      error
+}
+
+func (provider *fakeMetadataProvider) GetMetadata() (Metadata, error) {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+	provider.calls++
+	return provider.metadata, provider.err
+}
+
+func (provider *fakeMetadataProvider) setTags(tags string) {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+	provider.metadata.Compute.Tags = tags
+}
+
+func TestCachingMetadataProviderServesFromMemory(t *testing.T) {
+	fake := &fakeMetadataProvider{metadata: Metadata{Compute: MetadataCompute{Name: "vm"}}}
+	provider := NewCachingMetadataProvider(fake, CacheOptions{DisableSnapshot: true})
+	for i := 0; i < 3; i++ {
+		metadata, err := provider.GetMetadata()
+		if err != nil || metadata.Compute.Name != "vm" {
+			t.Fatalf("unexpected metadata %v: %v", metadata, err)
+		}
+	}
+	if fake.calls != 1 {
+		t.Fatalf("expected a single request, got %d", fake.calls)
+	}
+
+	fake.metadata.Compute.Name = "renamed"
+	metadata, err := provider.Refresh()
+	if err != nil || metadata.Compute.Name != "renamed" || fake.calls != 2 {
+		t.Fatalf("refresh didn't request the metadata: %v %v", metadata, err)
+	}
+}
+
+func TestCachingMetadataProviderReturnsStaleMetadata(t *testing.T) {
+	fake := &fakeMetadataProvider{metadata: Metadata{Compute: MetadataCompute{Name: "vm"}}}
+	provider := NewCachingMetadataProvider(fake, CacheOptions{Ttl: time.Nanosecond, DisableSnapshot: true})
+	if _, err := provider.GetMetadata(); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.err = fmt.Errorf("unreachable")
+	cached, err := provider.GetCachedMetadata()
+	if err != nil || !cached.Stale || cached.Value.Compute.Name != "vm" {
+		t.Fatalf("expected stale metadata, got %v: %v", cached, err)
+	}
+	if _, err := provider.Refresh(); err == nil {
+		t.Fatal("refresh returned stale metadata")
+	}
+}
+
+func TestCachingMetadataProviderUsesSnapshot(t *testing.T) {
+	directory, err := ioutil.TempDir("", "metadatacache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	fake := &fakeMetadataProvider{metadata: Metadata{Compute: MetadataCompute{Name: "vm"}}}
+	if _, err := NewCachingMetadataProvider(fake, CacheOptions{SnapshotDirectory: directory}).GetMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(directory, metadataSnapshotName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != snapshotFileMode {
+		t.Fatalf("unexpected snapshot permissions %v", info.Mode().Perm())
+	}
+
+	// a new process starting while the instance metadata service is unreachable
+	unreachable := &fakeMetadataProvider{err: fmt.Errorf("unreachable")}
+	cached, err := NewCachingMetadataProvider(unreachable, CacheOptions{SnapshotDirectory: directory}).GetCachedMetadata()
+	if err != nil || !cached.Stale || cached.Value.Compute.Name != "vm" || cached.RetrievedAt.IsZero() {
+		t.Fatalf("expected the snapshot, got %v: %v", cached, err)
+	}
+
+	empty, err := ioutil.TempDir("", "metadatacache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(empty)
+	if _, err := NewCachingMetadataProvider(unreachable, CacheOptions{SnapshotDirectory: empty}).GetMetadata(); err == nil {
+		t.Fatal("expected an error without snapshot")
+	}
+}
+
+func TestSlowRefreshDoesNotBlockCachedReads(t *testing.T) {
+	release := make(chan struct{})
+	fetches := 0
+	cache := newDocumentCache(func() (string, error) {
+		fetches++
+		if fetches > 1 {
+			<-release
+		}
+		return "document", nil
+	}, CacheOptions{Ttl: time.Hour, DisableSnapshot: true}, "")
+	if _, err := cache.get(); err != nil {
+		t.Fatal(err)
+	}
+
+	go cache.refresh()
+	done := make(chan struct{})
+	go func() {
+		cache.get()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("cached read waited for the refresh")
+	}
+	close(release)
+}
@@ -0,0 +1,182 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package metadata
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// MetadataCompute follows the compute schema of DefaultApiVersion. Fields introduced by newer versions are empty when
+// an older version was returned. The instance metadata service reports booleans and numbers as strings.
+type MetadataCompute struct {
+	AzEnvironment          string                 `json:"azEnvironment"`
+	AdditionalCapabilities AdditionalCapabilities `json:"additionalCapabilities"`
+	EvictionPolicy         string                 `json:"evictionPolicy"`
+	ExtendedLocation       ExtendedLocation       `json:"extendedLocation"`
+	Host                   SubResource            `json:"host"`
+	HostGroup              SubResource            `json:"hostGroup"`
+	LicenseType            string                 `json:"licenseType"`
+	Location               string                 `json:"location"`
+	Name                   string                 `json:"name"`
+	Offer                  string                 `json:"offer"`
+	OsProfile              OsProfile              `json:"osProfile"`
+	OsType                 string                 `json:"osType"`
+	PlacementGroupId       string                 `json:"placementGroupId"`
+	Plan                   Plan                   `json:"plan"`
+	PlatformFaultDomain    string                 `json:"platformFaultDomain"`
+	PlatformSubFaultDomain string                 `json:"platformSubFaultDomain"`
+	PlatformUpdateDomain   string                 `json:"platformUpdateDomain"`
+	Priority               string                 `json:"priority"`
+	Provider               string                 `json:"provider"`
+	PublicKeys             []PublicKey            `json:"publicKeys"`
+	Publisher              string                 `json:"publisher"`
+	ResourceGroupName      string                 `json:"resourceGroupName"`
+	ResourceId             string                 `json:"resourceId"`
+	SecurityProfile        SecurityProfile        `json:"securityProfile"`
+	Sku                    string                 `json:"sku"`
+	StorageProfile         StorageProfile         `json:"storageProfile"`
+	SubscriptionId         string                 `json:"subscriptionId"`
+	Tags                   interface{}            `json:"tags"`
+	TagsList               []Tag                  `json:"tagsList"`
+	UserData               string                 `json:"userData"`
+	Version                string                 `json:"version"`
+	VirtualMachineScaleSet SubResource            `json:"virtualMachineScaleSet"`
+	VmId                   string                 `json:"vmId"`
+	VmScaleSetName         string                 `json:"vmScaleSetName"`
+	VmSize                 string                 `json:"vmSize"`
+	Zone                   string                 `json:"zone"`
+
+	// Deprecated: misspelled, use PlatformUpdateDomain
+	PlatformUpdateDomatin string `json:"-"`
+}
+
+type AdditionalCapabilities struct {
+	HibernationEnabled string `json:"hibernationEnabled"`
+}
+
+type ExtendedLocation struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+type SubResource struct {
+	Id string `json:"id"`
+}
+
+type OsProfile struct {
+	AdminUsername                 string `json:"adminUsername"`
+	ComputerName                  string `json:"computerName"`
+	DisablePasswordAuthentication string `json:"disablePasswordAuthentication"`
+}
+
+type Plan struct {
+	Name      string `json:"name"`
+	Product   string `json:"product"`
+	Publisher string `json:"publisher"`
+}
+
+type PublicKey struct {
+	KeyData string `json:"keyData"`
+	Path    string `json:"path"`
+}
+
+type SecurityProfile struct {
+	SecureBootEnabled string `json:"secureBootEnabled"`
+	VirtualTpmEnabled string `json:"virtualTpmEnabled"`
+	EncryptionAtHost  string `json:"encryptionAtHost"`
+	SecurityType      string `json:"securityType"`
+}
+
+type Tag struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type StorageProfile struct {
+	DataDisks      []DataDisk     `json:"dataDisks"`
+	ImageReference ImageReference `json:"imageReference"`
+	OsDisk         OsDisk         `json:"osDisk"`
+	ResourceDisk   ResourceDisk   `json:"resourceDisk"`
+}
+
+type ImageReference struct {
+	Id        string `json:"id"`
+	Offer     string `json:"offer"`
+	Publisher string `json:"publisher"`
+	Sku       string `json:"sku"`
+	Version   string `json:"version"`
+}
+
+type ManagedDisk struct {
+	Id                 string `json:"id"`
+	StorageAccountType string `json:"storageAccountType"`
+}
+
+type DiskUri struct {
+	Uri string `json:"uri"`
+}
+
+type OsDisk struct {
+	Caching          string `json:"caching"`
+	CreateOption     string `json:"createOption"`
+	DiffDiskSettings struct {
+		Option string `json:"option"`
+	} `json:"diffDiskSettings"`
+	DiskSizeGB         string `json:"diskSizeGB"`
+	EncryptionSettings struct {
+		Enabled string `json:"enabled"`
+	} `json:"encryptionSettings"`
+	Image                   DiskUri     `json:"image"`
+	ManagedDisk             ManagedDisk `json:"managedDisk"`
+	Name                    string      `json:"name"`
+	OsType                  string      `json:"osType"`
+	Vhd                     DiskUri     `json:"vhd"`
+	WriteAcceleratorEnabled string      `json:"writeAcceleratorEnabled"`
+}
+
+type DataDisk struct {
+	BytesPerSecondThrottle  string      `json:"bytesPerSecondThrottle"`
+	Caching                 string      `json:"caching"`
+	CreateOption            string      `json:"createOption"`
+	DiskCapacityBytes       string      `json:"diskCapacityBytes"`
+	DiskSizeGB              string      `json:"diskSizeGB"`
+	Image                   DiskUri     `json:"image"`
+	IsSharedDisk            string      `json:"isSharedDisk"`
+	IsUltraDisk             string      `json:"isUltraDisk"`
+	Lun                     string      `json:"lun"`
+	ManagedDisk             ManagedDisk `json:"managedDisk"`
+	Name                    string      `json:"name"`
+	OpsPerSecondThrottle    string      `json:"opsPerSecondThrottle"`
+	Vhd                     DiskUri     `json:"vhd"`
+	WriteAcceleratorEnabled string      `json:"writeAcceleratorEnabled"`
+}
+
+type ResourceDisk struct {
+	Size string `json:"size"`
+}
+
+func (compute *MetadataCompute) UnmarshalJSON(data []byte) error {
+	type metadataCompute MetadataCompute
+	if err := json.Unmarshal(data, (*metadataCompute)(compute)); err != nil {
+		return err
+	}
+	compute.PlatformUpdateDomatin = compute.PlatformUpdateDomain
+	return nil
+}
+
+// IsSpot returns true for Azure Spot virtual machines, which may be evicted
+func (compute *MetadataCompute) IsSpot() bool {
+	return strings.EqualFold(compute.Priority, "Spot")
+}
+
+// IsSecureBootEnabled returns true for trusted launch and confidential virtual machines booted with secure boot
+func (profile SecurityProfile) IsSecureBootEnabled() bool {
+	return strings.EqualFold(profile.SecureBootEnabled, "true")
+}
+
+// IsVirtualTpmEnabled returns true if the virtual machine has a virtual trusted platform module
+func (profile SecurityProfile) IsVirtualTpmEnabled() bool {
+	return strings.EqualFold(profile.VirtualTpmEnabled, "true")
+}
@@ -0,0 +1,140 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package metadata
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/Azure/azure-extension-foundation/httputil"
+)
+
+const modernComputeJson = `{"compute": {
+	"azEnvironment": "AzurePublicCloud",
+	"evictionPolicy": "Deallocate",
+	"extendedLocation": {"type": "edgeZone", "name": "microsoftlosangeles1"},
+	"hostGroup": {"id": "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/hostGroups/hg"},
+	"licenseType": "Windows_Server",
+	"name": "vm",
+	"osProfile": {"adminUsername": "azureuser", "computerName": "vm", "disablePasswordAuthentication": "true"},
+	"platformUpdateDomain": "3",
+	"priority": "Spot",
+	"resourceId": "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm",
+	"securityProfile": {"secureBootEnabled": "true", "virtualTpmEnabled": "false"},
+	"storageProfile": {
+		"dataDisks": [{"lun": "0", "diskSizeGB": "1024", "managedDisk": {"storageAccountType": "Premium_LRS"}}],
+		"imageReference": {"offer": "UbuntuServer", "publisher": "Canonical", "sku": "18.04-LTS", "version": "latest"},
+		"osDisk": {"diffDiskSettings": {"option": "Local"}, "diskSizeGB": "30", "osType": "Linux"},
+		"resourceDisk": {"size": "16384"}
+	},
+	"tagsList": [{"name": "owner", "value": "me"}],
+	"userData": "aGVsbG8=",
+	"vmScaleSetName": "",
+	"zone": "1"
+}}`
+
+func TestModernComputeSchema(t *testing.T) {
+	jsonString := modernComputeJson
+	metadata, err := GetMetadataFromJsonString(&jsonString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compute := metadata.Compute
+	if compute.Zone != "1" || compute.ExtendedLocation.Name != "microsoftlosangeles1" || compute.HostGroup.Id == "" {
+		t.Fatalf("unexpected compute %+v", compute)
+	}
+	if !compute.IsSpot() || !compute.SecurityProfile.IsSecureBootEnabled() || compute.SecurityProfile.IsVirtualTpmEnabled() {
+		t.Fatalf("unexpected compute %+v", compute)
+	}
+	if len(compute.StorageProfile.DataDisks) != 1 || compute.StorageProfile.OsDisk.DiffDiskSettings.Option != "Local" {
+		t.Fatalf("unexpected storage profile %+v", compute.StorageProfile)
+	}
+	if len(compute.TagsList) != 1 || compute.TagsList[0].Value != "me" || compute.UserData != "aGVsbG8=" {
+		t.Fatalf("unexpected compute %+v", compute)
+	}
+	if compute.PlatformUpdateDomain != "3" || compute.PlatformUpdateDomatin != "3" {
+		t.Fatal("platform update domain was not decoded into both fields")
+	}
+}
+
+func TestGetMetadataFallsBackToOlderApiVersion(t *testing.T) {
+	var requested []string
+	prov := NewMetadataProvider(&httputil.MockHttpClient{Getfunc: func(requestUrl string, headers map[string]string) (int, []byte, error) {
+		u, err := url.Parse(requestUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		version := u.Query().Get("api-version")
+		requested = append(requested, version)
+		if version > "2020-09-01" {
+			return 400, []byte(`{"error": "Bad request. api-version is invalid or was not specified in the request."}`), nil
+		}
+		return 200, []byte(dummyMetadataJson), nil
+	}})
+
+	metadata, err := prov.GetMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Compute.Name != "some-computer" {
+		t.Fatalf("unexpected metadata %+v", metadata.Compute)
+	}
+	if len(requested) != 3 || requested[0] != DefaultApiVersion || requested[2] != "2020-09-01" {
+		t.Fatalf("unexpected api versions %v", requested)
+	}
+}
+
+func TestGetMetadataRemembersAcceptedApiVersion(t *testing.T) {
+	var requested []string
+	prov := NewMetadataProvider(&httputil.MockHttpClient{Getfunc: func(requestUrl string, headers map[string]string) (int, []byte, error) {
+		u, _ := url.Parse(requestUrl)
+		version := u.Query().Get("api-version")
+		requested = append(requested, version)
+		if version > "2020-09-01" {
+			return 400, []byte(`{"error": "Bad request. api-version is invalid or was not specified in the request."}`), nil
+		}
+		return 200, []byte(dummyMetadataJson), nil
+	}})
+
+	for i := 0; i < 2; i++ {
+		if _, err := prov.GetMetadata(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(requested) != 4 || requested[3] != "2020-09-01" {
+		t.Fatalf("accepted api version wasn't remembered: %v", requested)
+	}
+}
+
+func TestGetMetadataDoesNotFallBackOnOtherBadRequests(t *testing.T) {
+	var requested []string
+	prov := NewMetadataProvider(&httputil.MockHttpClient{Getfunc: func(requestUrl string, headers map[string]string) (int, []byte, error) {
+		u, _ := url.Parse(requestUrl)
+		requested = append(requested, u.Query().Get("api-version"))
+		return 400, []byte(`{"error": "Bad request. Required metadata header not specified"}`), nil
+	}})
+
+	if _, err := prov.GetMetadata(); err == nil {
+		t.Fatal("400 was not returned as an error")
+	}
+	if len(requested) != 1 {
+		t.Fatalf("request was retried with other api versions: %v", requested)
+	}
+}
+
+func TestGetMetadataStartsWithSelectedApiVersion(t *testing.T) {
+	var requested []string
+	prov := NewMetadataProviderWithApiVersion(&httputil.MockHttpClient{Getfunc: func(requestUrl string, headers map[string]string) (int, []byte, error) {
+		u, _ := url.Parse(requestUrl)
+		requested = append(requested, u.Query().Get("api-version"))
+		return 400, []byte(`{"error": "Bad request. api-version is invalid or was not specified in the request."}`), nil
+	}}, "2019-03-11")
+
+	if _, err := prov.GetMetadata(); err == nil {
+		t.Fatal("400 was not returned as an error")
+	}
+	if len(requested) != 2 || requested[0] != "2019-03-11" || requested[1] != "2017-08-01" {
+		t.Fatalf("unexpected api versions %v", requested)
+	}
+}
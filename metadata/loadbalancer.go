@@ -0,0 +1,137 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package metadata
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+
+	"github.com/Azure/azure-extension-foundation/errorhelper"
+)
+
+const (
+	loadBalancerPathFormat = "/metadata/loadbalancer?api-version=%s"
+	// loadBalancerApiVersion is the first instance metadata service version returning the load balancer metadata
+	loadBalancerApiVersion = "2020-10-01"
+
+	loadBalancerSnapshotName = "loadbalancer.json"
+)
+
+// LoadBalancerMetadataProvider returns the metadata of the standard load balancer in front of the machine
+type LoadBalancerMetadataProvider interface {
+	GetLoadBalancerMetadata() (LoadBalancerMetadata, error)
+}
+
+// LoadBalancerMetadata describes how the standard load balancer in front of the machine reaches it. Addresses are
+// IPv4 or IPv6 for dual stack load balancers.
+type LoadBalancerMetadata struct {
+	// PublicIpAddresses maps the public frontend addresses to the private backend addresses of the machine
+	PublicIpAddresses []LoadBalancerIpAddress `json:"publicIpAddresses"`
+	InboundRules      []LoadBalancerRule      `json:"inboundRules"`
+	OutboundRules     []LoadBalancerIpAddress `json:"outboundRules"`
+}
+
+type LoadBalancerIpAddress struct {
+	FrontendIpAddress string `json:"frontendIpAddress"`
+	PrivateIpAddress  string `json:"privateIpAddress"`
+}
+
+// LoadBalancerRule is a load balancing or inbound NAT rule forwarding FrontendPort to BackendPort of the machine
+type LoadBalancerRule struct {
+	FrontendIpAddress string `json:"frontendIpAddress"`
+	Protocol          string `json:"protocol"`
+	FrontendPort      int    `json:"frontendPort"`
+	BackendPort       int    `json:"backendPort"`
+	PrivateIpAddress  string `json:"privateIpAddress"`
+}
+
+type loadBalancerResponse struct {
+	LoadBalancer LoadBalancerMetadata `json:"loadbalancer"`
+}
+
+// IsIPv6 returns true if the frontend address is an IPv6 address
+func (address LoadBalancerIpAddress) IsIPv6() bool {
+	return isIPv6(address.FrontendIpAddress)
+}
+
+// IsIPv6 returns true if the frontend address of the rule is an IPv6 address
+func (rule LoadBalancerRule) IsIPv6() bool {
+	return isIPv6(rule.FrontendIpAddress)
+}
+
+// FrontendIpAddresses returns the distinct public frontend addresses of the load balancer
+func (lb *LoadBalancerMetadata) FrontendIpAddresses() []net.IP {
+	var addresses []net.IP
+	seen := map[string]bool{}
+	for _, address := range lb.PublicIpAddresses {
+		ip := net.ParseIP(address.FrontendIpAddress)
+		if ip != nil && !seen[ip.String()] {
+			seen[ip.String()] = true
+			addresses = append(addresses, ip)
+		}
+	}
+	return addresses
+}
+
+// InboundRulesFor returns the inbound rules forwarding to backendPort over protocol, e.g. tcp
+func (lb *LoadBalancerMetadata) InboundRulesFor(protocol string, backendPort int) []LoadBalancerRule {
+	var rules []LoadBalancerRule
+	for _, rule := range lb.InboundRules {
+		if strings.EqualFold(rule.Protocol, protocol) && rule.BackendPort == backendPort {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+func isIPv6(address string) bool {
+	ip := net.ParseIP(address)
+	return ip != nil && ip.To4() == nil
+}
+
+// GetLoadBalancerMetadata returns the metadata of the standard load balancer in front of the machine
+func (provider *provider) GetLoadBalancerMetadata() (LoadBalancerMetadata, error) {
+	responseBody, err := provider.getDocument(loadBalancerPathFormat, loadBalancerApiVersion, "load balancer metadata")
+	if err != nil {
+		return LoadBalancerMetadata{}, err
+	}
+	retval := loadBalancerResponse{}
+	err = json.Unmarshal(responseBody, &retval)
+	return retval.LoadBalancer, errorhelper.AddStackToError(err)
+}
+
+// CachingLoadBalancerMetadataProvider serves load balancer metadata from memory and from a snapshot file, it is safe
+// for concurrent use
+type CachingLoadBalancerMetadataProvider struct {
+	cache *documentCache[LoadBalancerMetadata]
+}
+
+// NewCachingLoadBalancerMetadataProvider returns a provider caching the metadata returned by provider according to
+// options
+func NewCachingLoadBalancerMetadataProvider(provider LoadBalancerMetadataProvider, options CacheOptions) *CachingLoadBalancerMetadataProvider {
+	if provider == nil {
+		panic("provider must be specified")
+	}
+	return &CachingLoadBalancerMetadataProvider{cache: newDocumentCache(provider.GetLoadBalancerMetadata, options, loadBalancerSnapshotName)}
+}
+
+// GetLoadBalancerMetadata returns the cached metadata, possibly stale if the instance metadata service can't be
+// reached
+func (provider *CachingLoadBalancerMetadataProvider) GetLoadBalancerMetadata() (LoadBalancerMetadata, error) {
+	cached, err := provider.cache.get()
+	return cached.Value, err
+}
+
+// GetCachedLoadBalancerMetadata returns the cached metadata with the time it was retrieved and whether it is stale
+func (provider *CachingLoadBalancerMetadataProvider) GetCachedLoadBalancerMetadata() (Cached[LoadBalancerMetadata], error) {
+	return provider.cache.get()
+}
+
+// Refresh requests the metadata from the instance metadata service regardless of the ttl, it never returns stale
+// metadata
+func (provider *CachingLoadBalancerMetadataProvider) Refresh() (LoadBalancerMetadata, error) {
+	cached, err := provider.cache.refresh()
+	return cached.Value, err
+}
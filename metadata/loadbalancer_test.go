@@ -0,0 +1,92 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package metadata
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/Azure/azure-extension-foundation/httputil"
+)
+
+var dummyLoadBalancerJson = `{
+  "loadbalancer": {
+    "publicIpAddresses": [
+      {"frontendIpAddress": "51.0.0.1", "privateIpAddress": "10.1.0.4"},
+      {"frontendIpAddress": "2603:1030:20e:3::1", "privateIpAddress": "ace:cab:deca::4"}
+    ],
+    "inboundRules": [
+      {"frontendIpAddress": "51.0.0.1", "protocol": "tcp", "frontendPort": 80, "backendPort": 8080, "privateIpAddress": "10.1.0.4"},
+      {"frontendIpAddress": "51.0.0.1", "protocol": "tcp", "frontendPort": 50001, "backendPort": 22, "privateIpAddress": "10.1.0.4"},
+      {"frontendIpAddress": "2603:1030:20e:3::1", "protocol": "tcp", "frontendPort": 80, "backendPort": 8080, "privateIpAddress": "ace:cab:deca::4"}
+    ],
+    "outboundRules": [
+      {"frontendIpAddress": "51.0.0.2", "privateIpAddress": "10.1.0.4"}
+    ]
+  }
+}`
+
+func TestGetLoadBalancerMetadata(t *testing.T) {
+	var requested []string
+	prov := NewMetadataProvider(&httputil.MockHttpClient{Getfunc: func(requestUrl string, headers map[string]string) (int, []byte, error) {
+		u, _ := url.Parse(requestUrl)
+		if u.Path != "/metadata/loadbalancer" || headers["Metadata"] != "true" {
+			t.Fatalf("unexpected request %s %v", requestUrl, headers)
+		}
+		requested = append(requested, u.Query().Get("api-version"))
+		if u.Query().Get("api-version") > "2021-02-01" {
+			return 400, []byte(`{"error": "Bad request. api-version is invalid or was not specified in the request.", "newest-versions": ["2020-09-01"]}`), nil
+		}
+		return 200, []byte(dummyLoadBalancerJson), nil
+	}})
+	lb, err := prov.GetLoadBalancerMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requested) != 2 {
+		t.Fatalf("unexpected api versions %v", requested)
+	}
+
+	frontends := lb.FrontendIpAddresses()
+	if len(frontends) != 2 || frontends[0].String() != "51.0.0.1" || frontends[1].String() != "2603:1030:20e:3::1" {
+		t.Fatalf("unexpected frontend addresses %v", frontends)
+	}
+	if lb.PublicIpAddresses[0].IsIPv6() || !lb.PublicIpAddresses[1].IsIPv6() {
+		t.Fatal("address families were not detected")
+	}
+	rules := lb.InboundRulesFor("TCP", 8080)
+	if len(rules) != 2 || rules[0].FrontendPort != 80 || !rules[1].IsIPv6() {
+		t.Fatalf("unexpected rules %+v", rules)
+	}
+	if len(lb.OutboundRules) != 1 || lb.OutboundRules[0].FrontendIpAddress != "51.0.0.2" {
+		t.Fatalf("unexpected outbound rules %+v", lb.OutboundRules)
+	}
+}
+
+func TestGetLoadBalancerMetadataRequiresSupportingApiVersion(t *testing.T) {
+	prov := NewMetadataProviderWithApiVersion(&httputil.MockHttpClient{Getfunc: func(requestUrl string, headers map[string]string) (int, []byte, error) {
+		t.Fatalf("unexpected request %s", requestUrl)
+		return 0, nil, nil
+	}}, "2019-03-11")
+	if _, err := prov.GetLoadBalancerMetadata(); err == nil {
+		t.Fatal("load balancer metadata was requested from an api version not supporting it")
+	}
+}
+
+func TestCachingLoadBalancerMetadataProvider(t *testing.T) {
+	calls := 0
+	prov := NewMetadataProvider(&httputil.MockHttpClient{Getfunc: func(requestUrl string, headers map[string]string) (int, []byte, error) {
+		calls++
+		return 200, []byte(dummyLoadBalancerJson), nil
+	}})
+	cached := NewCachingLoadBalancerMetadataProvider(&prov, CacheOptions{DisableSnapshot: true})
+	for i := 0; i < 2; i++ {
+		if lb, err := cached.GetLoadBalancerMetadata(); err != nil || len(lb.InboundRules) != 3 {
+			t.Fatalf("unexpected metadata %+v: %v", lb, err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("expected a single request, got %d", calls)
+	}
+}
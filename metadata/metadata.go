@@ -8,43 +8,95 @@ import (
 	"fmt"
 	"github.com/Azure/azure-extension-foundation/errorhelper"
 	"github.com/Azure/azure-extension-foundation/httputil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
 )
 
-const metadataUrl = "http://169.254.169.254/metadata/instance?api-version=2017-08-01"
+const (
+	// ImdsEndpointEnvVar overrides the address of the instance metadata service, e.g. to point to an emulator. Azure Arc
+	// sets it to its hybrid instance metadata service.
+	ImdsEndpointEnvVar  = "IMDS_ENDPOINT"
+	defaultImdsEndpoint = "http://169.254.169.254"
+
+	metadataPathFormat = "/metadata/instance?api-version=%s"
+)
+
+// DefaultApiVersion is the instance metadata service version the compute schema follows
+const DefaultApiVersion = "2023-07-01"
+
+// SupportedApiVersions lists the versions requested, newest first, when an older instance metadata service rejects
+// a version with 400 Bad Request, e.g. on Azure Stack Hub. 2019-03-11 is the first version returning
+// compute.resourceId.
+var SupportedApiVersions = []string{DefaultApiVersion, "2021-02-01", "2020-09-01", "2019-03-11", "2017-08-01"}
+
+const hybridComputeProvider = "Microsoft.HybridCompute"
 
 type Metadata struct {
 	Compute MetadataCompute `json:"compute"`
 	Network MetadataNetwork `json:"network"`
 }
 
-type MetadataNetwork struct {
-	Intrfc []map[string]interface{} `json:"interface"`
-}
-
 type provider struct {
 	httpClient httputil.HttpClient
+	apiVersion string
+	// accepted holds the api version each endpoint accepted, shared by the copies of the provider
+	accepted *acceptedApiVersions
+}
+
+// acceptedApiVersions remembers the api version accepted per path format so that later requests don't go through
+// the rejected versions again
+type acceptedApiVersions struct {
+	mu       sync.Mutex
+	versions map[string]string
+}
+
+func (accepted *acceptedApiVersions) get(pathFormat string) string {
+	if accepted == nil {
+		return ""
+	}
+	accepted.mu.Lock()
+	defer accepted.mu.Unlock()
+	return accepted.versions[pathFormat]
+}
+
+func (accepted *acceptedApiVersions) set(pathFormat string, apiVersion string) {
+	if accepted == nil {
+		return
+	}
+	accepted.mu.Lock()
+	defer accepted.mu.Unlock()
+	accepted.versions[pathFormat] = apiVersion
 }
 
+// NewMetadataProvider returns a provider issuing its requests through client, throttled by the shared
+// instance metadata service rate limiter
 func NewMetadataProvider(client httputil.HttpClient) provider {
-	return provider{httpClient: client}
-}
-
-type MetadataCompute struct {
-	Location              string      `json:"location"`
-	Name                  string      `json:"name"`
-	Offer                 string      `json:"offer"`
-	OsType                string      `json:"osType"`
-	PlacementGroupId      string      `json:"placementGroupId"`
-	PlatformFaultDomain   string      `json:"platformFaultDomain"`
-	PlatformUpdateDomatin string      `json:"platformUpdateDomain"`
-	Publisher             string      `json:"publisher"`
-	ResourceGroupName     string      `json:"resourceGroupName"`
-	Sku                   string      `json:"sku"`
-	SubscriptionId        string      `json:"subscriptionId"`
-	Tags                  interface{} `json:"tags"`
-	Version               string      `json:"version"`
-	VmId                  string      `json:"vmId"`
-	VmSize                string      `json:"vmSize"`
+	return NewMetadataProviderWithApiVersion(client, DefaultApiVersion)
+}
+
+// NewMetadataProviderWithApiVersion returns a provider requesting apiVersion first and falling back to the older
+// SupportedApiVersions if the instance metadata service doesn't support it
+func NewMetadataProviderWithApiVersion(client httputil.HttpClient, apiVersion string) provider {
+	return provider{
+		httpClient: httputil.NewThrottledHttpClient(client, httputil.ImdsRateLimiter, nil),
+		apiVersion: apiVersion,
+		accepted:   &acceptedApiVersions{versions: make(map[string]string)},
+	}
+}
+
+// GetImdsEndpoint returns the address of the instance metadata service
+func GetImdsEndpoint() string {
+	if endpoint := os.Getenv(ImdsEndpointEnvVar); endpoint != "" {
+		return strings.TrimSuffix(endpoint, "/")
+	}
+	return defaultImdsEndpoint
+}
+
+// imdsUrl returns the url of pathAndQuery on the instance metadata service
+func imdsUrl(pathAndQuery string) string {
+	return GetImdsEndpoint() + pathAndQuery
 }
 
 func GetMetadataFromJsonString(jsonString *string) (Metadata, error) {
@@ -54,45 +106,131 @@ func GetMetadataFromJsonString(jsonString *string) (Metadata, error) {
 	return retval, err
 }
 
+// GetIpV4PublicAddress returns the first public IPv4 address of the primary network interface, or 0.0.0.0 if it has
+// none
 func (metadata *Metadata) GetIpV4PublicAddress() string {
 	defaultIp := "0.0.0.0"
-	interface0Bytes, err := json.Marshal(metadata.Network.Intrfc[0]["ipv4"])
-	if err != nil {
-		return defaultIp
-	}
-	var interface0ipv4 map[string][]map[string]string
-	err = json.Unmarshal(interface0Bytes, &interface0ipv4)
-	if err != nil {
+	primary, ok := metadata.Network.PrimaryInterface()
+	if !ok {
 		return defaultIp
 	}
-	retval := ""
-	if len(interface0ipv4["ipAddress"]) > 0 {
-		retval = interface0ipv4["ipAddress"][0]["publicIpAddress"]
+	for _, address := range primary.Ipv4.IpAddress {
+		if address.PublicIpAddress != "" {
+			return address.PublicIpAddress
+		}
 	}
+	return defaultIp
+}
 
-	if retval == "" {
-		return defaultIp
+// GetAzureResourceId returns the resource id reported by the instance metadata service, or derives it for
+// instance metadata service versions not reporting it
+func (metadata *Metadata) GetAzureResourceId() string {
+	if metadata.Compute.ResourceId != "" {
+		return metadata.Compute.ResourceId
 	}
-	return retval
+	compute := metadata.Compute
+	prefix := fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers", compute.SubscriptionId, compute.ResourceGroupName)
+	switch {
+	case strings.EqualFold(compute.Provider, hybridComputeProvider):
+		return fmt.Sprintf("%s/Microsoft.HybridCompute/machines/%s", prefix, compute.Name)
+	case compute.VmScaleSetName != "":
+		// uniform scale set instances are named {scale set}_{instance id}, flexible orchestration instances are
+		// regular virtual machines
+		if instanceId, ok := uniformScaleSetInstanceId(compute.Name, compute.VmScaleSetName); ok {
+			return fmt.Sprintf("%s/Microsoft.Compute/virtualMachineScaleSets/%s/virtualMachines/%s", prefix, compute.VmScaleSetName, instanceId)
+		}
+	}
+	return fmt.Sprintf("%s/Microsoft.Compute/virtualMachines/%s", prefix, compute.Name)
 }
 
-func (metadata *Metadata) GetAzureResourceId() string {
-	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/virtualMachines/%s",
-		metadata.Compute.SubscriptionId, metadata.Compute.ResourceGroupName, metadata.Compute.Name)
+// GetResourceID returns the parsed resource id of the machine
+func (metadata *Metadata) GetResourceID() (ResourceID, error) {
+	return ParseResourceID(metadata.GetAzureResourceId())
+}
+
+func uniformScaleSetInstanceId(name string, scaleSetName string) (string, bool) {
+	if !strings.HasPrefix(name, scaleSetName+"_") {
+		return "", false
+	}
+	instanceId := strings.TrimPrefix(name, scaleSetName+"_")
+	if instanceId == "" {
+		return "", false
+	}
+	for _, c := range instanceId {
+		if c < '0' || c > '9' {
+			return "", false
+		}
+	}
+	return instanceId, true
 }
 
 func (provider *provider) GetMetadata() (Metadata, error) {
 	retval := Metadata{}
-	responseCode, responseBody, err := provider.httpClient.Get(metadataUrl, map[string]string{"Metadata": "true"})
+	responseBody, err := provider.getDocument(metadataPathFormat, "", "metadata")
 	if err != nil {
 		return retval, err
 	}
-	responseString := string(responseBody[:])
-	if responseCode != 200 {
-		return retval, errorhelper.AddStackToError(
-			errorhelper.AddStackToError(
-				fmt.Errorf("Get request for metadata returned return code %v.\nResponse Body: %s", responseCode, responseString)))
-	}
 	err = json.Unmarshal(responseBody[:], &retval)
 	return retval, errorhelper.AddStackToError(err)
 }
+
+// getDocument requests pathFormat formatted with the supported api versions not older than minimumApiVersion, newest
+// first, until one isn't rejected. The first accepted version is used for later requests.
+func (provider *provider) getDocument(pathFormat string, minimumApiVersion string, description string) ([]byte, error) {
+	var responseCode int
+	var responseBody []byte
+	accepted := provider.accepted.get(pathFormat)
+	for _, apiVersion := range provider.apiVersions() {
+		if apiVersion < minimumApiVersion {
+			break
+		}
+		if accepted != "" && apiVersion > accepted {
+			continue
+		}
+		var err error
+		responseCode, responseBody, err = provider.httpClient.Get(imdsUrl(fmt.Sprintf(pathFormat, apiVersion)), map[string]string{"Metadata": "true"})
+		if err != nil {
+			return nil, err
+		}
+		if !isApiVersionRejection(responseCode, responseBody) {
+			if responseCode == http.StatusOK {
+				provider.accepted.set(pathFormat, apiVersion)
+			}
+			break
+		}
+	}
+	if responseCode == 0 {
+		return nil, errorhelper.AddStackToError(fmt.Errorf("%s requires api version %s or newer", description, minimumApiVersion))
+	}
+	if responseCode != 200 {
+		return nil, errorhelper.AddStackToError(
+			fmt.Errorf("Get request for %s returned return code %v.\nResponse Body: %s", description, responseCode, string(responseBody)))
+	}
+	return responseBody, nil
+}
+
+// isApiVersionRejection returns true if the instance metadata service rejected the api version of a request, other
+// bad requests are not retried with another version
+func isApiVersionRejection(responseCode int, responseBody []byte) bool {
+	if responseCode != http.StatusBadRequest {
+		return false
+	}
+	body := strings.ToLower(string(responseBody))
+	return strings.Contains(body, "api-version") || strings.Contains(body, "newest-versions")
+}
+
+// apiVersions returns the configured version followed by the older supported versions
+func (provider *provider) apiVersions() []string {
+	requested := provider.apiVersion
+	if requested == "" {
+		requested = DefaultApiVersion
+	}
+	versions := []string{requested}
+	for _, version := range SupportedApiVersions {
+		// versions are dates, so they compare lexically
+		if version < requested {
+			versions = append(versions, version)
+		}
+	}
+	return versions
+}
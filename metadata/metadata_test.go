@@ -101,7 +101,7 @@ func TestEmptyHostnameFromMetadata(t *testing.T) {
 func TestRealMetadata(t *testing.T) {
 	t.Skip() // for testing on Azure VM only
 	client := httputil.NewSecureHttpClient(httputil.NoRetry)
-	prov := provider{client}
+	prov := provider{httpClient: client}
 	metadata, err := prov.GetMetadata()
 	if err != nil {
 		t.Fatal(err.Error())
@@ -112,3 +112,47 @@ func TestRealMetadata(t *testing.T) {
 	}
 	ioutil.WriteFile("testoutput/metadata.json", jsonBytes, 0666)
 }
+
+func TestGetAzureResourceId(t *testing.T) {
+	const prefix = "/subscriptions/sub/resourceGroups/rg/providers"
+	tests := []struct {
+		compute  MetadataCompute
+		expected string
+	}{
+		{MetadataCompute{ResourceId: prefix + "/Microsoft.Compute/virtualMachines/fromImds", Name: "vm"}, prefix + "/Microsoft.Compute/virtualMachines/fromImds"},
+		{MetadataCompute{Name: "vm"}, prefix + "/Microsoft.Compute/virtualMachines/vm"},
+		{MetadataCompute{Name: "vmss_12", VmScaleSetName: "vmss"}, prefix + "/Microsoft.Compute/virtualMachineScaleSets/vmss/virtualMachines/12"},
+		{MetadataCompute{Name: "vmss_a1b2c3d4", VmScaleSetName: "vmss"}, prefix + "/Microsoft.Compute/virtualMachines/vmss_a1b2c3d4"},
+		{MetadataCompute{Name: "server", Provider: "Microsoft.HybridCompute"}, prefix + "/Microsoft.HybridCompute/machines/server"},
+	}
+	for _, test := range tests {
+		test.compute.SubscriptionId = "sub"
+		test.compute.ResourceGroupName = "rg"
+		metadata := Metadata{Compute: test.compute}
+		if id := metadata.GetAzureResourceId(); id != test.expected {
+			t.Fatalf("expected %s, got %s", test.expected, id)
+		}
+		if _, err := metadata.GetResourceID(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestResourceIdFieldsFromJson(t *testing.T) {
+	jsonString := `{"compute": {
+		"name": "vmss_3",
+		"vmScaleSetName": "vmss",
+		"resourceId": "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/vmss/virtualMachines/3",
+		"osProfile": {"adminUsername": "azureuser", "computerName": "vmss000003"}}}`
+	metadata, err := GetMetadataFromJsonString(&jsonString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Compute.OsProfile.ComputerName != "vmss000003" || metadata.Compute.VmScaleSetName != "vmss" {
+		t.Fatalf("unexpected compute %+v", metadata.Compute)
+	}
+	id, err := metadata.GetResourceID()
+	if err != nil || id.Name() != "3" {
+		t.Fatalf("unexpected resource id %v %v", id, err)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package metadata
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/Azure/azure-extension-foundation/errorhelper"
+)
+
+type MetadataNetwork struct {
+	// Intrfc lists the network interfaces of the machine, the primary interface first
+	Intrfc []NetworkInterface `json:"interface"`
+}
+
+type NetworkInterface struct {
+	MacAddress string          `json:"macAddress"`
+	Ipv4       IpConfiguration `json:"ipv4"`
+	Ipv6       IpConfiguration `json:"ipv6"`
+}
+
+type IpConfiguration struct {
+	IpAddress []IpAddress `json:"ipAddress"`
+	Subnet    []Subnet    `json:"subnet"`
+}
+
+type IpAddress struct {
+	PrivateIpAddress string `json:"privateIpAddress"`
+	PublicIpAddress  string `json:"publicIpAddress"`
+}
+
+type Subnet struct {
+	Address string `json:"address"`
+	Prefix  string `json:"prefix"`
+}
+
+// IPNet returns the subnet as a net.IPNet, e.g. 10.0.0.0/24
+func (subnet Subnet) IPNet() (*net.IPNet, error) {
+	_, ipNet, err := net.ParseCIDR(fmt.Sprintf("%s/%s", subnet.Address, subnet.Prefix))
+	if err != nil {
+		return nil, errorhelper.AddStackToError(fmt.Errorf("invalid subnet %s/%s: %v", subnet.Address, subnet.Prefix, err))
+	}
+	return ipNet, nil
+}
+
+// Contains returns true if ip belongs to the subnet, invalid subnets contain no address
+func (subnet Subnet) Contains(ip net.IP) bool {
+	ipNet, err := subnet.IPNet()
+	return err == nil && ipNet.Contains(ip)
+}
+
+// PrimaryInterface returns the primary network interface, false if the machine reported none
+func (network *MetadataNetwork) PrimaryInterface() (NetworkInterface, bool) {
+	if len(network.Intrfc) == 0 {
+		return NetworkInterface{}, false
+	}
+	return network.Intrfc[0], true
+}
+
+// PrivateIpV4Addresses returns the private IPv4 addresses of all network interfaces
+func (network *MetadataNetwork) PrivateIpV4Addresses() []string {
+	return network.collect(func(nic NetworkInterface) []IpAddress { return nic.Ipv4.IpAddress },
+		func(address IpAddress) string { return address.PrivateIpAddress })
+}
+
+// PrivateIpV6Addresses returns the private IPv6 addresses of all network interfaces
+func (network *MetadataNetwork) PrivateIpV6Addresses() []string {
+	return network.collect(func(nic NetworkInterface) []IpAddress { return nic.Ipv6.IpAddress },
+		func(address IpAddress) string { return address.PrivateIpAddress })
+}
+
+// PublicIpAddresses returns the public IPv4 and IPv6 addresses of all network interfaces
+func (network *MetadataNetwork) PublicIpAddresses() []string {
+	public := func(address IpAddress) string { return address.PublicIpAddress }
+	return append(
+		network.collect(func(nic NetworkInterface) []IpAddress { return nic.Ipv4.IpAddress }, public),
+		network.collect(func(nic NetworkInterface) []IpAddress { return nic.Ipv6.IpAddress }, public)...)
+}
+
+// SubnetContaining returns the subnet of any network interface the address ip belongs to
+func (network *MetadataNetwork) SubnetContaining(ip string) (Subnet, bool) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return Subnet{}, false
+	}
+	for _, nic := range network.Intrfc {
+		for _, subnets := range [][]Subnet{nic.Ipv4.Subnet, nic.Ipv6.Subnet} {
+			for _, subnet := range subnets {
+				if subnet.Contains(parsed) {
+					return subnet, true
+				}
+			}
+		}
+	}
+	return Subnet{}, false
+}
+
+func (network *MetadataNetwork) collect(addresses func(NetworkInterface) []IpAddress, field func(IpAddress) string) []string {
+	var values []string
+	for _, nic := range network.Intrfc {
+		for _, address := range addresses(nic) {
+			if value := field(address); value != "" {
+				values = append(values, value)
+			}
+		}
+	}
+	return values
+}
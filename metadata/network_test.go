@@ -0,0 +1,92 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package metadata
+
+import (
+	"reflect"
+	"testing"
+)
+
+const multiNicNetworkJson = `{"network": {"interface": [
+	{
+		"macAddress": "000D3AF806EC",
+		"ipv4": {
+			"ipAddress": [{"privateIpAddress": "10.0.0.4", "publicIpAddress": "20.1.2.3"}, {"privateIpAddress": "10.0.0.5", "publicIpAddress": ""}],
+			"subnet": [{"address": "10.0.0.0", "prefix": "24"}]
+		},
+		"ipv6": {
+			"ipAddress": [{"privateIpAddress": "ace:cab:deca::4", "publicIpAddress": "2603:1030::1"}],
+			"subnet": [{"address": "ace:cab:deca::", "prefix": "64"}]
+		}
+	},
+	{
+		"macAddress": "000D3AF806ED",
+		"ipv4": {
+			"ipAddress": [{"privateIpAddress": "10.1.0.4"}],
+			"subnet": [{"address": "10.1.0.0", "prefix": "16"}]
+		},
+		"ipv6": {"ipAddress": []}
+	}
+]}}`
+
+func TestNetworkAccessors(t *testing.T) {
+	jsonString := multiNicNetworkJson
+	metadata, err := GetMetadataFromJsonString(&jsonString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	network := metadata.Network
+
+	primary, ok := network.PrimaryInterface()
+	if !ok || primary.MacAddress != "000D3AF806EC" {
+		t.Fatalf("unexpected primary interface %+v", primary)
+	}
+	if addresses := network.PrivateIpV4Addresses(); !reflect.DeepEqual(addresses, []string{"10.0.0.4", "10.0.0.5", "10.1.0.4"}) {
+		t.Fatalf("unexpected private IPv4 addresses %v", addresses)
+	}
+	if addresses := network.PrivateIpV6Addresses(); !reflect.DeepEqual(addresses, []string{"ace:cab:deca::4"}) {
+		t.Fatalf("unexpected private IPv6 addresses %v", addresses)
+	}
+	if addresses := network.PublicIpAddresses(); !reflect.DeepEqual(addresses, []string{"20.1.2.3", "2603:1030::1"}) {
+		t.Fatalf("unexpected public addresses %v", addresses)
+	}
+	if subnet, ok := network.SubnetContaining("10.1.200.1"); !ok || subnet.Address != "10.1.0.0" {
+		t.Fatalf("unexpected subnet %+v", subnet)
+	}
+	if subnet, ok := network.SubnetContaining("ace:cab:deca::10"); !ok || subnet.Prefix != "64" {
+		t.Fatalf("unexpected subnet %+v", subnet)
+	}
+	if _, ok := network.SubnetContaining("192.168.0.1"); ok {
+		t.Fatal("subnet found for a foreign address")
+	}
+	if metadata.GetIpV4PublicAddress() != "20.1.2.3" {
+		t.Fatalf("unexpected public address %s", metadata.GetIpV4PublicAddress())
+	}
+}
+
+func TestNetworkAccessorsOnSparseData(t *testing.T) {
+	sparse := []string{
+		`{}`,
+		`{"network": {}}`,
+		`{"network": {"interface": []}}`,
+		`{"network": {"interface": [{}]}}`,
+		`{"network": {"interface": [{"ipv4": {"ipAddress": [], "subnet": [{"address": "", "prefix": ""}]}}]}}`,
+	}
+	for _, jsonString := range sparse {
+		metadata, err := GetMetadataFromJsonString(&jsonString)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if metadata.GetIpV4PublicAddress() != "0.0.0.0" {
+			t.Fatalf("unexpected public address for %s", jsonString)
+		}
+		network := metadata.Network
+		if len(network.PrivateIpV4Addresses())+len(network.PrivateIpV6Addresses())+len(network.PublicIpAddresses()) != 0 {
+			t.Fatalf("addresses found in %s", jsonString)
+		}
+		if _, ok := network.SubnetContaining("10.0.0.4"); ok {
+			t.Fatalf("subnet found in %s", jsonString)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package metadata
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-extension-foundation/errorhelper"
+)
+
+// ResourceID is a parsed Azure Resource Manager resource id such as
+// /subscriptions/{sub}/resourceGroups/{rg}/providers/Microsoft.Compute/virtualMachineScaleSets/{vmss}/virtualMachines/{id}
+type ResourceID struct {
+	subscription  string
+	resourceGroup string
+	provider      string
+	// types and names of the resource and its parents, outermost first
+	types []string
+	names []string
+}
+
+// ParseResourceID parses id, which must name a resource of a provider in a resource group
+func ParseResourceID(id string) (ResourceID, error) {
+	var resourceID ResourceID
+	segments := strings.Split(strings.Trim(id, "/"), "/")
+	if len(segments) < 8 || len(segments)%2 != 0 ||
+		!strings.EqualFold(segments[0], "subscriptions") ||
+		!strings.EqualFold(segments[2], "resourceGroups") ||
+		!strings.EqualFold(segments[4], "providers") {
+		return resourceID, errorhelper.AddStackToError(fmt.Errorf("%q is not a resource id", id))
+	}
+	for _, segment := range segments {
+		if segment == "" {
+			return resourceID, errorhelper.AddStackToError(fmt.Errorf("%q is not a resource id", id))
+		}
+	}
+	resourceID.subscription = segments[1]
+	resourceID.resourceGroup = segments[3]
+	resourceID.provider = segments[5]
+	for i := 6; i < len(segments); i += 2 {
+		resourceID.types = append(resourceID.types, segments[i])
+		resourceID.names = append(resourceID.names, segments[i+1])
+	}
+	return resourceID, nil
+}
+
+func (id ResourceID) Subscription() string {
+	return id.subscription
+}
+
+func (id ResourceID) ResourceGroup() string {
+	return id.resourceGroup
+}
+
+// Provider returns the resource provider namespace, e.g. Microsoft.Compute
+func (id ResourceID) Provider() string {
+	return id.provider
+}
+
+// ResourceType returns the type of the resource including its parents, e.g. virtualMachineScaleSets/virtualMachines
+func (id ResourceID) ResourceType() string {
+	return strings.Join(id.types, "/")
+}
+
+// Name returns the name of the resource itself, e.g. the instance id of a scale set virtual machine
+func (id ResourceID) Name() string {
+	if len(id.names) == 0 {
+		return ""
+	}
+	return id.names[len(id.names)-1]
+}
+
+// Parent returns the id of the parent resource, e.g. the scale set of a scale set virtual machine
+func (id ResourceID) Parent() (ResourceID, bool) {
+	if len(id.types) < 2 {
+		return ResourceID{}, false
+	}
+	parent := id
+	parent.types = id.types[:len(id.types)-1]
+	parent.names = id.names[:len(id.names)-1]
+	return parent, true
+}
+
+func (id ResourceID) String() string {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "/subscriptions/%s/resourceGroups/%s/providers/%s", id.subscription, id.resourceGroup, id.provider)
+	for i := range id.types {
+		fmt.Fprintf(&builder, "/%s/%s", id.types[i], id.names[i])
+	}
+	return builder.String()
+}
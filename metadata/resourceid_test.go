@@ -0,0 +1,43 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package metadata
+
+import (
+	"testing"
+)
+
+func TestParseResourceID(t *testing.T) {
+	id, err := ParseResourceID("/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/vmss/virtualMachines/3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Subscription() != "sub" || id.ResourceGroup() != "rg" || id.Provider() != "Microsoft.Compute" || id.Name() != "3" {
+		t.Fatalf("unexpected resource id %+v", id)
+	}
+	if id.ResourceType() != "virtualMachineScaleSets/virtualMachines" {
+		t.Fatalf("unexpected resource type %s", id.ResourceType())
+	}
+	parent, ok := id.Parent()
+	if !ok || parent.String() != "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/vmss" {
+		t.Fatalf("unexpected parent %v", parent)
+	}
+	if _, ok := parent.Parent(); ok {
+		t.Fatal("top level resource has a parent")
+	}
+}
+
+func TestParseResourceIDRejectsInvalidIds(t *testing.T) {
+	invalid := []string{
+		"",
+		"/subscriptions/sub/resourceGroups/rg",
+		"/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines",
+		"/subscriptions/sub/resourceGroups//providers/Microsoft.Compute/virtualMachines/vm",
+		"/tenants/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm",
+	}
+	for _, id := range invalid {
+		if _, err := ParseResourceID(id); err == nil {
+			t.Fatalf("%q was accepted", id)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-extension-foundation/errorhelper"
+	"github.com/Azure/azure-extension-foundation/httputil"
+)
+
+const scheduledEventsPath = "/metadata/scheduledevents?api-version=2020-07-01"
+
+// DefaultScheduledEventsWatchInterval is the polling interval of Watch when none is given
+const DefaultScheduledEventsWatchInterval = 10 * time.Second
+
+type ScheduledEventType string
+
+const (
+	EventTypeReboot    ScheduledEventType = "Reboot"
+	EventTypeRedeploy  ScheduledEventType = "Redeploy"
+	EventTypeFreeze    ScheduledEventType = "Freeze"
+	EventTypePreempt   ScheduledEventType = "Preempt"
+	EventTypeTerminate ScheduledEventType = "Terminate"
+)
+
+const (
+	EventStatusScheduled = "Scheduled"
+	EventStatusStarted   = "Started"
+)
+
+type ScheduledEvent struct {
+	EventId      string             `json:"EventId"`
+	EventType    ScheduledEventType `json:"EventType"`
+	ResourceType string             `json:"ResourceType"`
+	// Resources lists the names of the virtual machines affected by the event
+	Resources   []string `json:"Resources"`
+	EventStatus string   `json:"EventStatus"`
+	// NotBefore is the time after which the event may start, empty once it started
+	NotBefore         string `json:"NotBefore"`
+	Description       string `json:"Description"`
+	EventSource       string `json:"EventSource"`
+	DurationInSeconds int    `json:"DurationInSeconds"`
+}
+
+// NotBeforeTime parses NotBefore, false if the event has no start time
+func (event ScheduledEvent) NotBeforeTime() (time.Time, bool) {
+	notBefore, err := time.Parse(http.TimeFormat, event.NotBefore)
+	if err != nil {
+		notBefore, err = time.Parse(time.RFC1123, event.NotBefore)
+	}
+	return notBefore, err == nil
+}
+
+// Affects returns true if the event affects the virtual machine named vmName, i.e. Metadata.Compute.Name
+func (event ScheduledEvent) Affects(vmName string) bool {
+	for _, resource := range event.Resources {
+		if strings.EqualFold(resource, vmName) {
+			return true
+		}
+	}
+	return false
+}
+
+type ScheduledEvents struct {
+	// DocumentIncarnation changes whenever the events change
+	DocumentIncarnation int              `json:"DocumentIncarnation"`
+	Events              []ScheduledEvent `json:"Events"`
+}
+
+// ForVm returns the events affecting the virtual machine named vmName
+func (events ScheduledEvents) ForVm(vmName string) []ScheduledEvent {
+	var affecting []ScheduledEvent
+	for _, event := range events.Events {
+		if event.Affects(vmName) {
+			affecting = append(affecting, event)
+		}
+	}
+	return affecting
+}
+
+type scheduledEventsStartRequest struct {
+	StartRequests []scheduledEventsStartRequestEvent `json:"StartRequests"`
+}
+
+type scheduledEventsStartRequestEvent struct {
+	EventId string `json:"EventId"`
+}
+
+type scheduledEventsClient struct {
+	httpClient httputil.HttpClient
+}
+
+// NewScheduledEventsClient returns a client of the scheduled events service issuing its requests through client,
+// throttled by the shared instance metadata service rate limiter. The first request enables the service for the
+// machine and may take up to two minutes.
+func NewScheduledEventsClient(client httputil.HttpClient) scheduledEventsClient {
+	return scheduledEventsClient{httpClient: httputil.NewThrottledHttpClient(client, httputil.ImdsRateLimiter, nil)}
+}
+
+// GetScheduledEvents returns the events currently scheduled for the machine and its availability set or scale set
+func (client *scheduledEventsClient) GetScheduledEvents() (ScheduledEvents, error) {
+	retval := ScheduledEvents{}
+	responseCode, responseBody, err := client.httpClient.Get(imdsUrl(scheduledEventsPath), map[string]string{"Metadata": "true"})
+	if err != nil {
+		return retval, err
+	}
+	if responseCode != 200 {
+		return retval, errorhelper.AddStackToError(
+			fmt.Errorf("Get request for scheduled events returned return code %v.\nResponse Body: %s", responseCode, string(responseBody)))
+	}
+	err = json.Unmarshal(responseBody, &retval)
+	return retval, errorhelper.AddStackToError(err)
+}
+
+// StartEvents approves the events so that they start before their NotBefore time, once the workload was drained
+func (client *scheduledEventsClient) StartEvents(eventIds ...string) error {
+	if len(eventIds) == 0 {
+		return nil
+	}
+	request := scheduledEventsStartRequest{}
+	for _, eventId := range eventIds {
+		request.StartRequests = append(request.StartRequests, scheduledEventsStartRequestEvent{EventId: eventId})
+	}
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return errorhelper.AddStackToError(err)
+	}
+	responseCode, responseBody, err := client.httpClient.Post(imdsUrl(scheduledEventsPath),
+		map[string]string{"Metadata": "true", "Content-Type": "application/json"}, payload)
+	if err != nil {
+		return err
+	}
+	if responseCode != 200 {
+		return errorhelper.AddStackToError(
+			fmt.Errorf("Post request to start scheduled events returned return code %v.\nResponse Body: %s", responseCode, string(responseBody)))
+	}
+	return nil
+}
+
+// Watch polls the scheduled events every interval and delivers the document whenever its incarnation changes,
+// starting with the current one. Failed polls are delivered on the error channel if it has room and are retried
+// at the next interval. Both channels are closed once ctx is done. An interval <= 0 polls every
+// DefaultScheduledEventsWatchInterval.
+func (client *scheduledEventsClient) Watch(ctx context.Context, interval time.Duration) (<-chan ScheduledEvents, <-chan error) {
+	if interval <= 0 {
+		interval = DefaultScheduledEventsWatchInterval
+	}
+	events := make(chan ScheduledEvents)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(events)
+		defer close(errs)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		incarnation := -1
+		for {
+			current, err := client.GetScheduledEvents()
+			if err != nil {
+				select {
+				case errs <- err:
+				default:
+				}
+			} else if current.DocumentIncarnation != incarnation {
+				select {
+				case events <- current:
+					incarnation = current.DocumentIncarnation
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, errs
+}
@@ -0,0 +1,138 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-extension-foundation/httputil"
+)
+
+const scheduledEventsJson = `{
+	"DocumentIncarnation": %d,
+	"Events": [
+		{
+			"EventId": "602d9444-d2cd-49c7-8624-8643e7171297",
+			"EventType": "Reboot",
+			"ResourceType": "VirtualMachine",
+			"Resources": ["FrontEnd_IN_0", "BackEnd_IN_0"],
+			"EventStatus": "Scheduled",
+			"NotBefore": "Mon, 19 Sep 2016 18:29:47 GMT",
+			"Description": "",
+			"EventSource": "Platform",
+			"DurationInSeconds": 5
+		},
+		{
+			"EventId": "c6b5e2b1-5f5b-4a4c-9a0d-6ee4b8c6d1a7",
+			"EventType": "Preempt",
+			"ResourceType": "VirtualMachine",
+			"Resources": ["BackEnd_IN_1"],
+			"EventStatus": "Scheduled",
+			"NotBefore": "Mon, 19 Sep 2016 18:30:17 GMT",
+			"EventSource": "Platform",
+			"DurationInSeconds": -1
+		}
+	]
+}`
+
+func TestGetScheduledEvents(t *testing.T) {
+	client := NewScheduledEventsClient(&httputil.MockHttpClient{Getfunc: func(url string, headers map[string]string) (int, []byte, error) {
+		if headers["Metadata"] != "true" {
+			t.Fatal("Metadata header is missing")
+		}
+		return 200, []byte(fmt.Sprintf(scheduledEventsJson, 2)), nil
+	}})
+
+	events, err := client.GetScheduledEvents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if events.DocumentIncarnation != 2 || len(events.Events) != 2 {
+		t.Fatalf("unexpected events %+v", events)
+	}
+	affecting := events.ForVm("frontend_in_0")
+	if len(affecting) != 1 || affecting[0].EventType != EventTypeReboot {
+		t.Fatalf("unexpected events for the vm %+v", affecting)
+	}
+	notBefore, ok := affecting[0].NotBeforeTime()
+	if !ok || !notBefore.Equal(time.Date(2016, 9, 19, 18, 29, 47, 0, time.UTC)) {
+		t.Fatalf("unexpected NotBefore %v", notBefore)
+	}
+	if len(events.ForVm("BackEnd_IN_1")) != 1 || events.ForVm("BackEnd_IN_1")[0].EventType != EventTypePreempt {
+		t.Fatal("preempt event was not returned")
+	}
+}
+
+func TestStartEvents(t *testing.T) {
+	var request scheduledEventsStartRequest
+	client := NewScheduledEventsClient(&httputil.MockHttpClient{Postfunc: func(url string, headers map[string]string, payload []byte) (int, []byte, error) {
+		if headers["Metadata"] != "true" {
+			t.Fatal("Metadata header is missing")
+		}
+		if err := json.Unmarshal(payload, &request); err != nil {
+			t.Fatal(err)
+		}
+		return 200, nil, nil
+	}})
+
+	if err := client.StartEvents("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if len(request.StartRequests) != 2 || request.StartRequests[1].EventId != "b" {
+		t.Fatalf("unexpected request %+v", request)
+	}
+}
+
+func TestWatchDeliversIncarnationChanges(t *testing.T) {
+	var polls int32
+	client := NewScheduledEventsClient(&httputil.MockHttpClient{Getfunc: func(url string, headers map[string]string) (int, []byte, error) {
+		// incarnation 1, 1, a failure, then incarnation 2
+		poll := atomic.AddInt32(&polls, 1)
+		if poll == 3 {
+			return 500, nil, nil
+		}
+		return 200, []byte(fmt.Sprintf(scheduledEventsJson, 1+poll/4)), nil
+	}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events, errs := client.Watch(ctx, 10*time.Millisecond)
+	for _, expected := range []int{1, 2} {
+		select {
+		case document := <-events:
+			if document.DocumentIncarnation != expected {
+				t.Fatalf("expected incarnation %d, got %d", expected, document.DocumentIncarnation)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("events were not delivered")
+		}
+	}
+	if err := <-errs; err == nil {
+		t.Fatal("poll failure was not delivered")
+	}
+	cancel()
+	for range events {
+	}
+}
+
+func TestWatchDefaultsNonPositiveInterval(t *testing.T) {
+	client := NewScheduledEventsClient(&httputil.MockHttpClient{Getfunc: func(url string, headers map[string]string) (int, []byte, error) {
+		return 200, []byte(fmt.Sprintf(scheduledEventsJson, 1)), nil
+	}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events, _ := client.Watch(ctx, 0)
+	select {
+	case <-events:
+	case <-time.After(5 * time.Second):
+		t.Fatal("events were not delivered")
+	}
+	cancel()
+	for range events {
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-extension-foundation/errorhelper"
+)
+
+// DefaultTagsWatchInterval is the polling interval of WatchTags when none is given
+const DefaultTagsWatchInterval = time.Minute
+
+// GetTags returns the tags of the virtual machine. tagsList is used when present since names and values of the
+// legacy tags string can't contain ':' or ';'.
+func (compute *MetadataCompute) GetTags() map[string]string {
+	tags := make(map[string]string)
+	if len(compute.TagsList) > 0 {
+		for _, tag := range compute.TagsList {
+			tags[tag.Name] = tag.Value
+		}
+		return tags
+	}
+	switch legacy := compute.Tags.(type) {
+	case string:
+		for _, pair := range strings.Split(legacy, ";") {
+			if pair == "" {
+				continue
+			}
+			name, value, _ := strings.Cut(pair, ":")
+			tags[name] = value
+		}
+	case map[string]interface{}:
+		for name, value := range legacy {
+			tags[name] = fmt.Sprint(value)
+		}
+	}
+	return tags
+}
+
+// TagChanges describes how the tags of the virtual machine changed
+type TagChanges struct {
+	// Tags are all current tags
+	Tags map[string]string
+	// Added holds the new tags
+	Added map[string]string
+	// Changed holds the new values of changed tags
+	Changed map[string]string
+	// Removed holds the last values of removed tags
+	Removed map[string]string
+}
+
+// IsEmpty returns true if no tag changed
+func (changes TagChanges) IsEmpty() bool {
+	return len(changes.Added) == 0 && len(changes.Changed) == 0 && len(changes.Removed) == 0
+}
+
+// DiffTags returns the changes from previous to current
+func DiffTags(previous map[string]string, current map[string]string) TagChanges {
+	changes := TagChanges{Tags: current, Added: map[string]string{}, Changed: map[string]string{}, Removed: map[string]string{}}
+	for name, value := range current {
+		previousValue, ok := previous[name]
+		if !ok {
+			changes.Added[name] = value
+		} else if previousValue != value {
+			changes.Changed[name] = value
+		}
+	}
+	for name, value := range previous {
+		if _, ok := current[name]; !ok {
+			changes.Removed[name] = value
+		}
+	}
+	return changes
+}
+
+// WatchTags polls the metadata of provider every interval and delivers the tag changes, starting with the current
+// tags as added. Failed polls are delivered on the error channel if it has room and are retried at the next interval.
+// Both channels are closed once ctx is done. A CachingMetadataProvider only reports changes once its ttl expired.
+// An interval <= 0 polls every DefaultTagsWatchInterval.
+func WatchTags(ctx context.Context, provider MetadataProvider, interval time.Duration) (<-chan TagChanges, <-chan error) {
+	if interval <= 0 {
+		interval = DefaultTagsWatchInterval
+	}
+	changes := make(chan TagChanges)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(changes)
+		defer close(errs)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		var previous map[string]string
+		for {
+			metadata, err := provider.GetMetadata()
+			if err != nil {
+				select {
+				case errs <- err:
+				default:
+				}
+			} else {
+				current := metadata.Compute.GetTags()
+				diff := DiffTags(previous, current)
+				if previous == nil || !diff.IsEmpty() {
+					select {
+					case changes <- diff:
+						previous = current
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return changes, errs
+}
+
+// ApplyTagsToSettings overlays the tags named prefix followed by a field name onto publicSettings, a pointer to a
+// struct. With prefix ext.myext., the tag ext.myext.logLevel sets the field serialized as logLevel and
+// ext.myext.proxy.port sets the port field of the proxy struct. Names match case-insensitively like encoding/json.
+// String fields take the value verbatim, other fields parse it as JSON. Tags not matching a field are ignored.
+func ApplyTagsToSettings(tags map[string]string, prefix string, publicSettings interface{}) error {
+	target := reflect.ValueOf(publicSettings)
+	if target.Kind() != reflect.Ptr || target.IsNil() || target.Elem().Kind() != reflect.Struct {
+		return errorhelper.AddStackToError(fmt.Errorf("public settings must be a pointer to a struct, got %T", publicSettings))
+	}
+	prefix = strings.TrimSuffix(prefix, "*")
+
+	// sorted so that errors are reported deterministically
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		if strings.HasPrefix(strings.ToLower(name), strings.ToLower(prefix)) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		field, ok := settingsField(target.Elem(), strings.Split(name[len(prefix):], "."))
+		if !ok {
+			continue
+		}
+		value := tags[name]
+		if field.Kind() == reflect.String {
+			field.SetString(value)
+			continue
+		}
+		if err := json.Unmarshal([]byte(value), field.Addr().Interface()); err != nil {
+			return errorhelper.AddStackToError(fmt.Errorf("invalid value %q of tag %s: %v", value, name, err))
+		}
+	}
+	return nil
+}
+
+// settingsField returns the field of value at path, allocating nil struct pointers on the way once the path is known
+// to exist
+func settingsField(value reflect.Value, path []string) (reflect.Value, bool) {
+	var indexes []int
+	valueType := value.Type()
+	for _, name := range path {
+		if valueType.Kind() == reflect.Ptr {
+			valueType = valueType.Elem()
+		}
+		if valueType.Kind() != reflect.Struct {
+			return reflect.Value{}, false
+		}
+		index, ok := structFieldByJsonName(valueType, name)
+		if !ok {
+			return reflect.Value{}, false
+		}
+		indexes = append(indexes, index)
+		valueType = valueType.Field(index).Type
+	}
+	for _, index := range indexes {
+		if value.Kind() == reflect.Ptr {
+			if value.IsNil() {
+				value.Set(reflect.New(value.Type().Elem()))
+			}
+			value = value.Elem()
+		}
+		value = value.Field(index)
+	}
+	return value, value.CanSet()
+}
+
+func structFieldByJsonName(valueType reflect.Type, name string) (int, bool) {
+	for i := 0; i < valueType.NumField(); i++ {
+		field := valueType.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		jsonName := field.Name
+		if tag, ok := field.Tag.Lookup("json"); ok {
+			tagName, _, _ := strings.Cut(tag, ",")
+			if tagName == "-" {
+				continue
+			}
+			if tagName != "" {
+				jsonName = tagName
+			}
+		}
+		if strings.EqualFold(jsonName, name) {
+			return i, true
+		}
+	}
+	return 0, false
+}
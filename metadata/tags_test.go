@@ -0,0 +1,111 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package metadata
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGetTags(t *testing.T) {
+	compute := MetadataCompute{Tags: "env:prod;ext.myext.logLevel:debug;empty:"}
+	expected := map[string]string{"env": "prod", "ext.myext.logLevel": "debug", "empty": ""}
+	if tags := compute.GetTags(); !reflect.DeepEqual(tags, expected) {
+		t.Fatalf("unexpected tags %v", tags)
+	}
+
+	compute.TagsList = []Tag{{Name: "url", Value: "https://contoso.com:443/a;b"}}
+	if tags := compute.GetTags(); !reflect.DeepEqual(tags, map[string]string{"url": "https://contoso.com:443/a;b"}) {
+		t.Fatalf("tagsList wasn't preferred: %v", tags)
+	}
+
+	if tags := (&MetadataCompute{}).GetTags(); len(tags) != 0 {
+		t.Fatalf("unexpected tags %v", tags)
+	}
+}
+
+func TestDiffTags(t *testing.T) {
+	changes := DiffTags(map[string]string{"same": "1", "changed": "1", "removed": "1"}, map[string]string{"same": "1", "changed": "2", "added": "1"})
+	if !reflect.DeepEqual(changes.Added, map[string]string{"added": "1"}) ||
+		!reflect.DeepEqual(changes.Changed, map[string]string{"changed": "2"}) ||
+		!reflect.DeepEqual(changes.Removed, map[string]string{"removed": "1"}) {
+		t.Fatalf("unexpected changes %+v", changes)
+	}
+	if !DiffTags(map[string]string{"a": "1"}, map[string]string{"a": "1"}).IsEmpty() {
+		t.Fatal("identical tags reported changes")
+	}
+}
+
+func TestWatchTags(t *testing.T) {
+	fake := &fakeMetadataProvider{metadata: Metadata{Compute: MetadataCompute{Tags: "a:1"}}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes, _ := WatchTags(ctx, fake, time.Millisecond)
+
+	initial := <-changes
+	if !reflect.DeepEqual(initial.Added, map[string]string{"a": "1"}) {
+		t.Fatalf("unexpected initial changes %+v", initial)
+	}
+	fake.setTags("a:2")
+	changed := <-changes
+	if !reflect.DeepEqual(changed.Changed, map[string]string{"a": "2"}) || len(changed.Added) != 0 {
+		t.Fatalf("unexpected changes %+v", changed)
+	}
+	cancel()
+	for range changes {
+	}
+}
+
+func TestWatchTagsDefaultsNonPositiveInterval(t *testing.T) {
+	fake := &fakeMetadataProvider{metadata: Metadata{Compute: MetadataCompute{Tags: "a:1"}}}
+	ctx, cancel := context.WithCancel(context.Background())
+	changes, _ := WatchTags(ctx, fake, -time.Second)
+	if initial := <-changes; len(initial.Added) != 1 {
+		t.Fatalf("unexpected initial changes %+v", initial)
+	}
+	cancel()
+	for range changes {
+	}
+}
+
+func TestApplyTagsToSettings(t *testing.T) {
+	type proxy struct {
+		Port int `json:"port"`
+	}
+	type publicSettings struct {
+		LogLevel string   `json:"logLevel"`
+		Enabled  bool     `json:"enabled"`
+		Paths    []string `json:"paths"`
+		Proxy    *proxy   `json:"proxy"`
+		Other    *proxy   `json:"other"`
+		Ignored  string   `json:"-"`
+	}
+	settings := publicSettings{LogLevel: "info"}
+	tags := map[string]string{
+		"ext.myext.loglevel":   "debug",
+		"ext.myext.enabled":    "true",
+		"ext.myext.paths":      `["/a","/b"]`,
+		"ext.myext.proxy.port": "8080",
+		"ext.myext.other.host": "unknown",
+		"ext.myext.Ignored":    "x",
+		"ext.other.logLevel":   "error",
+		"env":                  "prod",
+	}
+	if err := ApplyTagsToSettings(tags, "ext.myext.*", &settings); err != nil {
+		t.Fatal(err)
+	}
+	expected := publicSettings{LogLevel: "debug", Enabled: true, Paths: []string{"/a", "/b"}, Proxy: &proxy{Port: 8080}}
+	if !reflect.DeepEqual(settings, expected) {
+		t.Fatalf("unexpected settings %+v", settings)
+	}
+
+	if err := ApplyTagsToSettings(map[string]string{"ext.myext.enabled": "yes"}, "ext.myext.", &settings); err == nil {
+		t.Fatal("invalid value was accepted")
+	}
+	if err := ApplyTagsToSettings(tags, "ext.myext.", settings); err == nil {
+		t.Fatal("settings passed by value were accepted")
+	}
+}
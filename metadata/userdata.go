@@ -0,0 +1,114 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package metadata
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/Azure/azure-extension-foundation/errorhelper"
+)
+
+const (
+	userDataPathFormat = "/metadata/instance/compute/userData?api-version=%s&format=text"
+	// userDataApiVersion is the first instance metadata service version returning userData
+	userDataApiVersion = "2021-01-01"
+
+	// OvfEnvironmentFile is where the Linux guest agent stores the provisioning configuration of the virtual machine
+	OvfEnvironmentFile = "/var/lib/waagent/ovf-env.xml"
+)
+
+// GetUserData returns the decoded user data of the virtual machine, empty if none was specified
+func (provider *provider) GetUserData() ([]byte, error) {
+	responseBody, err := provider.getDocument(userDataPathFormat, userDataApiVersion, "user data")
+	if err != nil {
+		return nil, err
+	}
+	return decodeBase64Data(string(responseBody), "user data")
+}
+
+// GetUserData returns the decoded userData field, empty if none was specified
+func (compute *MetadataCompute) GetUserData() ([]byte, error) {
+	return decodeBase64Data(compute.UserData, "user data")
+}
+
+func decodeBase64Data(encoded string, description string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, errorhelper.AddStackToError(fmt.Errorf("%s is not base64: %v", description, err))
+	}
+	return data, nil
+}
+
+// OvfEnvironment is the provisioning configuration the platform passes to the virtual machine. Passwords aren't
+// deserialized so that the environment can be logged.
+type OvfEnvironment struct {
+	ProvisioningSection     OvfProvisioningSection     `xml:"ProvisioningSection"`
+	PlatformSettingsSection OvfPlatformSettingsSection `xml:"PlatformSettingsSection"`
+}
+
+type OvfProvisioningSection struct {
+	Version                           string                               `xml:"Version"`
+	LinuxProvisioningConfigurationSet OvfLinuxProvisioningConfigurationSet `xml:"LinuxProvisioningConfigurationSet"`
+}
+
+type OvfLinuxProvisioningConfigurationSet struct {
+	ConfigurationSetType             string         `xml:"ConfigurationSetType"`
+	HostName                         string         `xml:"HostName"`
+	UserName                         string         `xml:"UserName"`
+	DisableSshPasswordAuthentication string         `xml:"DisableSshPasswordAuthentication"`
+	CustomData                       string         `xml:"CustomData"`
+	PublicKeys                       []OvfPublicKey `xml:"SSH>PublicKeys>PublicKey"`
+	KeyPairs                         []OvfPublicKey `xml:"SSH>KeyPairs>KeyPair"`
+}
+
+type OvfPublicKey struct {
+	Fingerprint string `xml:"Fingerprint"`
+	Path        string `xml:"Path"`
+	Value       string `xml:"Value"`
+}
+
+type OvfPlatformSettingsSection struct {
+	Version          string `xml:"Version"`
+	PlatformSettings struct {
+		KmsServerHostname   string `xml:"KmsServerHostname"`
+		ProvisionGuestAgent string `xml:"ProvisionGuestAgent"`
+	} `xml:"PlatformSettings"`
+}
+
+// GetOvfEnvironment reads the provisioning configuration from OvfEnvironmentFile, which is only readable by root
+func GetOvfEnvironment() (OvfEnvironment, error) {
+	return GetOvfEnvironmentFromFile(OvfEnvironmentFile)
+}
+
+// GetOvfEnvironmentFromFile reads the provisioning configuration from path
+func GetOvfEnvironmentFromFile(path string) (OvfEnvironment, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return OvfEnvironment{}, errorhelper.AddStackToError(err)
+	}
+	return ParseOvfEnvironment(data)
+}
+
+// ParseOvfEnvironment deserializes the content of an ovf-env.xml file
+func ParseOvfEnvironment(data []byte) (OvfEnvironment, error) {
+	retval := OvfEnvironment{}
+	if err := xml.Unmarshal(data, &retval); err != nil {
+		return retval, errorhelper.AddStackToError(fmt.Errorf("unable to deserialize ovf environment: %v", err))
+	}
+	return retval, nil
+}
+
+// HostName returns the host name the virtual machine was provisioned with
+func (environment *OvfEnvironment) HostName() string {
+	return environment.ProvisioningSection.LinuxProvisioningConfigurationSet.HostName
+}
+
+// CustomData returns the decoded custom data of the virtual machine, empty if none was specified
+func (environment *OvfEnvironment) CustomData() ([]byte, error) {
+	return decodeBase64Data(environment.ProvisioningSection.LinuxProvisioningConfigurationSet.CustomData, "custom data")
+}
@@ -0,0 +1,76 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package metadata
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/Azure/azure-extension-foundation/httputil"
+)
+
+const expectedCustomData = "#cloud-config\npackages: [curl]\n"
+
+func TestGetUserData(t *testing.T) {
+	var requested []string
+	prov := NewMetadataProvider(&httputil.MockHttpClient{Getfunc: func(requestUrl string, headers map[string]string) (int, []byte, error) {
+		u, _ := url.Parse(requestUrl)
+		if u.Path != "/metadata/instance/compute/userData" || headers["Metadata"] != "true" {
+			t.Fatalf("unexpected request %s %v", requestUrl, headers)
+		}
+		requested = append(requested, u.Query().Get("api-version"))
+		if u.Query().Get("api-version") > "2021-02-01" {
+			return 400, []byte(`{"error": "Bad request. api-version is invalid or was not specified in the request.", "newest-versions": ["2020-09-01"]}`), nil
+		}
+		return 200, []byte("I2Nsb3VkLWNvbmZpZwpwYWNrYWdlczogW2N1cmxdCg=="), nil
+	}})
+	userData, err := prov.GetUserData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(userData) != expectedCustomData || len(requested) != 2 {
+		t.Fatalf("unexpected user data %q after requesting %v", userData, requested)
+	}
+
+	compute := MetadataCompute{UserData: "I2Nsb3VkLWNvbmZpZwpwYWNrYWdlczogW2N1cmxdCg=="}
+	if userData, err := compute.GetUserData(); err != nil || string(userData) != expectedCustomData {
+		t.Fatalf("unexpected user data %q: %v", userData, err)
+	}
+}
+
+func TestGetUserDataRequiresSupportingApiVersion(t *testing.T) {
+	prov := NewMetadataProviderWithApiVersion(&httputil.MockHttpClient{Getfunc: func(requestUrl string, headers map[string]string) (int, []byte, error) {
+		t.Fatalf("unexpected request %s", requestUrl)
+		return 0, nil, nil
+	}}, "2020-09-01")
+	if _, err := prov.GetUserData(); err == nil {
+		t.Fatal("user data was requested from an api version not supporting it")
+	}
+}
+
+func TestGetOvfEnvironmentFromFile(t *testing.T) {
+	environment, err := GetOvfEnvironmentFromFile("testdata/ovf-env.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if environment.HostName() != "some-computer" {
+		t.Fatalf("unexpected host name %s", environment.HostName())
+	}
+	customData, err := environment.CustomData()
+	if err != nil || string(customData) != expectedCustomData {
+		t.Fatalf("unexpected custom data %q: %v", customData, err)
+	}
+	configuration := environment.ProvisioningSection.LinuxProvisioningConfigurationSet
+	if configuration.UserName != "azureuser" || len(configuration.PublicKeys) != 1 ||
+		configuration.PublicKeys[0].Path != "/home/azureuser/.ssh/authorized_keys" {
+		t.Fatalf("unexpected provisioning configuration %+v", configuration)
+	}
+	if environment.PlatformSettingsSection.PlatformSettings.ProvisionGuestAgent != "true" {
+		t.Fatalf("unexpected platform settings %+v", environment.PlatformSettingsSection)
+	}
+
+	if _, err := ParseOvfEnvironment([]byte("<Environment>")); err == nil {
+		t.Fatal("truncated environment was accepted")
+	}
+}
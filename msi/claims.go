@@ -0,0 +1,76 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package msi
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-extension-foundation/errorhelper"
+)
+
+// TokenClaims holds the claims of an access token useful when troubleshooting authorization failures
+type TokenClaims struct {
+	TenantId     string       `json:"tid"`
+	ObjectId     string       `json:"oid"`
+	AppId        string       `json:"appid"`
+	Audience     ClaimStrings `json:"aud"`
+	MiResourceId string       `json:"xms_mirid"`
+	Roles        []string     `json:"roles"`
+	Issuer       string       `json:"iss"`
+	IssuedAt     int64        `json:"iat"`
+	NotBefore    int64        `json:"nbf"`
+	ExpiresAt    int64        `json:"exp"`
+}
+
+// ClaimStrings is a claim that may be either a single string or an array of strings
+type ClaimStrings []string
+
+func (claim *ClaimStrings) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*claim = ClaimStrings{single}
+		return nil
+	}
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return err
+	}
+	*claim = multiple
+	return nil
+}
+
+// GetClaims decodes the payload of the access token. The signature is NOT verified, the claims must only be used
+// for diagnostics and never for authorization decisions.
+func (msi *Msi) GetClaims() (TokenClaims, error) {
+	var claims TokenClaims
+	segments := strings.Split(msi.AccessToken, ".")
+	if len(segments) != 3 {
+		return claims, errorhelper.AddStackToError(fmt.Errorf("access token is not a JWT, it has %d segments", len(segments)))
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segments[1], "="))
+	if err != nil {
+		return claims, errorhelper.AddStackToError(fmt.Errorf("unable to decode access token payload: %v", err))
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, errorhelper.AddStackToError(fmt.Errorf("unable to deserialize access token claims: %v", err))
+	}
+	return claims, nil
+}
+
+// RedactedSummary describes the token without the token itself and is safe to write to logs
+func (msi *Msi) RedactedSummary() string {
+	summary := fmt.Sprintf("token_type=%s resource=%s expires_on=%s access_token=<redacted, %d bytes>",
+		msi.TokenType, msi.Resource, msi.ExpiresOn, len(msi.AccessToken))
+	claims, err := msi.GetClaims()
+	if err != nil {
+		return summary + " claims=<unavailable>"
+	}
+	return fmt.Sprintf("%s tid=%s oid=%s appid=%s aud=%s xms_mirid=%s roles=[%s] exp=%s",
+		summary, claims.TenantId, claims.ObjectId, claims.AppId, strings.Join(claims.Audience, ","),
+		claims.MiResourceId, strings.Join(claims.Roles, ","), time.Unix(claims.ExpiresAt, 0).UTC().Format(time.RFC3339))
+}
@@ -0,0 +1,123 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package msi
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-extension-foundation/httputil"
+)
+
+func newTestJwt(claims map[string]interface{}) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	payload, _ := json.Marshal(claims)
+	return header + "." + base64.RawURLEncoding.EncodeToString(payload) + ".signature"
+}
+
+func TestGetClaims(t *testing.T) {
+	msi := Msi{AccessToken: newTestJwt(map[string]interface{}{
+		"tid":       "tenant",
+		"oid":       "object",
+		"appid":     "app",
+		"aud":       []string{"https://storage.azure.com/", "https://storage.azure.com"},
+		"xms_mirid": testMsiResId,
+		"roles":     []string{"Reader"},
+		"exp":       1700000000,
+	})}
+
+	claims, err := msi.GetClaims()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.TenantId != "tenant" || claims.ObjectId != "object" || claims.AppId != "app" || claims.MiResourceId != testMsiResId {
+		t.Fatalf("unexpected claims %+v", claims)
+	}
+	if len(claims.Audience) != 2 || len(claims.Roles) != 1 || claims.ExpiresAt != 1700000000 {
+		t.Fatalf("unexpected claims %+v", claims)
+	}
+
+	single := Msi{AccessToken: newTestJwt(map[string]interface{}{"aud": "https://vault.azure.net"})}
+	claims, err = single.GetClaims()
+	if err != nil || len(claims.Audience) != 1 || claims.Audience[0] != "https://vault.azure.net" {
+		t.Fatalf("single audience was not decoded: %+v %v", claims, err)
+	}
+
+	if _, err := (&Msi{AccessToken: "opaque"}).GetClaims(); err == nil {
+		t.Fatal("opaque token was decoded")
+	}
+}
+
+func TestRedactedSummaryOmitsToken(t *testing.T) {
+	msi := Msi{AccessToken: newTestJwt(map[string]interface{}{"tid": "tenant", "oid": "object"}), TokenType: "Bearer"}
+	summary := msi.RedactedSummary()
+	if strings.Contains(summary, msi.AccessToken) || strings.Contains(summary, ".signature") {
+		t.Fatalf("summary contains the token: %s", summary)
+	}
+	if !strings.Contains(summary, "tid=tenant") || !strings.Contains(summary, "oid=object") {
+		t.Fatalf("summary doesn't describe the token: %s", summary)
+	}
+}
+
+func TestExpiryTimeFormats(t *testing.T) {
+	var msi Msi
+	if err := json.Unmarshal([]byte(`{"access_token":"token","expires_in":3600,"expires_on":1700000000}`), &msi); err != nil {
+		t.Fatal(err)
+	}
+	if expiry, err := msi.GetExpiryTime(); err != nil || expiry.Unix() != 1700000000 {
+		t.Fatalf("numeric expires_on was not parsed: %v %v", expiry, err)
+	}
+
+	msi = Msi{ExpiresOn: "2023-11-14T22:13:20Z"}
+	if expiry, err := msi.GetExpiryTime(); err != nil || expiry.Unix() != 1700000000 {
+		t.Fatalf("ISO expires_on was not parsed: %v %v", expiry, err)
+	}
+
+	msi = Msi{ExpiresOn: "11/14/2023 10:13:20 PM +00:00"}
+	if expiry, err := msi.GetExpiryTime(); err != nil || expiry.Unix() != 1700000000 {
+		t.Fatalf("app service expires_on was not parsed: %v %v", expiry, err)
+	}
+
+	msi = Msi{ExpiresIn: "3600", NotBefore: "1699996400"}
+	if expiry, err := msi.GetExpiryTime(); err != nil || expiry.Unix() != 1700000000 {
+		t.Fatalf("expires_in was not resolved from not_before: %v %v", expiry, err)
+	}
+
+	if _, err := (&Msi{ExpiresIn: "3600"}).GetExpiryTime(); err == nil {
+		t.Fatal("expires_in was resolved without knowing when the token was issued")
+	}
+}
+
+func TestIsExpiredWithSkew(t *testing.T) {
+	msi := Msi{ExpiresOn: strconv.FormatInt(time.Now().Add(5*time.Minute).Unix(), 10)}
+	if expired, _ := msi.IsExpiredWithSkew(time.Minute); expired {
+		t.Fatal("token expiring in 5 minutes is expired with 1 minute skew")
+	}
+	if expired, _ := msi.IsExpiredWithSkew(10 * time.Minute); !expired {
+		t.Fatal("token expiring in 5 minutes isn't expired with 10 minutes skew")
+	}
+}
+
+func TestExpiresInIsCountedFromReception(t *testing.T) {
+	httpClient := httputil.MockHttpClient{Getfunc: func(url string, headers map[string]string) (int, []byte, error) {
+		return 200, []byte(`{"access_token":"token","expires_in":"3600"}`), nil
+	}}
+	provider := NewMsiProviderForIdentitySource(&httpClient, IdentitySourceImds, NoRetryPolicy)
+
+	msi, err := provider.GetMsi()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiry, err := msi.GetExpiryTime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remaining := time.Until(expiry); remaining < 59*time.Minute || remaining > time.Hour {
+		t.Fatalf("unexpected remaining lifetime %v", remaining)
+	}
+}
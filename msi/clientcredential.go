@@ -0,0 +1,252 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package msi
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-extension-foundation/cloud"
+	"github.com/Azure/azure-extension-foundation/errorhelper"
+	"github.com/Azure/azure-extension-foundation/httputil"
+)
+
+const (
+	// DefaultAuthority is the authority of the public cloud, the authority of cloud.ActiveEnvironment is used by default
+	DefaultAuthority = "https://login.microsoftonline.com/"
+
+	clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+	assertionLifetime   = 10 * time.Minute
+
+	authorityHostEnvVar      = "AZURE_AUTHORITY_HOST"
+	tenantIdEnvVar           = "AZURE_TENANT_ID"
+	clientIdEnvVar           = "AZURE_CLIENT_ID"
+	federatedTokenFileEnvVar = "AZURE_FEDERATED_TOKEN_FILE"
+)
+
+// ClientCredentialOptions identifies the application a service principal token source authenticates as
+type ClientCredentialOptions struct {
+	// Authority is the Azure AD authority host, defaults to the authority of the active cloud
+	Authority string
+	TenantId  string
+	ClientId  string
+}
+
+type clientCredentialTokenSource struct {
+	httpClient httputil.HttpClient
+	options    ClientCredentialOptions
+	// credential adds the client secret or assertion to the token request
+	credential func(tokenEndpoint string, form url.Values) error
+}
+
+// NewClientSecretTokenSource returns a TokenSource authenticating the application with a client secret
+func NewClientSecretTokenSource(client httputil.HttpClient, options ClientCredentialOptions, secret string) TokenSource {
+	return newClientCredentialTokenSource(client, options, func(tokenEndpoint string, form url.Values) error {
+		form.Set("client_secret", secret)
+		return nil
+	})
+}
+
+// NewClientCertificateTokenSource returns a TokenSource authenticating the application with a JWT assertion signed
+// by the private key of certificate, which must be an RSA key
+func NewClientCertificateTokenSource(client httputil.HttpClient, options ClientCredentialOptions, certificate *x509.Certificate, key crypto.Signer) (TokenSource, error) {
+	if _, ok := key.(*rsa.PrivateKey); !ok {
+		return nil, errorhelper.AddStackToError(fmt.Errorf("client certificate key must be an RSA key, got %T", key))
+	}
+	return newClientCredentialTokenSource(client, options, func(tokenEndpoint string, form url.Values) error {
+		assertion, err := newClientAssertion(tokenEndpoint, options.ClientId, certificate, key)
+		if err != nil {
+			return err
+		}
+		form.Set("client_assertion_type", clientAssertionType)
+		form.Set("client_assertion", assertion)
+		return nil
+	}), nil
+}
+
+// NewWorkloadIdentityTokenSource returns a TokenSource exchanging the federated token read from tokenFile for an
+// access token. The file is read on every request since it is rotated by the platform.
+func NewWorkloadIdentityTokenSource(client httputil.HttpClient, options ClientCredentialOptions, tokenFile string) TokenSource {
+	return newClientCredentialTokenSource(client, options, func(tokenEndpoint string, form url.Values) error {
+		assertion, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return errorhelper.AddStackToError(fmt.Errorf("unable to read federated token file: %v", err))
+		}
+		form.Set("client_assertion_type", clientAssertionType)
+		form.Set("client_assertion", strings.TrimSpace(string(assertion)))
+		return nil
+	})
+}
+
+// NewWorkloadIdentityTokenSourceFromEnvironment configures a workload identity token source from AZURE_TENANT_ID,
+// AZURE_CLIENT_ID, AZURE_FEDERATED_TOKEN_FILE and optionally AZURE_AUTHORITY_HOST
+func NewWorkloadIdentityTokenSourceFromEnvironment(client httputil.HttpClient) (TokenSource, error) {
+	options := ClientCredentialOptions{
+		Authority: os.Getenv(authorityHostEnvVar),
+		TenantId:  os.Getenv(tenantIdEnvVar),
+		ClientId:  os.Getenv(clientIdEnvVar),
+	}
+	tokenFile := os.Getenv(federatedTokenFileEnvVar)
+	if options.TenantId == "" || options.ClientId == "" || tokenFile == "" {
+		return nil, errorhelper.AddStackToError(fmt.Errorf("workload identity requires %s, %s and %s to be set", tenantIdEnvVar, clientIdEnvVar, federatedTokenFileEnvVar))
+	}
+	return NewWorkloadIdentityTokenSource(client, options, tokenFile), nil
+}
+
+// ParseCertificateAndKey reads the first certificate and private key of a PEM bundle, such as the one an extension
+// receives in its protected settings
+func ParseCertificateAndKey(pemData []byte) (*x509.Certificate, crypto.Signer, error) {
+	var certificate *x509.Certificate
+	var key crypto.Signer
+	for block, rest := pem.Decode(pemData); block != nil; block, rest = pem.Decode(rest) {
+		switch block.Type {
+		case "CERTIFICATE":
+			if certificate == nil {
+				parsed, err := x509.ParseCertificate(block.Bytes)
+				if err != nil {
+					return nil, nil, errorhelper.AddStackToError(fmt.Errorf("unable to parse certificate: %v", err))
+				}
+				certificate = parsed
+			}
+		case "RSA PRIVATE KEY":
+			parsed, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, nil, errorhelper.AddStackToError(fmt.Errorf("unable to parse private key: %v", err))
+			}
+			key = parsed
+		case "PRIVATE KEY":
+			parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, nil, errorhelper.AddStackToError(fmt.Errorf("unable to parse private key: %v", err))
+			}
+			signer, ok := parsed.(crypto.Signer)
+			if !ok {
+				return nil, nil, errorhelper.AddStackToError(fmt.Errorf("unsupported private key type %T", parsed))
+			}
+			key = signer
+		}
+	}
+	if certificate == nil || key == nil {
+		return nil, nil, errorhelper.AddStackToError(fmt.Errorf("pem data must contain a certificate and its private key"))
+	}
+	return certificate, key, nil
+}
+
+func newClientCredentialTokenSource(client httputil.HttpClient, options ClientCredentialOptions, credential func(string, url.Values) error) *clientCredentialTokenSource {
+	if client == nil {
+		panic("client must be specified")
+	}
+	if options.Authority == "" {
+		options.Authority = cloud.ActiveEnvironment().ActiveDirectoryAuthority
+	}
+	return &clientCredentialTokenSource{httpClient: client, options: options, credential: credential}
+}
+
+func (source *clientCredentialTokenSource) tokenEndpoint() string {
+	return fmt.Sprintf("%s/%s/oauth2/v2.0/token", strings.TrimRight(source.options.Authority, "/"), source.options.TenantId)
+}
+
+func (source *clientCredentialTokenSource) GetToken(targetResource string) (Msi, error) {
+	tokenEndpoint := source.tokenEndpoint()
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", source.options.ClientId)
+	form.Set("scope", targetResource+"/.default")
+	if err := source.credential(tokenEndpoint, form); err != nil {
+		return Msi{}, err
+	}
+
+	res, err := source.httpClient.Do(httputil.RequestSpec{
+		Method: httputil.OperationPost,
+		URL:    tokenEndpoint,
+		Header: http.Header{"Content-Type": {"application/x-www-form-urlencoded"}},
+		Body:   strings.NewReader(form.Encode()),
+	})
+	if err != nil {
+		return Msi{}, err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return Msi{}, errorhelper.AddStackToError(err)
+	}
+	if res.StatusCode != 200 {
+		httpErr := httputil.NewHTTPError(res.StatusCode, res.Header, body)
+		return Msi{}, errorhelper.AddStackToError(fmt.Errorf("unable to get token from %s, response code %v, error: %s, error_description: %s",
+			tokenEndpoint, res.StatusCode, httpErr.Code, httpErr.Message))
+	}
+
+	var msi Msi
+	if err := json.Unmarshal(body, &msi); err != nil {
+		return Msi{}, errorhelper.AddStackToError(fmt.Errorf("unable to deserialize token response"))
+	}
+	msi.receivedAt = time.Now()
+	msi.ClientID = source.options.ClientId
+	msi.Resource = targetResource
+	if msi.ExpiresOn == "" {
+		if expiryTime, err := msi.GetExpiryTime(); err == nil {
+			msi.ExpiresOn = strconv.FormatInt(expiryTime.Unix(), 10)
+		}
+	}
+	return msi, nil
+}
+
+// newClientAssertion builds the signed JWT Azure AD accepts as proof of possession of a certificate
+func newClientAssertion(tokenEndpoint string, clientId string, certificate *x509.Certificate, key crypto.Signer) (string, error) {
+	thumbprint := sha1.Sum(certificate.Raw)
+	header, err := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"x5t": base64.RawURLEncoding.EncodeToString(thumbprint[:]),
+	})
+	if err != nil {
+		return "", errorhelper.AddStackToError(err)
+	}
+
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", errorhelper.AddStackToError(err)
+	}
+	now := time.Now()
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": tokenEndpoint,
+		"iss": clientId,
+		"sub": clientId,
+		"jti": hex.EncodeToString(jti),
+		"iat": now.Unix(),
+		"nbf": now.Unix(),
+		"exp": now.Add(assertionLifetime).Unix(),
+	})
+	if err != nil {
+		return "", errorhelper.AddStackToError(err)
+	}
+
+	var signingInput bytes.Buffer
+	signingInput.WriteString(base64.RawURLEncoding.EncodeToString(header))
+	signingInput.WriteString(".")
+	signingInput.WriteString(base64.RawURLEncoding.EncodeToString(claims))
+	digest := sha256.Sum256(signingInput.Bytes())
+	signature, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return "", errorhelper.AddStackToError(fmt.Errorf("unable to sign client assertion: %v", err))
+	}
+	return signingInput.String() + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
@@ -0,0 +1,163 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package msi
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-extension-foundation/httputil"
+)
+
+const testTokenEndpoint = "https://login.microsoftonline.com/tenant/oauth2/v2.0/token"
+
+func newTestCertificate(t *testing.T) (*x509.Certificate, *rsa.PrivateKey, []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "extension"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	pemData = append(pemData, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})...)
+	return certificate, key, pemData
+}
+
+func newTokenEndpointClient(t *testing.T, check func(form url.Values)) *httputil.MockHttpClient {
+	return &httputil.MockHttpClient{Postfunc: func(requestUrl string, headers map[string]string, payload []byte) (int, []byte, error) {
+		if requestUrl != testTokenEndpoint {
+			t.Fatalf("unexpected token endpoint %s", requestUrl)
+		}
+		form, err := url.ParseQuery(string(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if form.Get("grant_type") != "client_credentials" || form.Get("client_id") != "client" || form.Get("scope") != "https://vault.azure.net/.default" {
+			t.Fatalf("unexpected form %v", form)
+		}
+		check(form)
+		return 200, []byte(`{"token_type":"Bearer","expires_in":3599,"access_token":"token"}`), nil
+	}}
+}
+
+func TestClientSecretTokenSource(t *testing.T) {
+	client := newTokenEndpointClient(t, func(form url.Values) {
+		if form.Get("client_secret") != "secret" {
+			t.Fatalf("unexpected form %v", form)
+		}
+	})
+	source := NewClientSecretTokenSource(client, ClientCredentialOptions{TenantId: "tenant", ClientId: "client"}, "secret")
+
+	msi, err := source.GetToken("https://vault.azure.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msi.AccessToken != "token" || msi.Resource != "https://vault.azure.net" {
+		t.Fatalf("unexpected token %+v", msi)
+	}
+	if expired, err := msi.IsMsiTokenExpired(); err != nil || expired {
+		t.Fatalf("token expiry was not resolved: %v %v", expired, err)
+	}
+}
+
+func TestClientCertificateTokenSourceSignsAssertion(t *testing.T) {
+	_, _, pemData := newTestCertificate(t)
+	certificate, key, err := ParseCertificateAndKey(pemData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newTokenEndpointClient(t, func(form url.Values) {
+		if form.Get("client_assertion_type") != clientAssertionType {
+			t.Fatalf("unexpected form %v", form)
+		}
+		segments := strings.Split(form.Get("client_assertion"), ".")
+		if len(segments) != 3 {
+			t.Fatalf("assertion is not a JWT")
+		}
+		var claims map[string]interface{}
+		payload, _ := base64.RawURLEncoding.DecodeString(segments[1])
+		if err := json.Unmarshal(payload, &claims); err != nil {
+			t.Fatal(err)
+		}
+		if claims["aud"] != testTokenEndpoint || claims["iss"] != "client" || claims["sub"] != "client" {
+			t.Fatalf("unexpected claims %v", claims)
+		}
+		signature, _ := base64.RawURLEncoding.DecodeString(segments[2])
+		digest := sha256.Sum256([]byte(segments[0] + "." + segments[1]))
+		if err := rsa.VerifyPKCS1v15(certificate.PublicKey.(*rsa.PublicKey), crypto.SHA256, digest[:], signature); err != nil {
+			t.Fatalf("assertion signature doesn't verify: %v", err)
+		}
+	})
+	source, err := NewClientCertificateTokenSource(client, ClientCredentialOptions{TenantId: "tenant", ClientId: "client"}, certificate, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := source.GetToken("https://vault.azure.net"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWorkloadIdentityTokenSourceReadsTokenFile(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	client := newTokenEndpointClient(t, func(form url.Values) {
+		expected, _ := os.ReadFile(tokenFile)
+		if form.Get("client_assertion") != string(expected) {
+			t.Fatalf("unexpected assertion %s", form.Get("client_assertion"))
+		}
+	})
+	t.Setenv(tenantIdEnvVar, "tenant")
+	t.Setenv(clientIdEnvVar, "client")
+	t.Setenv(federatedTokenFileEnvVar, tokenFile)
+
+	source, err := NewWorkloadIdentityTokenSourceFromEnvironment(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{"first", "rotated"} {
+		if err := os.WriteFile(tokenFile, []byte(token), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := source.GetToken("https://vault.azure.net"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestClientCredentialTokenSourceReturnsAadError(t *testing.T) {
+	client := &httputil.MockHttpClient{Postfunc: func(requestUrl string, headers map[string]string, payload []byte) (int, []byte, error) {
+		return 401, []byte(`{"error":"invalid_client","error_description":"AADSTS7000215: Invalid client secret provided."}`), nil
+	}}
+	source := NewClientSecretTokenSource(client, ClientCredentialOptions{TenantId: "tenant", ClientId: "client"}, "wrong")
+
+	_, err := source.GetToken("https://vault.azure.net")
+	if err == nil || !strings.Contains(err.Error(), "invalid_client") || !strings.Contains(err.Error(), "AADSTS7000215") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
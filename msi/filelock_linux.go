@@ -0,0 +1,33 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package msi
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/Azure/azure-extension-foundation/errorhelper"
+)
+
+// agentTransportKeyFile is the private key of the certificate the guest agent uses to receive protected settings
+const agentTransportKeyFile = "/var/lib/waagent/TransportPrivate.pem"
+
+// lockFile opens path and blocks until it holds an exclusive lock on it
+func lockFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, persistentTokenCacheFileMode)
+	if err != nil {
+		return nil, errorhelper.AddStackToError(fmt.Errorf("unable to open lock file: %v", err))
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		file.Close()
+		return nil, errorhelper.AddStackToError(fmt.Errorf("unable to lock %s: %v", path, err))
+	}
+	return file, nil
+}
+
+func unlockFile(file *os.File) {
+	syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+	file.Close()
+}
@@ -0,0 +1,45 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package msi
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/Azure/azure-extension-foundation/errorhelper"
+)
+
+// the transport certificate of the Windows guest agent lives in the certificate store, a key file must be specified
+const agentTransportKeyFile = ""
+
+const lockfileExclusiveLock = 0x00000002
+
+var (
+	kernel32         = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = kernel32.NewProc("LockFileEx")
+	procUnlockFileEx = kernel32.NewProc("UnlockFileEx")
+)
+
+// lockFile opens path and blocks until it holds an exclusive lock on it
+func lockFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, persistentTokenCacheFileMode)
+	if err != nil {
+		return nil, errorhelper.AddStackToError(fmt.Errorf("unable to open lock file: %v", err))
+	}
+	var overlapped syscall.Overlapped
+	r, _, err := procLockFileEx.Call(file.Fd(), lockfileExclusiveLock, 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+	if r == 0 {
+		file.Close()
+		return nil, errorhelper.AddStackToError(fmt.Errorf("unable to lock %s: %v", path, err))
+	}
+	return file, nil
+}
+
+func unlockFile(file *os.File) {
+	var overlapped syscall.Overlapped
+	procUnlockFileEx.Call(file.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+	file.Close()
+}
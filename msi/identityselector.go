@@ -0,0 +1,64 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package msi
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-extension-foundation/errorhelper"
+)
+
+// IdentitySelector selects a user assigned identity by exactly one of its identifiers. It is meant to be part of the
+// extension public settings, e.g. {"identity": {"resourceId": "/subscriptions/.../userAssignedIdentities/myid"}}.
+type IdentitySelector struct {
+	ClientId   string `json:"clientId,omitempty"`
+	ObjectId   string `json:"objectId,omitempty"`
+	ResourceId string `json:"resourceId,omitempty"`
+}
+
+// IsSpecified returns false if no identifier is set, callers usually fall back to the system assigned identity
+func (selector IdentitySelector) IsSpecified() bool {
+	return countNonEmpty(selector.ClientId, selector.ObjectId, selector.ResourceId) != 0
+}
+
+// Validate returns an error unless exactly one identifier is set
+func (selector IdentitySelector) Validate() error {
+	switch countNonEmpty(selector.ClientId, selector.ObjectId, selector.ResourceId) {
+	case 0:
+		return errorhelper.AddStackToError(fmt.Errorf("identity must specify one of clientId, objectId or resourceId"))
+	case 1:
+	default:
+		return errorhelper.AddStackToError(fmt.Errorf("identity must specify only one of clientId, objectId or resourceId"))
+	}
+	if selector.ResourceId != "" && !strings.HasPrefix(strings.ToLower(selector.ResourceId), "/subscriptions/") {
+		return errorhelper.AddStackToError(fmt.Errorf("identity resourceId %q is not an ARM resource id", selector.ResourceId))
+	}
+	return nil
+}
+
+// GetMsi validates the selector and requests a token for targetResource from provider using the selected identity
+func (selector IdentitySelector) GetMsi(provider MsiProvider, targetResource string) (Msi, error) {
+	if err := selector.Validate(); err != nil {
+		return Msi{}, err
+	}
+	switch {
+	case selector.ClientId != "":
+		return provider.GetMsiUsingClientId(selector.ClientId, targetResource)
+	case selector.ObjectId != "":
+		return provider.GetMsiUsingObjectId(selector.ObjectId, targetResource)
+	default:
+		return provider.GetMsiUsingResourceId(selector.ResourceId, targetResource)
+	}
+}
+
+// TokenCacheKey returns the key of the token for targetResource obtained with the selected identity
+func (selector IdentitySelector) TokenCacheKey(targetResource string) TokenCacheKey {
+	return TokenCacheKey{
+		ClientId: selector.ClientId,
+		ObjectId: selector.ObjectId,
+		MsiResId: selector.ResourceId,
+		Resource: targetResource,
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package msi
+
+import (
+	"encoding/json"
+	"net/url"
+	"testing"
+
+	"github.com/Azure/azure-extension-foundation/httputil"
+)
+
+const testMsiResId = "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.ManagedIdentity/userAssignedIdentities/myid"
+
+type selectorTestSettings struct {
+	Script string `json:"script"`
+	IdentitySelector
+}
+
+func TestIdentitySelectorFromEmbeddingSettings(t *testing.T) {
+	var settings selectorTestSettings
+	err := json.Unmarshal([]byte(`{"script":"run.sh","resourceId":"`+testMsiResId+`"}`), &settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.IdentitySelector.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if settings.ResourceId != testMsiResId {
+		t.Fatalf("unexpected selector %+v", settings.IdentitySelector)
+	}
+}
+
+func TestIdentitySelectorValidation(t *testing.T) {
+	invalid := []IdentitySelector{
+		{},
+		{ClientId: "client", ObjectId: "object"},
+		{ClientId: "client", ResourceId: testMsiResId},
+		{ResourceId: "myid"},
+	}
+	for _, selector := range invalid {
+		if err := selector.Validate(); err == nil {
+			t.Fatalf("selector %+v was accepted", selector)
+		}
+	}
+	if (IdentitySelector{}).IsSpecified() {
+		t.Fatal("empty selector is reported as specified")
+	}
+}
+
+func TestIdentitySelectorGetMsiUsesResourceId(t *testing.T) {
+	httpClient := httputil.MockHttpClient{Getfunc: func(requestUrl string, headers map[string]string) (int, []byte, error) {
+		u, err := url.Parse(requestUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Query().Get("msi_res_id") != testMsiResId || u.Query().Get("resource") != "https://vault.azure.net" {
+			t.Fatalf("unexpected query %s", u.RawQuery)
+		}
+		return 200, []byte(`{"access_token":"token"}`), nil
+	}}
+	provider := NewMsiProviderForIdentitySource(&httpClient, IdentitySourceImds, NoRetryPolicy)
+
+	msi, err := IdentitySelector{ResourceId: testMsiResId}.GetMsi(&provider, "https://vault.azure.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msi.AccessToken != "token" {
+		t.Fatalf("unexpected token %+v", msi)
+	}
+}
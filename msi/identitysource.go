@@ -0,0 +1,200 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package msi
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/Azure/azure-extension-foundation/errorhelper"
+)
+
+// IdentitySource is the kind of endpoint managed identity tokens are requested from
+type IdentitySource int
+
+const (
+	// IdentitySourceImds is the instance metadata service of an Azure virtual machine
+	IdentitySourceImds IdentitySource = iota
+	// IdentitySourceAzureArc is the hybrid instance metadata service (himds) of an Azure Arc-enabled server
+	IdentitySourceAzureArc
+	// IdentitySourceAppService is the identity endpoint of App Service and Azure Functions
+	IdentitySourceAppService
+)
+
+const (
+	identityHeaderEnvVar = "IDENTITY_HEADER"
+	imdsEndpointEnvVar   = "IMDS_ENDPOINT"
+
+	arcApiVersion            = "2020-06-01"
+	arcDefaultIdentityURL    = "http://localhost:40342/metadata/identity/oauth2/token"
+	arcKeyFileExtension      = ".key"
+	arcMaxKeyFileSize        = 4096
+	appServiceApiVersion     = "2019-08-01"
+	appServiceIdentityHeader = "X-IDENTITY-HEADER"
+
+	msiResIdQueryParam           = "msi_res_id"
+	apiVersionQueryParam         = "api-version"
+	appServiceObjectIdQueryParam = "principal_id"
+	appServiceResIdQueryParam    = "mi_res_id"
+)
+
+// for testing
+var (
+	arcAgentExecutable = defaultArcAgentExecutable()
+	arcTokensDirectory = defaultArcTokensDirectory()
+)
+
+func (source IdentitySource) String() string {
+	switch source {
+	case IdentitySourceImds:
+		return "imds"
+	case IdentitySourceAzureArc:
+		return "azure-arc"
+	case IdentitySourceAppService:
+		return "app-service"
+	default:
+		return "unknown"
+	}
+}
+
+// DetectIdentitySource inspects the environment to find where tokens have to be requested from.
+// App Service sets IDENTITY_ENDPOINT and IDENTITY_HEADER, Azure Arc sets IDENTITY_ENDPOINT and IMDS_ENDPOINT for
+// services it manages, and an installed Arc agent also indicates an Arc-enabled server.
+func DetectIdentitySource() IdentitySource {
+	if os.Getenv(identityEnvVar) != "" {
+		if os.Getenv(identityHeaderEnvVar) != "" {
+			return IdentitySourceAppService
+		}
+		if os.Getenv(imdsEndpointEnvVar) != "" {
+			return IdentitySourceAzureArc
+		}
+		return IdentitySourceImds
+	}
+	if arcAgentExecutable != "" {
+		if _, err := os.Stat(arcAgentExecutable); err == nil {
+			return IdentitySourceAzureArc
+		}
+	}
+	return IdentitySourceImds
+}
+
+// newTokenRequest returns the url and headers of a token request to source. queryParams use the instance metadata
+// service parameter names and are translated for the other sources.
+func newTokenRequest(source IdentitySource, queryParams map[string]string) (string, http.Header, error) {
+	var endpoint string
+	header := http.Header{}
+	params := url.Values{}
+
+	switch source {
+	case IdentitySourceImds:
+		endpoint = GetMetadataIdentityURL()
+		header.Set("Metadata", "true")
+		for key, value := range queryParams {
+			params.Set(key, value)
+		}
+	case IdentitySourceAzureArc:
+		endpoint = os.Getenv(identityEnvVar)
+		if endpoint == "" {
+			endpoint = arcDefaultIdentityURL
+		}
+		header.Set("Metadata", "true")
+		params.Set(apiVersionQueryParam, arcApiVersion)
+		for key, value := range queryParams {
+			if key != resourceQueryParam {
+				return "", nil, errorhelper.AddStackToError(fmt.Errorf("azure arc doesn't support user assigned identities, %s can't be specified", key))
+			}
+			params.Set(key, value)
+		}
+	case IdentitySourceAppService:
+		endpoint = os.Getenv(identityEnvVar)
+		header.Set(appServiceIdentityHeader, os.Getenv(identityHeaderEnvVar))
+		params.Set(apiVersionQueryParam, appServiceApiVersion)
+		for key, value := range queryParams {
+			switch key {
+			case objectIdQueryParam:
+				key = appServiceObjectIdQueryParam
+			case msiResIdQueryParam:
+				key = appServiceResIdQueryParam
+			}
+			params.Set(key, value)
+		}
+	default:
+		return "", nil, errorhelper.AddStackToError(fmt.Errorf("unknown identity source %d", source))
+	}
+
+	requestUrl, err := url.Parse(endpoint)
+	if err != nil {
+		return "", nil, errorhelper.AddStackToError(err)
+	}
+	query := requestUrl.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	requestUrl.RawQuery = query.Encode()
+	return requestUrl.String(), header, nil
+}
+
+// readArcChallengeSecret reads the key file named by the Basic realm of an Azure Arc challenge. The file must be a
+// small .key file in the agent's token directory so that a rogue endpoint can't make us disclose arbitrary files.
+func readArcChallengeSecret(header http.Header) (string, error) {
+	challenge := header.Get("WWW-Authenticate")
+	const prefix = "basic realm="
+	if !strings.HasPrefix(strings.ToLower(challenge), prefix) {
+		return "", fmt.Errorf("azure arc identity endpoint returned an unexpected challenge %q", challenge)
+	}
+	keyFile := strings.Trim(challenge[len(prefix):], `"`)
+
+	if filepath.Ext(keyFile) != arcKeyFileExtension {
+		return "", fmt.Errorf("azure arc key file %s doesn't have the %s extension", keyFile, arcKeyFileExtension)
+	}
+	if !isSameDirectory(filepath.Dir(keyFile), arcTokensDirectory) {
+		return "", fmt.Errorf("azure arc key file %s isn't in %s", keyFile, arcTokensDirectory)
+	}
+	info, err := os.Stat(keyFile)
+	if err != nil {
+		return "", fmt.Errorf("unable to read azure arc key file: %v", err)
+	}
+	if info.Size() > arcMaxKeyFileSize {
+		return "", fmt.Errorf("azure arc key file %s is larger than %d bytes", keyFile, arcMaxKeyFileSize)
+	}
+	secret, err := os.ReadFile(keyFile)
+	if err != nil {
+		return "", fmt.Errorf("unable to read azure arc key file: %v", err)
+	}
+	return string(secret), nil
+}
+
+func isSameDirectory(a string, b string) bool {
+	if runtime.GOOS == "windows" {
+		return strings.EqualFold(filepath.Clean(a), filepath.Clean(b))
+	}
+	return filepath.Clean(a) == filepath.Clean(b)
+}
+
+func defaultArcAgentExecutable() string {
+	switch runtime.GOOS {
+	case "linux":
+		return "/opt/azcmagent/bin/himds"
+	case "windows":
+		return filepath.Join(os.Getenv("ProgramFiles"), "AzureConnectedMachineAgent", "himds.exe")
+	default:
+		return ""
+	}
+}
+
+func defaultArcTokensDirectory() string {
+	switch runtime.GOOS {
+	case "linux":
+		return "/var/opt/azcmagent/tokens"
+	case "windows":
+		return filepath.Join(os.Getenv("ProgramData"), "AzureConnectedMachineAgent", "Tokens")
+	default:
+		return ""
+	}
+}
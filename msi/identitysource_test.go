@@ -0,0 +1,151 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package msi
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/azure-extension-foundation/httputil"
+)
+
+const identityTestToken = `{"access_token":"token","expires_on":"1700000000","resource":"https://management.core.windows.net/","token_type":"Bearer"}`
+
+func TestDetectIdentitySource(t *testing.T) {
+	arcAgentExecutable = filepath.Join(t.TempDir(), "himds")
+	defer func() { arcAgentExecutable = defaultArcAgentExecutable() }()
+
+	if source := DetectIdentitySource(); source != IdentitySourceImds {
+		t.Fatalf("expected imds, got %v", source)
+	}
+
+	t.Setenv(identityEnvVar, "http://localhost:40342/metadata/identity/oauth2/token")
+	if source := DetectIdentitySource(); source != IdentitySourceImds {
+		t.Fatalf("IDENTITY_ENDPOINT alone must keep imds, got %v", source)
+	}
+
+	t.Setenv(imdsEndpointEnvVar, "http://localhost:40342")
+	if source := DetectIdentitySource(); source != IdentitySourceAzureArc {
+		t.Fatalf("expected azure arc, got %v", source)
+	}
+
+	t.Setenv(imdsEndpointEnvVar, "")
+	t.Setenv(identityHeaderEnvVar, "secret")
+	if source := DetectIdentitySource(); source != IdentitySourceAppService {
+		t.Fatalf("expected app service, got %v", source)
+	}
+}
+
+func TestDetectIdentitySourceFromArcAgent(t *testing.T) {
+	arcAgentExecutable = filepath.Join(t.TempDir(), "himds")
+	defer func() { arcAgentExecutable = defaultArcAgentExecutable() }()
+	if err := os.WriteFile(arcAgentExecutable, nil, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if source := DetectIdentitySource(); source != IdentitySourceAzureArc {
+		t.Fatalf("expected azure arc, got %v", source)
+	}
+}
+
+func newArcTestServer(t *testing.T, keyFile string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata") != "true" {
+			t.Error("metadata header is missing")
+		}
+		if r.URL.Query().Get("api-version") != arcApiVersion || r.URL.Query().Get("resource") != "https://vault.azure.net" {
+			t.Errorf("unexpected query %s", r.URL.RawQuery)
+		}
+		if r.Header.Get("Authorization") == "" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%s", keyFile))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get("Authorization") != "Basic secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(identityTestToken))
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv(identityEnvVar, server.URL+"/metadata/identity/oauth2/token")
+	t.Setenv(imdsEndpointEnvVar, server.URL)
+	return server
+}
+
+func TestAzureArcChallengeFlow(t *testing.T) {
+	arcTokensDirectory = t.TempDir()
+	defer func() { arcTokensDirectory = defaultArcTokensDirectory() }()
+	keyFile := filepath.Join(arcTokensDirectory, "challenge.key")
+	if err := os.WriteFile(keyFile, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	newArcTestServer(t, keyFile)
+
+	provider := NewMsiProviderWithRetryPolicy(httputil.NewSecureHttpClient(httputil.NoRetry), NoRetryPolicy)
+	if provider.identitySource != IdentitySourceAzureArc {
+		t.Fatalf("expected azure arc, got %v", provider.identitySource)
+	}
+	msi, err := provider.GetMsiForResource("https://vault.azure.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msi.AccessToken != "token" {
+		t.Fatalf("unexpected token %+v", msi)
+	}
+}
+
+func TestAzureArcRejectsKeyFileOutsideTokenDirectory(t *testing.T) {
+	arcTokensDirectory = t.TempDir()
+	defer func() { arcTokensDirectory = defaultArcTokensDirectory() }()
+	keyFile := filepath.Join(t.TempDir(), "challenge.key")
+	if err := os.WriteFile(keyFile, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	newArcTestServer(t, keyFile)
+
+	provider := NewMsiProviderWithRetryPolicy(httputil.NewSecureHttpClient(httputil.NoRetry), NoRetryPolicy)
+	if _, err := provider.GetMsiForResource("https://vault.azure.net"); err == nil {
+		t.Fatal("key file outside of the token directory was read")
+	}
+}
+
+func TestAzureArcRejectsUserAssignedIdentity(t *testing.T) {
+	provider := NewMsiProviderForIdentitySource(&httputil.MockHttpClient{}, IdentitySourceAzureArc, NoRetryPolicy)
+	if _, err := provider.GetMsiUsingClientId("client", defaultResource()); err == nil {
+		t.Fatal("user assigned identity was accepted on azure arc")
+	}
+}
+
+func TestAppServiceFlow(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.Header.Get("X-IDENTITY-HEADER") != "header-secret" {
+			t.Error("identity header is missing")
+		}
+		if query.Get("api-version") != appServiceApiVersion || query.Get("principal_id") != "object" || query.Get("resource") != "https://storage.azure.com/" {
+			t.Errorf("unexpected query %s", r.URL.RawQuery)
+		}
+		w.Write([]byte(identityTestToken))
+	}))
+	defer server.Close()
+	t.Setenv(identityEnvVar, server.URL+"/msi/token")
+	t.Setenv(identityHeaderEnvVar, "header-secret")
+
+	provider := NewMsiProviderWithRetryPolicy(httputil.NewSecureHttpClient(httputil.NoRetry), NoRetryPolicy)
+	if provider.identitySource != IdentitySourceAppService {
+		t.Fatalf("expected app service, got %v", provider.identitySource)
+	}
+	msi, err := provider.GetMsiUsingObjectId("object", "https://storage.azure.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msi.AccessToken != "token" {
+		t.Fatalf("unexpected token %+v", msi)
+	}
+}
@@ -6,24 +6,26 @@ package msi
 import (
 	"encoding/json"
 	"fmt"
-	"net/url"
+	"io/ioutil"
+	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/Azure/azure-extension-foundation/cloud"
 	"github.com/Azure/azure-extension-foundation/errorhelper"
 	"github.com/Azure/azure-extension-foundation/httputil"
 )
 
 const (
-	metadataIdentityURL = "http://169.254.169.254/metadata/identity/oauth2/token?api-version=2018-02-01"
+	metadataIdentityURL  = "http://169.254.169.254/metadata/identity/oauth2/token?api-version=2018-02-01"
+	metadataIdentityPath = "/metadata/identity/oauth2/token?api-version=2018-02-01"
 
 	clientIdQueryParam = "client_id"
 	objectIdQueryParam = "object_id"
 	resourceQueryParam = "resource"
 
-	armResourceUri = "https://management.core.windows.net/"
-
 	identityEnvVar = "IDENTITY_ENDPOINT"
 )
 
@@ -36,6 +38,16 @@ type Msi struct {
 	NotBefore    string `json:"not_before"`
 	Resource     string `json:"resource"`
 	TokenType    string `json:"token_type"`
+
+	// when the token was received, used to resolve expires_in
+	receivedAt time.Time
+}
+
+// layouts of expires_on returned by endpoints not using seconds from epoch
+var expiresOnLayouts = []string{
+	time.RFC3339,
+	"1/2/2006 3:04:05 PM -07:00",
+	"2006-01-02 15:04:05 -07:00",
 }
 
 type MsiProvider interface {
@@ -43,46 +55,123 @@ type MsiProvider interface {
 	GetMsiForResource(targetResource string) (Msi, error)
 	GetMsiUsingClientId(clientId string, targetResource string) (Msi, error)
 	GetMsiUsingObjectId(objectId string, targetResource string) (Msi, error)
+	GetMsiUsingResourceId(msiResId string, targetResource string) (Msi, error)
 }
 
 type provider struct {
-	httpClient httputil.HttpClient
+	httpClient     httputil.HttpClient
+	retryPolicy    RetryPolicy
+	identitySource IdentitySource
 }
 
+// NewMsiProvider returns a provider for the identity source detected from the environment, issuing its requests
+// through client, throttled by the shared instance metadata service rate limiter and retried according to
+// DefaultRetryPolicy
 func NewMsiProvider(client httputil.HttpClient) provider {
-	return provider{httpClient: client}
+	return NewMsiProviderWithRetryPolicy(client, DefaultRetryPolicy)
 }
 
-func (p *provider) getMsiHelper(queryParams map[string]string) (*Msi, error) {
-	var msi = Msi{}
-	requestUrl, err := url.Parse(GetMetadataIdentityURL())
-	if err != nil {
-		return &msi, err
+// NewMsiProviderWithRetryPolicy returns a provider retrying token requests according to retryPolicy. The policy is
+// applied on top of the retry behavior of client, which should usually be httputil.NoRetry.
+func NewMsiProviderWithRetryPolicy(client httputil.HttpClient, retryPolicy RetryPolicy) provider {
+	return NewMsiProviderForIdentitySource(client, DetectIdentitySource(), retryPolicy)
+}
+
+// NewMsiProviderForIdentitySource returns a provider requesting tokens from identitySource instead of detecting it
+func NewMsiProviderForIdentitySource(client httputil.HttpClient, identitySource IdentitySource, retryPolicy RetryPolicy) provider {
+	if err := retryPolicy.Validate(); err != nil {
+		panic(err)
 	}
-	urlQuery := requestUrl.Query()
-	for key, value := range queryParams {
-		urlQuery.Add(key, value)
+	return provider{
+		httpClient:     httputil.NewThrottledHttpClient(client, httputil.ImdsRateLimiter, nil),
+		retryPolicy:    retryPolicy,
+		identitySource: identitySource,
 	}
-	requestUrl.RawQuery = urlQuery.Encode()
+}
 
-	code, body, err := p.httpClient.Get(requestUrl.String(), map[string]string{"Metadata": "true"})
+func (p *provider) getMsiHelper(queryParams map[string]string) (*Msi, error) {
+	var msi = Msi{}
+	requestUrl, header, err := newTokenRequest(p.identitySource, queryParams)
 	if err != nil {
 		return &msi, err
 	}
 
-	if code != 200 {
-		return &msi, errorhelper.AddStackToError(fmt.Errorf("unable to get msi, metadata service response code %v", code))
+	var elapsed time.Duration
+	var code int
+	var body []byte
+	challenged := false
+	for attempt := 1; ; attempt++ {
+		var responseHeader http.Header
+		requestStart := time.Now()
+		code, responseHeader, body, err = p.requestToken(requestUrl, header)
+		elapsed += time.Since(requestStart)
+		if err != nil {
+			return &msi, err
+		}
+		if code == 200 {
+			break
+		}
+
+		// azure arc answers the first request with a challenge naming a file only local administrators can read
+		if code == http.StatusUnauthorized && p.identitySource == IdentitySourceAzureArc && !challenged {
+			secret, err := readArcChallengeSecret(responseHeader)
+			if err != nil {
+				return &msi, errorhelper.AddStackToError(err)
+			}
+			header.Set("Authorization", "Basic "+secret)
+			challenged = true
+			continue
+		}
+
+		delay, retry := p.retryPolicy.nextDelay(attempt, code, responseHeader, elapsed)
+		if !retry {
+			return &msi, errorhelper.AddStackToError(newMsiResponseError(code, responseHeader, body))
+		}
+		sleep(delay)
+		elapsed += delay
 	}
 
 	err = json.Unmarshal(body, &msi)
 	if err != nil {
 		return &msi, errorhelper.AddStackToError(fmt.Errorf("unable to deserialize metadata service response"))
 	}
+	msi.receivedAt = time.Now()
 	return &msi, nil
 }
 
+func (p *provider) requestToken(requestUrl string, header http.Header) (int, http.Header, []byte, error) {
+	res, err := p.httpClient.Do(httputil.RequestSpec{
+		Method: httputil.OperationGet,
+		URL:    requestUrl,
+		Header: header,
+	})
+	if err != nil {
+		return -1, nil, nil, err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return -1, nil, nil, errorhelper.AddStackToError(err)
+	}
+	return res.StatusCode, res.Header, body, nil
+}
+
+// newMsiResponseError surfaces the error and error_description fields returned by the metadata service
+func newMsiResponseError(code int, header http.Header, body []byte) error {
+	httpErr := httputil.NewHTTPError(code, header, body)
+	if httpErr.Code == "" {
+		return fmt.Errorf("unable to get msi, metadata service response code %v", code)
+	}
+	return fmt.Errorf("unable to get msi, metadata service response code %v, error: %s, error_description: %s", code, httpErr.Code, httpErr.Message)
+}
+
+// defaultResource returns the Azure Resource Manager audience of the active cloud, see cloud.Init
+func defaultResource() string {
+	return cloud.ActiveEnvironment().ResourceManagerAudience
+}
+
 func (p *provider) GetMsi() (Msi, error) {
-	msi, err := p.getMsiHelper(map[string]string{resourceQueryParam: armResourceUri})
+	msi, err := p.getMsiHelper(map[string]string{resourceQueryParam: defaultResource()})
 	return *msi, err
 }
 
@@ -101,30 +190,96 @@ func (p *provider) GetMsiUsingObjectId(objectId string, targetResource string) (
 	return *msi, err
 }
 
+// GetToken returns a token of the system assigned identity for targetResource
+func (p *provider) GetToken(targetResource string) (Msi, error) {
+	return p.GetMsiForResource(targetResource)
+}
+
+// GetMsiUsingResourceId selects the user assigned identity by its ARM resource id (msi_res_id)
+func (p *provider) GetMsiUsingResourceId(msiResId string, targetResource string) (Msi, error) {
+	msi, err := p.getMsiHelper(map[string]string{msiResIdQueryParam: msiResId, resourceQueryParam: targetResource})
+	return *msi, err
+}
+
 // check expiry of MSI token based on time
 func (msi *Msi) IsMsiTokenExpired() (bool, error) {
+	// Consider token expired 2 minutes before expiry time
+	return msi.IsExpiredWithSkew(2 * time.Minute)
+}
+
+// IsExpiredWithSkew considers the token expired skew before its expiry time
+func (msi *Msi) IsExpiredWithSkew(skew time.Duration) (bool, error) {
 	expiryTime, err := msi.GetExpiryTime()
 	if err != nil {
 		return false, err
 	}
+	return time.Now().After(expiryTime.Add(-skew)), nil
+}
 
-	// Consider token expired 2 minutes before expiry time
-	expiryTime = expiryTime.Add(-2 * time.Minute)
+// GetExpiryTime reads expires_on, given in seconds from epoch or as a date. When expires_on is missing it falls back
+// to expires_in counted from when the token was received, or from not_before if the token was deserialized.
+func (msi *Msi) GetExpiryTime() (time.Time, error) {
+	if msi.ExpiresOn != "" {
+		if expiryTimeInSeconds, err := strconv.ParseInt(msi.ExpiresOn, 10, 64); err == nil {
+			return time.Unix(expiryTimeInSeconds, 0), nil
+		}
+		for _, layout := range expiresOnLayouts {
+			if expiryTime, err := time.Parse(layout, msi.ExpiresOn); err == nil {
+				return expiryTime, nil
+			}
+		}
+		return time.Unix(0, 0), fmt.Errorf("unable to parse expires_on %q", msi.ExpiresOn)
+	}
 
-	if time.Now().After(expiryTime) {
-		return true, nil
-	} else {
-		return false, nil
+	expiresIn, err := strconv.ParseInt(msi.ExpiresIn, 10, 64)
+	if err != nil {
+		return time.Unix(0, 0), fmt.Errorf("token has neither expires_on nor a valid expires_in")
 	}
+	issuedAt := msi.receivedAt
+	if issuedAt.IsZero() {
+		notBefore, err := strconv.ParseInt(msi.NotBefore, 10, 64)
+		if err != nil {
+			return time.Unix(0, 0), fmt.Errorf("unable to resolve expires_in, the time the token was issued is unknown")
+		}
+		issuedAt = time.Unix(notBefore, 0)
+	}
+	return issuedAt.Add(time.Duration(expiresIn) * time.Second), nil
 }
 
-func (msi *Msi) GetExpiryTime() (time.Time, error) {
-	expiryTimeInSeconds, err := strconv.ParseInt(msi.ExpiresOn, 10, 64)
-	if err != nil {
-		return time.Unix(0, 0), err
+// UnmarshalJSON accepts the numeric fields either as strings or as numbers, endpoints differ
+func (msi *Msi) UnmarshalJSON(data []byte) error {
+	type plainMsi Msi
+	aux := struct {
+		*plainMsi
+		ExpiresIn    numberOrString `json:"expires_in"`
+		ExpiresOn    numberOrString `json:"expires_on"`
+		ExtExpiresIn numberOrString `json:"ext_expires_in"`
+		NotBefore    numberOrString `json:"not_before"`
+	}{plainMsi: (*plainMsi)(msi)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
 	}
-	expiryTime := time.Unix(expiryTimeInSeconds, 0)
-	return expiryTime, nil
+	msi.ExpiresIn = string(aux.ExpiresIn)
+	msi.ExpiresOn = string(aux.ExpiresOn)
+	msi.ExtExpiresIn = string(aux.ExtExpiresIn)
+	msi.NotBefore = string(aux.NotBefore)
+	return nil
+}
+
+type numberOrString string
+
+func (value *numberOrString) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*value = numberOrString(text)
+		return nil
+	}
+	var number json.Number
+	if err := json.Unmarshal(data, &number); err != nil {
+		return err
+	}
+	*value = numberOrString(number)
+	return nil
 }
 
 func (msi *Msi) GetJson() (string, error) {
@@ -132,10 +287,15 @@ func (msi *Msi) GetJson() (string, error) {
 	return string(jsonBytes[:]), err
 }
 
+// GetMetadataIdentityURL returns the token endpoint of the instance metadata service. IDENTITY_ENDPOINT overrides it,
+// IMDS_ENDPOINT overrides the address of the instance metadata service, e.g. to point to an emulator.
 func GetMetadataIdentityURL() string {
 	envMetadataIdentityURL := os.Getenv(identityEnvVar)
 	if envMetadataIdentityURL != "" {
 		return envMetadataIdentityURL
 	}
+	if imdsEndpoint := os.Getenv(imdsEndpointEnvVar); imdsEndpoint != "" {
+		return strings.TrimSuffix(imdsEndpoint, "/") + metadataIdentityPath
+	}
 	return metadataIdentityURL
 }
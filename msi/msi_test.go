@@ -4,12 +4,18 @@
 package msi
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/Azure/azure-extension-foundation/cloud"
 	"github.com/Azure/azure-extension-foundation/httputil"
 )
 
@@ -56,6 +62,156 @@ func TestGetMsiReturns400(t *testing.T) {
 	}
 }
 
+func stubSleep(t *testing.T) *[]time.Duration {
+	delays := []time.Duration{}
+	sleep = func(d time.Duration) { delays = append(delays, d) }
+	t.Cleanup(func() { sleep = time.Sleep })
+	return &delays
+}
+
+func newMockTokenResponse(code int, header http.Header, body string) *httputil.Response {
+	return &httputil.Response{StatusCode: code, Header: header, Body: ioutil.NopCloser(bytes.NewReader([]byte(body)))}
+}
+
+func TestGetMsiRetriesTransientResponses(t *testing.T) {
+	delays := stubSleep(t)
+	codes := []int{404, 410, 429, 503, 200}
+	attempt := 0
+	httpClient := httputil.MockHttpClient{Dofunc: func(spec httputil.RequestSpec) (*httputil.Response, error) {
+		code := codes[attempt]
+		attempt++
+		if code == 200 {
+			return newMockTokenResponse(200, nil, `{"access_token":"token"}`), nil
+		}
+		return newMockTokenResponse(code, nil, ""), nil
+	}}
+	provider := NewMsiProvider(&httpClient)
+
+	msi, err := provider.GetMsi()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msi.AccessToken != "token" || attempt != len(codes) {
+		t.Fatalf("unexpected result after %d attempts: %+v", attempt, msi)
+	}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}
+	for i, delay := range expected {
+		if (*delays)[i] != delay {
+			t.Fatalf("unexpected back-off %v", *delays)
+		}
+	}
+}
+
+func TestGetMsiHonorsRetryAfter(t *testing.T) {
+	delays := stubSleep(t)
+	attempt := 0
+	httpClient := httputil.MockHttpClient{Dofunc: func(spec httputil.RequestSpec) (*httputil.Response, error) {
+		attempt++
+		if attempt == 1 {
+			return newMockTokenResponse(429, http.Header{"Retry-After": {"7"}}, ""), nil
+		}
+		return newMockTokenResponse(200, nil, `{"access_token":"token"}`), nil
+	}}
+	provider := NewMsiProvider(&httpClient)
+
+	if _, err := provider.GetMsi(); err != nil {
+		t.Fatal(err)
+	}
+	if len(*delays) != 1 || (*delays)[0] != 7*time.Second {
+		t.Fatalf("Retry-After was not honored, delays: %v", *delays)
+	}
+}
+
+func TestGetMsiUsesAudienceOfActiveCloud(t *testing.T) {
+	if err := cloud.SetActiveEnvironment(cloud.AzureUSGovernmentCloud); err != nil {
+		t.Fatal(err)
+	}
+	defer cloud.SetActiveEnvironment(cloud.AzurePublicCloud)
+	var resource string
+	httpClient := httputil.MockHttpClient{Dofunc: func(spec httputil.RequestSpec) (*httputil.Response, error) {
+		u, _ := url.Parse(spec.URL)
+		resource = u.Query().Get(resourceQueryParam)
+		return newMockTokenResponse(200, nil, `{"access_token":"token"}`), nil
+	}}
+	provider := NewMsiProviderForIdentitySource(&httpClient, IdentitySourceImds, NoRetryPolicy)
+
+	if _, err := provider.GetMsi(); err != nil {
+		t.Fatal(err)
+	}
+	if resource != "https://management.core.usgovcloudapi.net/" {
+		t.Fatalf("unexpected resource %s", resource)
+	}
+}
+
+func TestGetMsiDoesNotBusyLoopOnZeroRetryAfter(t *testing.T) {
+	delays := stubSleep(t)
+	attempts := 0
+	httpClient := httputil.MockHttpClient{Dofunc: func(spec httputil.RequestSpec) (*httputil.Response, error) {
+		attempts++
+		return newMockTokenResponse(429, http.Header{"Retry-After": {"0"}}, ""), nil
+	}}
+	provider := NewMsiProvider(&httpClient)
+
+	if _, err := provider.GetMsi(); err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, delay := range *delays {
+		if delay < DefaultRetryPolicy.InitialDelay {
+			t.Fatalf("retried after %v, delays: %v", delay, *delays)
+		}
+	}
+	if attempts > 10 {
+		t.Fatalf("%d attempts within the retry policy", attempts)
+	}
+}
+
+func TestRetryPolicyWithoutDelayIsRejected(t *testing.T) {
+	if err := (RetryPolicy{MaxElapsedTime: time.Minute}).Validate(); err == nil {
+		t.Fatal("policy retrying without delay was accepted")
+	}
+	if err := NoRetryPolicy.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("provider accepted a policy retrying without delay")
+		}
+	}()
+	NewMsiProviderWithRetryPolicy(&httputil.MockHttpClient{}, RetryPolicy{MaxElapsedTime: time.Minute})
+}
+
+func TestGetMsiGivesUpAfterMaxElapsedTime(t *testing.T) {
+	delays := stubSleep(t)
+	httpClient := httputil.MockHttpClient{Dofunc: func(spec httputil.RequestSpec) (*httputil.Response, error) {
+		return newMockTokenResponse(410, nil, ""), nil
+	}}
+	provider := NewMsiProvider(&httpClient)
+
+	if _, err := provider.GetMsi(); err == nil {
+		t.Fatal("expected an error")
+	}
+	var waited time.Duration
+	for _, delay := range *delays {
+		waited += delay
+	}
+	if waited > DefaultRetryPolicy.MaxElapsedTime || waited < DefaultRetryPolicy.MaxElapsedTime/2 {
+		t.Fatalf("waited %v in total", waited)
+	}
+}
+
+func TestGetMsiSurfacesErrorDescription(t *testing.T) {
+	stubSleep(t)
+	httpClient := httputil.MockHttpClient{Dofunc: func(spec httputil.RequestSpec) (*httputil.Response, error) {
+		return newMockTokenResponse(400, nil, `{"error":"invalid_request","error_description":"Identity not found"}`), nil
+	}}
+	provider := NewMsiProvider(&httpClient)
+
+	_, err := provider.GetMsiUsingClientId("unknown", defaultResource())
+	if err == nil || !strings.Contains(err.Error(), "Identity not found") || !strings.Contains(err.Error(), "invalid_request") {
+		t.Fatalf("error doesn't describe the failure: %v", err)
+	}
+}
+
 func TestCanGetMsi(t *testing.T) {
 	t.Skip() // for testing on Azure VM only
 	outdir := "./testoutput"
@@ -181,3 +337,10 @@ func TestCanGetImdsVariable(t *testing.T) {
 
 	os.Unsetenv(identityEnvVar)
 }
+
+func TestImdsEndpointOverridesMetadataIdentityURL(t *testing.T) {
+	t.Setenv(imdsEndpointEnvVar, "http://127.0.0.1:8080/")
+	if url := GetMetadataIdentityURL(); url != "http://127.0.0.1:8080/metadata/identity/oauth2/token?api-version=2018-02-01" {
+		t.Fatalf("unexpected url %s", url)
+	}
+}
@@ -0,0 +1,323 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package msi
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-extension-foundation/errorhelper"
+	"github.com/Azure/azure-extension-foundation/settings"
+)
+
+const (
+	persistentTokenCacheFileName = "msitokencache"
+	persistentTokenCacheFileMode = os.FileMode(0600)
+
+	// context of the encryption key derivation, changing it invalidates every existing cache file
+	persistentTokenCacheKeyContext = "azure-extension-foundation msi token cache v1"
+)
+
+// PersistentTokenCacheOptions configures where tokens shared between handler processes are stored
+type PersistentTokenCacheOptions struct {
+	// Directory holds the cache file, defaults to the extension directory of the handler environment
+	Directory string
+	// KeyFile is the PEM private key the encryption key is derived from. Defaults to the private key of the guest
+	// agent transport certificate, which is only readable by root.
+	KeyFile string
+	// ExpiryBuffer is how long before its expiry a token stops being served from the file. Defaults to 2 minutes.
+	ExpiryBuffer time.Duration
+}
+
+type persistentMsiProvider struct {
+	provider     MsiProvider
+	path         string
+	key          []byte
+	expiryBuffer time.Duration
+}
+
+type persistentTokenCacheEntry struct {
+	Key       TokenCacheKey `json:"key"`
+	Msi       Msi           `json:"msi"`
+	ExpiresOn int64         `json:"expiresOn"`
+}
+
+// NewPersistentMsiProvider returns a provider serving tokens of provider from an encrypted file, so that short lived
+// handler processes don't each request a token from the identity endpoint. Concurrent processes are serialized with
+// a file lock and a single one requests a missing token.
+func NewPersistentMsiProvider(provider MsiProvider, options PersistentTokenCacheOptions) (MsiProvider, error) {
+	if provider == nil {
+		panic("msiProvider must be specified")
+	}
+	if options.Directory == "" {
+		environment, err := settings.GetHandlerEnvironment()
+		if err != nil {
+			return nil, err
+		}
+		if environment.HandlerEnvironment.ConfigFolder == "" {
+			return nil, errorhelper.AddStackToError(fmt.Errorf("token cache directory must be specified"))
+		}
+		options.Directory = filepath.Dir(environment.HandlerEnvironment.ConfigFolder)
+	}
+	if options.KeyFile == "" {
+		options.KeyFile = agentTransportKeyFile
+	}
+	if options.KeyFile == "" {
+		return nil, errorhelper.AddStackToError(fmt.Errorf("token cache key file must be specified"))
+	}
+	if options.ExpiryBuffer == 0 {
+		options.ExpiryBuffer = defaultExpiryBuffer
+	}
+
+	key, err := deriveTokenCacheKey(options.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &persistentMsiProvider{
+		provider:     provider,
+		path:         filepath.Join(options.Directory, persistentTokenCacheFileName),
+		key:          key,
+		expiryBuffer: options.ExpiryBuffer,
+	}, nil
+}
+
+// deriveTokenCacheKey derives the AES-256 key of the cache file from the private key in keyFile
+func deriveTokenCacheKey(keyFile string) ([]byte, error) {
+	pemData, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, errorhelper.AddStackToError(fmt.Errorf("unable to read token cache key file: %v", err))
+	}
+	for block, rest := pem.Decode(pemData); block != nil; block, rest = pem.Decode(rest) {
+		if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			mac := hmac.New(sha256.New, block.Bytes)
+			mac.Write([]byte(persistentTokenCacheKeyContext))
+			return mac.Sum(nil), nil
+		}
+	}
+	return nil, errorhelper.AddStackToError(fmt.Errorf("token cache key file %s doesn't contain a private key", keyFile))
+}
+
+func (p *persistentMsiProvider) GetMsi() (Msi, error) {
+	// the default resource depends on the cloud of the process, the file is shared by processes of any cloud
+	return p.get(TokenCacheKey{Resource: defaultResource()}, p.provider.GetMsi)
+}
+
+func (p *persistentMsiProvider) GetToken(targetResource string) (Msi, error) {
+	return p.GetMsiForResource(targetResource)
+}
+
+func (p *persistentMsiProvider) GetMsiForResource(targetResource string) (Msi, error) {
+	return p.get(TokenCacheKey{Resource: targetResource}, func() (Msi, error) {
+		return p.provider.GetMsiForResource(targetResource)
+	})
+}
+
+func (p *persistentMsiProvider) GetMsiUsingClientId(clientId string, targetResource string) (Msi, error) {
+	return p.get(TokenCacheKey{ClientId: clientId, Resource: targetResource}, func() (Msi, error) {
+		return p.provider.GetMsiUsingClientId(clientId, targetResource)
+	})
+}
+
+func (p *persistentMsiProvider) GetMsiUsingObjectId(objectId string, targetResource string) (Msi, error) {
+	return p.get(TokenCacheKey{ObjectId: objectId, Resource: targetResource}, func() (Msi, error) {
+		return p.provider.GetMsiUsingObjectId(objectId, targetResource)
+	})
+}
+
+func (p *persistentMsiProvider) GetMsiUsingResourceId(msiResId string, targetResource string) (Msi, error) {
+	return p.get(TokenCacheKey{MsiResId: msiResId, Resource: targetResource}, func() (Msi, error) {
+		return p.provider.GetMsiUsingResourceId(msiResId, targetResource)
+	})
+}
+
+// Invalidate removes the token for key from the file, TokenCache.Invalidate calls it when a token was rejected
+func (p *persistentMsiProvider) Invalidate(key TokenCacheKey) {
+	if key.Resource == "" {
+		key.Resource = defaultResource()
+	}
+	lock, err := lockFile(p.path + ".lock")
+	if err != nil {
+		return
+	}
+	defer unlockFile(lock)
+	entries := p.read()
+	if _, ok := entries[key]; ok {
+		delete(entries, key)
+		p.write(entries)
+	}
+}
+
+func (p *persistentMsiProvider) get(key TokenCacheKey, request func() (Msi, error)) (Msi, error) {
+	lock, err := lockFile(p.path + ".lock")
+	if err != nil {
+		return Msi{}, err
+	}
+	defer unlockFile(lock)
+
+	entries := p.read()
+	if entry, ok := entries[key]; ok && time.Now().Before(time.Unix(entry.ExpiresOn, 0).Add(-p.expiryBuffer)) && entry.matchesKey() {
+		return entry.Msi, nil
+	}
+
+	msi, err := request()
+	if err != nil {
+		return Msi{}, err
+	}
+	expiryTime, err := msi.GetExpiryTime()
+	if err != nil {
+		// without an expiry time the token can't be shared
+		return msi, nil
+	}
+	stored := msi
+	stored.ExpiresOn = strconv.FormatInt(expiryTime.Unix(), 10)
+	entries[key] = persistentTokenCacheEntry{Key: key, Msi: stored, ExpiresOn: expiryTime.Unix()}
+	// failing to persist the token only costs another request
+	p.write(entries)
+	return msi, nil
+}
+
+// matchesKey returns false if the claims of the token contradict the identity or resource of its key
+func (entry persistentTokenCacheEntry) matchesKey() bool {
+	claims, err := entry.Msi.GetClaims()
+	if err != nil {
+		// opaque tokens can't be checked
+		return true
+	}
+	if entry.Key.Resource != "" && len(claims.Audience) != 0 && !containsResource(claims.Audience, entry.Key.Resource) {
+		return false
+	}
+	switch {
+	case entry.Key.ClientId != "" && claims.AppId != "":
+		return strings.EqualFold(entry.Key.ClientId, claims.AppId)
+	case entry.Key.ObjectId != "" && claims.ObjectId != "":
+		return strings.EqualFold(entry.Key.ObjectId, claims.ObjectId)
+	case entry.Key.MsiResId != "" && claims.MiResourceId != "":
+		return strings.EqualFold(entry.Key.MsiResId, claims.MiResourceId)
+	}
+	return true
+}
+
+// containsResource returns true if one of audiences is resource, ignoring case and a trailing slash
+func containsResource(audiences []string, resource string) bool {
+	for _, audience := range audiences {
+		if strings.EqualFold(strings.TrimSuffix(audience, "/"), strings.TrimSuffix(resource, "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// read returns the unexpired entries of the cache file, a missing, foreign or corrupt file is treated as empty
+func (p *persistentMsiProvider) read() map[TokenCacheKey]persistentTokenCacheEntry {
+	entries := make(map[TokenCacheKey]persistentTokenCacheEntry)
+	info, err := os.Stat(p.path)
+	if err != nil || info.Mode().Perm()&^persistentTokenCacheFileMode != 0 {
+		// a file readable by others may have been planted or tampered with
+		return entries
+	}
+	data, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return entries
+	}
+	plaintext, err := p.decrypt(data)
+	if err != nil {
+		return entries
+	}
+	var stored []persistentTokenCacheEntry
+	if err := json.Unmarshal(plaintext, &stored); err != nil {
+		return entries
+	}
+	now := time.Now()
+	for _, entry := range stored {
+		if now.Before(time.Unix(entry.ExpiresOn, 0)) {
+			entries[entry.Key] = entry
+		}
+	}
+	return entries
+}
+
+// write atomically replaces the cache file with entries
+func (p *persistentMsiProvider) write(entries map[TokenCacheKey]persistentTokenCacheEntry) error {
+	stored := make([]persistentTokenCacheEntry, 0, len(entries))
+	for _, entry := range entries {
+		stored = append(stored, entry)
+	}
+	plaintext, err := json.Marshal(stored)
+	if err != nil {
+		return errorhelper.AddStackToError(err)
+	}
+	ciphertext, err := p.encrypt(plaintext)
+	if err != nil {
+		return err
+	}
+
+	temp, err := ioutil.TempFile(filepath.Dir(p.path), persistentTokenCacheFileName+".*")
+	if err != nil {
+		return errorhelper.AddStackToError(err)
+	}
+	defer os.Remove(temp.Name())
+	if err := temp.Chmod(persistentTokenCacheFileMode); err != nil {
+		temp.Close()
+		return errorhelper.AddStackToError(err)
+	}
+	if _, err := temp.Write(ciphertext); err != nil {
+		temp.Close()
+		return errorhelper.AddStackToError(err)
+	}
+	if err := temp.Close(); err != nil {
+		return errorhelper.AddStackToError(err)
+	}
+	return errorhelper.AddStackToError(os.Rename(temp.Name(), p.path))
+}
+
+func (p *persistentMsiProvider) encrypt(plaintext []byte) ([]byte, error) {
+	aead, err := p.newAead()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errorhelper.AddStackToError(err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, []byte(p.path)), nil
+}
+
+func (p *persistentMsiProvider) decrypt(ciphertext []byte) ([]byte, error) {
+	aead, err := p.newAead()
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errorhelper.AddStackToError(fmt.Errorf("token cache file is truncated"))
+	}
+	plaintext, err := aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], []byte(p.path))
+	if err != nil {
+		return nil, errorhelper.AddStackToError(fmt.Errorf("unable to decrypt token cache file: %v", err))
+	}
+	return plaintext, nil
+}
+
+func (p *persistentMsiProvider) newAead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(p.key)
+	if err != nil {
+		return nil, errorhelper.AddStackToError(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errorhelper.AddStackToError(err)
+	}
+	return aead, nil
+}
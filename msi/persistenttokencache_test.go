@@ -0,0 +1,186 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package msi
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-extension-foundation/cloud"
+)
+
+func newTestKeyFile(t *testing.T, dir string, name string) string {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := ioutil.WriteFile(path, pemData, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newTestPersistentProvider(t *testing.T, inner MsiProvider, dir string, keyFile string) MsiProvider {
+	provider, err := NewPersistentMsiProvider(inner, PersistentTokenCacheOptions{Directory: dir, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+func TestPersistentTokenCacheSharesTokensBetweenProcesses(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := newTestKeyFile(t, dir, "key.pem")
+	inner := &countingMsiProvider{lifetime: time.Hour}
+
+	first, err := newTestPersistentProvider(t, inner, dir, keyFile).GetMsiForResource("https://vault.azure.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a new provider stands for the next handler process
+	second, err := newTestPersistentProvider(t, inner, dir, keyFile).GetMsiForResource("https://vault.azure.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.AccessToken != second.AccessToken || inner.calls != 1 {
+		t.Fatalf("token was not served from the file, provider calls: %d", inner.calls)
+	}
+
+	if _, err := newTestPersistentProvider(t, inner, dir, keyFile).GetMsiUsingResourceId(testMsiResId, "https://vault.azure.net"); err != nil {
+		t.Fatal(err)
+	}
+	if inner.calls != 2 {
+		t.Fatal("token of another identity was served")
+	}
+
+	info, err := os.Stat(filepath.Join(dir, persistentTokenCacheFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected cache file mode %v", info.Mode())
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, persistentTokenCacheFileName))
+	if len(data) == 0 || bytes.Contains(data, []byte(first.AccessToken)) {
+		t.Fatal("token is stored in clear text")
+	}
+}
+
+func TestPersistentTokenCacheIgnoresForeignFiles(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := newTestKeyFile(t, dir, "key.pem")
+	inner := &countingMsiProvider{lifetime: time.Hour}
+	newTestPersistentProvider(t, inner, dir, keyFile).GetMsiForResource("https://vault.azure.net")
+
+	// a rotated agent certificate can't decrypt the file
+	otherKeyFile := newTestKeyFile(t, dir, "other.pem")
+	if _, err := newTestPersistentProvider(t, inner, dir, otherKeyFile).GetMsiForResource("https://vault.azure.net"); err != nil {
+		t.Fatal(err)
+	}
+	if inner.calls != 2 {
+		t.Fatal("file encrypted with another key was used")
+	}
+
+	// a file readable by others is not trusted
+	path := filepath.Join(dir, persistentTokenCacheFileName)
+	if err := os.Chmod(path, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newTestPersistentProvider(t, inner, dir, otherKeyFile).GetMsiForResource("https://vault.azure.net"); err != nil {
+		t.Fatal(err)
+	}
+	if inner.calls != 3 {
+		t.Fatal("file readable by others was used")
+	}
+}
+
+func TestPersistentTokenCacheInvalidateThroughTokenCache(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := newTestKeyFile(t, dir, "key.pem")
+	inner := &countingMsiProvider{lifetime: time.Hour}
+	cache := NewTokenCache(newTestPersistentProvider(t, inner, dir, keyFile), TokenCacheOptions{RefreshFraction: -1})
+	defer cache.Close()
+
+	key := TokenCacheKey{MsiResId: testMsiResId}
+	if _, err := cache.Get(key); err != nil {
+		t.Fatal(err)
+	}
+	cache.Invalidate(key)
+	if _, err := cache.Get(key); err != nil {
+		t.Fatal(err)
+	}
+	if inner.calls != 2 {
+		t.Fatalf("rejected token was served from the file, provider calls: %d", inner.calls)
+	}
+}
+
+func TestPersistentTokenCacheKeysDefaultResourceByCloud(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := newTestKeyFile(t, dir, "key.pem")
+	inner := &countingMsiProvider{lifetime: time.Hour}
+
+	public, err := newTestPersistentProvider(t, inner, dir, keyFile).GetMsi()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a process of another cloud shares the file
+	if err := cloud.SetActiveEnvironment(cloud.AzureUSGovernmentCloud); err != nil {
+		t.Fatal(err)
+	}
+	defer cloud.SetActiveEnvironment(cloud.AzurePublicCloud)
+	government, err := newTestPersistentProvider(t, inner, dir, keyFile).GetMsi()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if government.AccessToken == public.AccessToken || government.Resource != cloud.AzureUSGovernmentCloud.ResourceManagerAudience {
+		t.Fatalf("token of the public cloud was served: %+v", government)
+	}
+}
+
+func TestPersistentTokenCacheEntryMatchesAudience(t *testing.T) {
+	token := Msi{AccessToken: newTestJwt(map[string]interface{}{"aud": "https://management.core.windows.net/"})}
+	for resource, expected := range map[string]bool{
+		"https://management.core.windows.net/":       true,
+		"https://management.core.windows.net":        true,
+		"https://management.core.usgovcloudapi.net/": false,
+	} {
+		entry := persistentTokenCacheEntry{Key: TokenCacheKey{Resource: resource}, Msi: token}
+		if entry.matchesKey() != expected {
+			t.Fatalf("entry for %s matched token of another audience: %v", resource, !expected)
+		}
+	}
+}
+
+func TestPersistentTokenCacheSerializesConcurrentRequests(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := newTestKeyFile(t, dir, "key.pem")
+	inner := &countingMsiProvider{lifetime: time.Hour, delay: 50 * time.Millisecond}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		provider := newTestPersistentProvider(t, inner, dir, keyFile)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := provider.GetMsi(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if inner.calls != 1 {
+		t.Fatalf("concurrent handlers requested %d tokens", inner.calls)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package msi
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Azure/azure-extension-foundation/httputil"
+)
+
+// RetryPolicy controls how token requests are retried. Following the instance metadata service guidance, 404 (the
+// identity is still being assigned), 410 (the service is being updated), 429 and 5xx responses are retried with
+// exponential back-off, waiting at least as long as the Retry-After header asks.
+type RetryPolicy struct {
+	// MaxElapsedTime bounds the total time spent on attempts and waiting between them, zero disables retries
+	MaxElapsedTime time.Duration
+	// InitialDelay must be positive when retries are enabled
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+}
+
+// DefaultRetryPolicy retries for up to 70 seconds, which is how long the metadata service may take to be updated
+var DefaultRetryPolicy = RetryPolicy{MaxElapsedTime: 70 * time.Second, InitialDelay: time.Second, MaxDelay: 16 * time.Second}
+
+var NoRetryPolicy = RetryPolicy{}
+
+// for testing
+var sleep = time.Sleep
+
+// Validate returns an error if the policy could retry without waiting
+func (policy RetryPolicy) Validate() error {
+	if policy.MaxElapsedTime > 0 && policy.InitialDelay <= 0 {
+		return fmt.Errorf("retry policy must have a positive InitialDelay when MaxElapsedTime is set")
+	}
+	if policy.MaxDelay < 0 {
+		return fmt.Errorf("retry policy MaxDelay can't be negative")
+	}
+	return nil
+}
+
+// nextDelay returns how long to wait before the next attempt, or false if the request must not be retried.
+// attempt starts from 1 and elapsed is the time already spent on attempts and waiting.
+func (policy RetryPolicy) nextDelay(attempt int, statusCode int, header http.Header, elapsed time.Duration) (time.Duration, bool) {
+	if !isRetriableTokenStatusCode(statusCode) {
+		return 0, false
+	}
+
+	delay := policy.InitialDelay << uint(attempt-1)
+	if delay <= 0 || (policy.MaxDelay > 0 && delay > policy.MaxDelay) {
+		delay = policy.MaxDelay
+	}
+	// Retry-After is a lower bound so that "Retry-After: 0" doesn't turn into a busy loop
+	if retryAfter, ok := httputil.ParseRetryAfter(header); ok && retryAfter > delay {
+		delay = retryAfter
+	}
+
+	if delay <= 0 || elapsed+delay > policy.MaxElapsedTime {
+		return 0, false
+	}
+	return delay, true
+}
+
+func isRetriableTokenStatusCode(statusCode int) bool {
+	switch {
+	case statusCode == http.StatusNotFound, statusCode == http.StatusGone, statusCode == http.StatusTooManyRequests:
+		return true
+	case statusCode >= 500 && statusCode <= 599:
+		return true
+	default:
+		return false
+	}
+}
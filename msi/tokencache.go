@@ -0,0 +1,225 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package msi
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-extension-foundation/errorhelper"
+)
+
+const (
+	defaultRefreshFraction = 0.8
+	defaultExpiryBuffer    = 2 * time.Minute
+	minimumRefreshDelay    = time.Second
+)
+
+// TokenCacheKey identifies a cached token. At most one of ClientId, ObjectId and MsiResId may be set, none selects
+// the system assigned identity. An empty Resource selects the Azure Resource Manager audience.
+type TokenCacheKey struct {
+	ClientId string
+	ObjectId string
+	MsiResId string
+	Resource string
+}
+
+type TokenCacheOptions struct {
+	// RefreshFraction is the fraction of a token's lifetime after which it is refreshed in the background.
+	// Defaults to 0.8, a negative value disables background refresh.
+	RefreshFraction float64
+	// ExpiryBuffer is how long before its expiry a token stops being served from the cache. Defaults to 2 minutes.
+	ExpiryBuffer time.Duration
+	// TokenSource overrides the provider, e.g. a service principal or chained source. Keys can't select an identity
+	// then, the source decides which identity it authenticates as.
+	TokenSource TokenSource
+}
+
+// TokenCache serves managed identity tokens from memory and is safe for concurrent use.
+// Concurrent misses for the same key result in a single request to the provider.
+type TokenCache struct {
+	provider MsiProvider
+	options  TokenCacheOptions
+
+	mu       sync.Mutex
+	entries  map[TokenCacheKey]*tokenCacheEntry
+	inflight map[TokenCacheKey]*tokenCall
+	closed   bool
+}
+
+type tokenCacheEntry struct {
+	msi          Msi
+	expiryTime   time.Time
+	refreshTimer *time.Timer
+}
+
+type tokenCall struct {
+	done chan struct{}
+	msi  Msi
+	err  error
+}
+
+// NewTokenCache returns a cache requesting tokens from provider, or from options.TokenSource in which case provider
+// may be nil
+func NewTokenCache(provider MsiProvider, options TokenCacheOptions) *TokenCache {
+	if provider == nil && options.TokenSource == nil {
+		panic("msiProvider must be specified")
+	}
+	if options.RefreshFraction == 0 {
+		options.RefreshFraction = defaultRefreshFraction
+	}
+	if options.RefreshFraction >= 1 {
+		panic("RefreshFraction must be less than 1")
+	}
+	if options.ExpiryBuffer == 0 {
+		options.ExpiryBuffer = defaultExpiryBuffer
+	}
+	return &TokenCache{
+		provider: provider,
+		options:  options,
+		entries:  make(map[TokenCacheKey]*tokenCacheEntry),
+		inflight: make(map[TokenCacheKey]*tokenCall),
+	}
+}
+
+// Get returns the cached token for key, requesting a new one from the provider if there is none or it is about
+// to expire
+func (cache *TokenCache) Get(key TokenCacheKey) (Msi, error) {
+	key = key.resolved()
+	cache.mu.Lock()
+	if entry, ok := cache.entries[key]; ok && time.Now().Before(entry.expiryTime.Add(-cache.options.ExpiryBuffer)) {
+		cache.mu.Unlock()
+		return entry.msi, nil
+	}
+	cache.mu.Unlock()
+	return cache.fetch(key)
+}
+
+// Invalidate drops the cached token for key so that the next Get requests a new one, e.g. after the token was
+// rejected by a service
+func (cache *TokenCache) Invalidate(key TokenCacheKey) {
+	key = key.resolved()
+	cache.mu.Lock()
+	if entry, ok := cache.entries[key]; ok {
+		if entry.refreshTimer != nil {
+			entry.refreshTimer.Stop()
+		}
+		delete(cache.entries, key)
+	}
+	cache.mu.Unlock()
+	// providers caching tokens themselves, such as the persistent provider, must not serve the token again
+	if invalidator, ok := cache.provider.(interface{ Invalidate(TokenCacheKey) }); ok {
+		invalidator.Invalidate(key)
+	}
+}
+
+// Close stops all background refreshes, the cache can still be used afterwards but won't refresh proactively
+func (cache *TokenCache) Close() {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.closed = true
+	for _, entry := range cache.entries {
+		if entry.refreshTimer != nil {
+			entry.refreshTimer.Stop()
+		}
+	}
+}
+
+// fetch requests a token from the provider, joining a request already in flight for the same key
+func (cache *TokenCache) fetch(key TokenCacheKey) (Msi, error) {
+	cache.mu.Lock()
+	if call, ok := cache.inflight[key]; ok {
+		cache.mu.Unlock()
+		<-call.done
+		return call.msi, call.err
+	}
+	call := &tokenCall{done: make(chan struct{})}
+	cache.inflight[key] = call
+	cache.mu.Unlock()
+
+	call.msi, call.err = cache.requestToken(key)
+
+	cache.mu.Lock()
+	delete(cache.inflight, key)
+	if call.err == nil {
+		cache.store(key, call.msi)
+	}
+	cache.mu.Unlock()
+	close(call.done)
+	return call.msi, call.err
+}
+
+// store caches msi and schedules its background refresh, cache.mu must be held
+func (cache *TokenCache) store(key TokenCacheKey, msi Msi) {
+	if previous, ok := cache.entries[key]; ok && previous.refreshTimer != nil {
+		previous.refreshTimer.Stop()
+	}
+	expiryTime, err := msi.GetExpiryTime()
+	if err != nil {
+		// without an expiry time the token can't be served from the cache
+		delete(cache.entries, key)
+		return
+	}
+	entry := &tokenCacheEntry{msi: msi, expiryTime: expiryTime}
+	cache.entries[key] = entry
+
+	if cache.closed || cache.options.RefreshFraction < 0 {
+		return
+	}
+	lifetime := time.Until(expiryTime)
+	delay := time.Duration(float64(lifetime) * cache.options.RefreshFraction)
+	if latest := lifetime - cache.options.ExpiryBuffer; delay > latest {
+		delay = latest
+	}
+	if delay < minimumRefreshDelay {
+		return
+	}
+	entry.refreshTimer = time.AfterFunc(delay, func() {
+		// failures are ignored, the token is requested again once it expires
+		cache.fetch(key)
+	})
+}
+
+// resolved returns key with the default resource of the active cloud filled in, so that tokens cached before the
+// active cloud changed aren't served for the new default audience
+func (key TokenCacheKey) resolved() TokenCacheKey {
+	if key.Resource == "" {
+		key.Resource = defaultResource()
+	}
+	return key
+}
+
+// requestToken requests the token of a resolved key from the provider
+func (cache *TokenCache) requestToken(key TokenCacheKey) (Msi, error) {
+	resource := key.Resource
+	switch {
+	case cache.options.TokenSource != nil && countNonEmpty(key.ClientId, key.ObjectId, key.MsiResId) != 0:
+		return Msi{}, errorhelper.AddStackToError(fmt.Errorf("an identity can't be selected for tokens of a token source"))
+	case cache.options.TokenSource != nil:
+		return cache.options.TokenSource.GetToken(resource)
+	case countNonEmpty(key.ClientId, key.ObjectId, key.MsiResId) > 1:
+		return Msi{}, errorhelper.AddStackToError(fmt.Errorf("only one of client_id, object_id and msi_res_id can be specified"))
+	case key.ClientId != "":
+		return cache.provider.GetMsiUsingClientId(key.ClientId, resource)
+	case key.ObjectId != "":
+		return cache.provider.GetMsiUsingObjectId(key.ObjectId, resource)
+	case key.MsiResId != "":
+		return cache.provider.GetMsiUsingResourceId(key.MsiResId, resource)
+	case resource == defaultResource():
+		return cache.provider.GetMsi()
+	default:
+		return cache.provider.GetMsiForResource(resource)
+	}
+}
+
+func countNonEmpty(values ...string) int {
+	count := 0
+	for _, value := range values {
+		if value != "" {
+			count++
+		}
+	}
+	return count
+}
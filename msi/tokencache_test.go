@@ -0,0 +1,194 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package msi
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-extension-foundation/cloud"
+)
+
+type countingMsiProvider struct {
+	calls    int32
+	delay    time.Duration
+	lifetime time.Duration
+}
+
+func (prov *countingMsiProvider) token(identity string, resource string) (Msi, error) {
+	count := atomic.AddInt32(&prov.calls, 1)
+	time.Sleep(prov.delay)
+	return Msi{
+		AccessToken: fmt.Sprintf("%s|%s|%d", identity, resource, count),
+		ExpiresOn:   strconv.FormatInt(time.Now().Add(prov.lifetime).Unix(), 10),
+		Resource:    resource,
+	}, nil
+}
+
+func (prov *countingMsiProvider) GetMsi() (Msi, error) {
+	return prov.token("system", defaultResource())
+}
+
+func (prov *countingMsiProvider) GetMsiForResource(targetResource string) (Msi, error) {
+	return prov.token("system", targetResource)
+}
+
+func (prov *countingMsiProvider) GetMsiUsingClientId(clientId string, targetResource string) (Msi, error) {
+	return prov.token(clientId, targetResource)
+}
+
+func (prov *countingMsiProvider) GetMsiUsingObjectId(objectId string, targetResource string) (Msi, error) {
+	return prov.token(objectId, targetResource)
+}
+
+func (prov *countingMsiProvider) GetMsiUsingResourceId(msiResId string, targetResource string) (Msi, error) {
+	return prov.token(msiResId, targetResource)
+}
+
+func TestTokenCacheServesCachedToken(t *testing.T) {
+	prov := &countingMsiProvider{lifetime: time.Hour}
+	cache := NewTokenCache(prov, TokenCacheOptions{})
+	defer cache.Close()
+
+	first, err := cache.Get(TokenCacheKey{Resource: "https://storage.azure.com/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := cache.Get(TokenCacheKey{Resource: "https://storage.azure.com/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.AccessToken != second.AccessToken || prov.calls != 1 {
+		t.Fatalf("token was not served from the cache, provider calls: %d", prov.calls)
+	}
+}
+
+func TestTokenCacheInvalidateForcesNewToken(t *testing.T) {
+	prov := &countingMsiProvider{lifetime: time.Hour}
+	cache := NewTokenCache(prov, TokenCacheOptions{})
+	defer cache.Close()
+
+	key := TokenCacheKey{Resource: "https://vault.azure.net"}
+	first, err := cache.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Invalidate(key)
+	second, err := cache.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.AccessToken == second.AccessToken || prov.calls != 2 {
+		t.Fatalf("invalidated token was served from the cache, provider calls: %d", prov.calls)
+	}
+}
+
+func TestTokenCacheSeparatesIdentitiesAndResources(t *testing.T) {
+	prov := &countingMsiProvider{lifetime: time.Hour}
+	cache := NewTokenCache(prov, TokenCacheOptions{})
+	defer cache.Close()
+
+	keys := []TokenCacheKey{
+		{},
+		{Resource: "https://vault.azure.net"},
+		{ClientId: "client", Resource: "https://vault.azure.net"},
+		{ObjectId: "object", Resource: "https://vault.azure.net"},
+		{MsiResId: "/subscriptions/sub/resourcegroups/rg/providers/Microsoft.ManagedIdentity/userAssignedIdentities/id", Resource: "https://vault.azure.net"},
+	}
+	tokens := make(map[string]bool)
+	for _, key := range keys {
+		token, err := cache.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens[token.AccessToken] = true
+	}
+	if len(tokens) != len(keys) || prov.calls != int32(len(keys)) {
+		t.Fatalf("expected %d distinct tokens, got %d with %d provider calls", len(keys), len(tokens), prov.calls)
+	}
+
+	if _, err := cache.Get(TokenCacheKey{ClientId: "client", ObjectId: "object"}); err == nil {
+		t.Fatal("key with two identities was accepted")
+	}
+}
+
+func TestTokenCacheDefaultResourceFollowsActiveCloud(t *testing.T) {
+	prov := &countingMsiProvider{lifetime: time.Hour}
+	cache := NewTokenCache(prov, TokenCacheOptions{RefreshFraction: -1})
+	defer cache.Close()
+
+	if _, err := cache.Get(TokenCacheKey{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cloud.SetActiveEnvironment(cloud.AzureChinaCloud); err != nil {
+		t.Fatal(err)
+	}
+	defer cloud.SetActiveEnvironment(cloud.AzurePublicCloud)
+	token, err := cache.Get(TokenCacheKey{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Resource != cloud.AzureChinaCloud.ResourceManagerAudience || prov.calls != 2 {
+		t.Fatalf("token of the previous cloud was served: %+v", token)
+	}
+}
+
+func TestTokenCacheCollapsesConcurrentMisses(t *testing.T) {
+	prov := &countingMsiProvider{lifetime: time.Hour, delay: 50 * time.Millisecond}
+	cache := NewTokenCache(prov, TokenCacheOptions{})
+	defer cache.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := cache.Get(TokenCacheKey{ClientId: "client"}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if prov.calls != 1 {
+		t.Fatalf("concurrent misses resulted in %d provider calls", prov.calls)
+	}
+}
+
+func TestTokenCacheRefreshesExpiringToken(t *testing.T) {
+	prov := &countingMsiProvider{lifetime: time.Minute}
+	cache := NewTokenCache(prov, TokenCacheOptions{RefreshFraction: -1})
+	defer cache.Close()
+
+	cache.Get(TokenCacheKey{})
+	cache.Get(TokenCacheKey{})
+	if prov.calls != 2 {
+		t.Fatalf("token within the expiry buffer was served from the cache, provider calls: %d", prov.calls)
+	}
+}
+
+func TestTokenCacheRefreshesInBackground(t *testing.T) {
+	prov := &countingMsiProvider{lifetime: 8 * time.Second}
+	cache := NewTokenCache(prov, TokenCacheOptions{RefreshFraction: 0.25, ExpiryBuffer: time.Millisecond})
+	defer cache.Close()
+
+	first, err := cache.Get(TokenCacheKey{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(3 * time.Second)
+	if atomic.LoadInt32(&prov.calls) < 2 {
+		t.Fatal("token was not refreshed in the background")
+	}
+	second, err := cache.Get(TokenCacheKey{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.AccessToken == second.AccessToken {
+		t.Fatal("cache did not serve the refreshed token")
+	}
+}
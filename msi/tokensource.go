@@ -0,0 +1,59 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package msi
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-extension-foundation/errorhelper"
+)
+
+// TokenSource returns access tokens for a resource. The providers of this package are TokenSources of the system
+// assigned identity, other implementations authenticate as a user assigned identity or a service principal.
+type TokenSource interface {
+	GetToken(targetResource string) (Msi, error)
+}
+
+type identityTokenSource struct {
+	provider MsiProvider
+	selector IdentitySelector
+}
+
+// NewIdentityTokenSource returns a TokenSource of the user assigned identity selected by selector, or of the system
+// assigned identity if selector is empty
+func NewIdentityTokenSource(provider MsiProvider, selector IdentitySelector) TokenSource {
+	return &identityTokenSource{provider: provider, selector: selector}
+}
+
+func (source *identityTokenSource) GetToken(targetResource string) (Msi, error) {
+	if !source.selector.IsSpecified() {
+		return source.provider.GetMsiForResource(targetResource)
+	}
+	return source.selector.GetMsi(source.provider, targetResource)
+}
+
+type chainedTokenSource struct {
+	sources []TokenSource
+}
+
+// NewChainedTokenSource returns a TokenSource trying sources in order until one of them returns a token
+func NewChainedTokenSource(sources ...TokenSource) TokenSource {
+	if len(sources) == 0 {
+		panic("at least one token source must be specified")
+	}
+	return &chainedTokenSource{sources: sources}
+}
+
+func (chain *chainedTokenSource) GetToken(targetResource string) (Msi, error) {
+	failures := make([]string, 0, len(chain.sources))
+	for i, source := range chain.sources {
+		msi, err := source.GetToken(targetResource)
+		if err == nil {
+			return msi, nil
+		}
+		failures = append(failures, fmt.Sprintf("token source %d: %v", i+1, err))
+	}
+	return Msi{}, errorhelper.AddStackToError(fmt.Errorf("no token source returned a token:\n%s", strings.Join(failures, "\n")))
+}
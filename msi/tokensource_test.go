@@ -0,0 +1,71 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package msi
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type funcTokenSource func(targetResource string) (Msi, error)
+
+func (source funcTokenSource) GetToken(targetResource string) (Msi, error) {
+	return source(targetResource)
+}
+
+func TestChainedTokenSourceFallsBack(t *testing.T) {
+	failing := funcTokenSource(func(string) (Msi, error) { return Msi{}, fmt.Errorf("no identity assigned") })
+	working := funcTokenSource(func(resource string) (Msi, error) { return Msi{AccessToken: "token", Resource: resource}, nil })
+
+	msi, err := NewChainedTokenSource(failing, working).GetToken("https://vault.azure.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msi.AccessToken != "token" {
+		t.Fatalf("unexpected token %+v", msi)
+	}
+
+	_, err = NewChainedTokenSource(failing, failing).GetToken("https://vault.azure.net")
+	if err == nil || strings.Count(err.Error(), "no identity assigned") != 2 {
+		t.Fatalf("errors of all sources were not reported: %v", err)
+	}
+}
+
+func TestTokenCacheUsesTokenSource(t *testing.T) {
+	requests := 0
+	source := funcTokenSource(func(resource string) (Msi, error) {
+		requests++
+		return Msi{AccessToken: "principal|" + resource, ExpiresOn: strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)}, nil
+	})
+	cache := NewTokenCache(nil, TokenCacheOptions{TokenSource: source})
+	defer cache.Close()
+
+	for i := 0; i < 2; i++ {
+		msi, err := cache.Get(TokenCacheKey{Resource: "https://vault.azure.net"})
+		if err != nil || msi.AccessToken != "principal|https://vault.azure.net" {
+			t.Fatalf("unexpected token %+v: %v", msi, err)
+		}
+	}
+	if requests != 1 {
+		t.Fatalf("token wasn't cached, %d requests", requests)
+	}
+	if _, err := cache.Get(TokenCacheKey{ClientId: "client"}); err == nil {
+		t.Fatal("identity was selected for a token source")
+	}
+}
+
+func TestIdentityTokenSourceUsesSelector(t *testing.T) {
+	provider := &countingMsiProvider{lifetime: time.Hour}
+	msi, err := NewIdentityTokenSource(provider, IdentitySelector{ResourceId: testMsiResId}).GetToken("https://vault.azure.net")
+	if err != nil || !strings.HasPrefix(msi.AccessToken, testMsiResId+"|") {
+		t.Fatalf("user assigned identity was not used: %+v %v", msi, err)
+	}
+	msi, err = NewIdentityTokenSource(provider, IdentitySelector{}).GetToken("https://vault.azure.net")
+	if err != nil || !strings.HasPrefix(msi.AccessToken, "system|") {
+		t.Fatalf("system assigned identity was not used: %+v %v", msi, err)
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package msicredential
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-extension-foundation/errorhelper"
+	"github.com/Azure/azure-extension-foundation/msi"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+const defaultScopeSuffix = "/.default"
+
+type msiCredential struct {
+	tokenCache *msi.TokenCache
+	identity   msi.IdentitySelector
+}
+
+// NewMsiCredential returns an azcore.TokenCredential serving tokens of the identity selected by identity, or of the
+// system assigned identity if identity is empty, so Azure SDK clients can share the identity configuration of the
+// extension. Tokens are refreshed on demand, as the credential can't be closed; use NewTokenCacheCredential with a
+// cache owned by the caller for background refresh.
+func NewMsiCredential(msiProvider msi.MsiProvider, identity msi.IdentitySelector) (azcore.TokenCredential, error) {
+	if msiProvider == nil {
+		panic("msiProvider must be specified")
+	}
+	// a negative fraction disables background refresh, Azure SDK clients refresh tokens before they expire anyway
+	return NewTokenCacheCredential(msi.NewTokenCache(msiProvider, msi.TokenCacheOptions{RefreshFraction: -1}), identity)
+}
+
+// NewTokenSourceCredential returns an azcore.TokenCredential serving tokens of source, e.g. a service principal, so
+// Azure SDK clients can use the same credentials as the rest of the extension. Tokens are refreshed on demand.
+func NewTokenSourceCredential(source msi.TokenSource) (azcore.TokenCredential, error) {
+	if source == nil {
+		panic("source must be specified")
+	}
+	return NewTokenCacheCredential(msi.NewTokenCache(nil, msi.TokenCacheOptions{RefreshFraction: -1, TokenSource: source}), msi.IdentitySelector{})
+}
+
+// NewTokenCacheCredential returns an azcore.TokenCredential serving tokens from tokenCache, which may be shared with
+// other users of the cache
+func NewTokenCacheCredential(tokenCache *msi.TokenCache, identity msi.IdentitySelector) (azcore.TokenCredential, error) {
+	if tokenCache == nil {
+		panic("tokenCache must be specified")
+	}
+	if identity.IsSpecified() {
+		if err := identity.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return &msiCredential{tokenCache: tokenCache, identity: identity}, nil
+}
+
+// ScopeToResource translates an Azure AD v2 scope such as https://vault.azure.net/.default into the resource
+// managed identity endpoints expect. Managed identities only support the .default scope.
+func ScopeToResource(scope string) (string, error) {
+	if !strings.HasSuffix(scope, defaultScopeSuffix) {
+		return "", errorhelper.AddStackToError(fmt.Errorf("scope %q is not supported, managed identities only support %s scopes", scope, defaultScopeSuffix))
+	}
+	resource := strings.TrimSuffix(scope, defaultScopeSuffix)
+	if resource == "" {
+		return "", errorhelper.AddStackToError(fmt.Errorf("scope %q doesn't name a resource", scope))
+	}
+	return resource, nil
+}
+
+func (credential *msiCredential) GetToken(ctx context.Context, options policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	if len(options.Scopes) != 1 {
+		return azcore.AccessToken{}, errorhelper.AddStackToError(fmt.Errorf("managed identity tokens are requested for exactly one scope, got %d", len(options.Scopes)))
+	}
+	resource, err := ScopeToResource(options.Scopes[0])
+	if err != nil {
+		return azcore.AccessToken{}, err
+	}
+	key := credential.identity.TokenCacheKey(resource)
+	if options.Claims != "" {
+		// a claims challenge means the service rejected the cached token, managed identities can't add the claims
+		// but a new token may satisfy the service
+		credential.tokenCache.Invalidate(key)
+	}
+
+	type result struct {
+		msi msi.Msi
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		token, err := credential.tokenCache.Get(key)
+		done <- result{token, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		// the request keeps running and its token is cached for the next call
+		return azcore.AccessToken{}, ctx.Err()
+	case res := <-done:
+		if res.err != nil {
+			return azcore.AccessToken{}, res.err
+		}
+		expiryTime, err := res.msi.GetExpiryTime()
+		if err != nil {
+			return azcore.AccessToken{}, err
+		}
+		return azcore.AccessToken{Token: res.msi.AccessToken, ExpiresOn: expiryTime}, nil
+	}
+}
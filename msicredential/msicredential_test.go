@@ -0,0 +1,108 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT license.
+
+package msicredential
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-extension-foundation/httputil"
+	"github.com/Azure/azure-extension-foundation/msi"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+const testMsiResId = "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.ManagedIdentity/userAssignedIdentities/myid"
+
+func newMockProvider(t *testing.T, requests *int) msi.MsiProvider {
+	httpClient := httputil.MockHttpClient{Getfunc: func(requestUrl string, headers map[string]string) (int, []byte, error) {
+		*requests++
+		u, err := url.Parse(requestUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Query().Get("resource") != "https://vault.azure.net" || u.Query().Get("msi_res_id") != testMsiResId {
+			t.Fatalf("unexpected query %s", u.RawQuery)
+		}
+		return 200, []byte(`{"access_token":"token","expires_on":"1900000000","token_type":"Bearer"}`), nil
+	}}
+	provider := msi.NewMsiProviderForIdentitySource(&httpClient, msi.IdentitySourceImds, msi.NoRetryPolicy)
+	return &provider
+}
+
+func TestGetTokenTranslatesScopeAndExpiry(t *testing.T) {
+	requests := 0
+	credential, err := NewMsiCredential(newMockProvider(t, &requests), msi.IdentitySelector{ResourceId: testMsiResId})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		token, err := credential.GetToken(context.Background(), policy.TokenRequestOptions{Scopes: []string{"https://vault.azure.net/.default"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.Token != "token" || !token.ExpiresOn.Equal(time.Unix(1900000000, 0)) {
+			t.Fatalf("unexpected token %+v", token)
+		}
+	}
+	if requests != 1 {
+		t.Fatalf("token was not cached, %d requests", requests)
+	}
+
+	if _, err := credential.GetToken(context.Background(), policy.TokenRequestOptions{Scopes: []string{"https://vault.azure.net/.default"}, Claims: `{"access_token":{}}`}); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 2 {
+		t.Fatal("claims challenge didn't request a new token")
+	}
+}
+
+func TestTokenSourceCredential(t *testing.T) {
+	requests := 0
+	credential, err := NewTokenSourceCredential(msi.NewIdentityTokenSource(newMockProvider(t, &requests), msi.IdentitySelector{ResourceId: testMsiResId}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := credential.GetToken(context.Background(), policy.TokenRequestOptions{Scopes: []string{"https://vault.azure.net/.default"}})
+	if err != nil || token.Token != "token" || requests != 1 {
+		t.Fatalf("unexpected token %+v: %v", token, err)
+	}
+}
+
+func TestGetTokenRejectsUnsupportedScopes(t *testing.T) {
+	requests := 0
+	credential, err := NewMsiCredential(newMockProvider(t, &requests), msi.IdentitySelector{ResourceId: testMsiResId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalid := [][]string{
+		nil,
+		{"https://vault.azure.net/.default", "https://storage.azure.com/.default"},
+		{"https://storage.azure.com/user_impersonation"},
+	}
+	for _, scopes := range invalid {
+		if _, err := credential.GetToken(context.Background(), policy.TokenRequestOptions{Scopes: scopes}); err == nil {
+			t.Fatalf("scopes %v were accepted", scopes)
+		}
+	}
+	if requests != 0 {
+		t.Fatal("tokens were requested for unsupported scopes")
+	}
+}
+
+func TestScopeToResource(t *testing.T) {
+	resource, err := ScopeToResource("https://management.azure.com//.default")
+	if err != nil || resource != "https://management.azure.com/" {
+		t.Fatalf("unexpected resource %q %v", resource, err)
+	}
+}
+
+func TestNewMsiCredentialValidatesIdentity(t *testing.T) {
+	requests := 0
+	if _, err := NewMsiCredential(newMockProvider(t, &requests), msi.IdentitySelector{ClientId: "client", ObjectId: "object"}); err == nil {
+		t.Fatal("ambiguous identity was accepted")
+	}
+}
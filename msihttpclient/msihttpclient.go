@@ -5,8 +5,8 @@ package msihttpclient
 
 import (
 	"bytes"
-	"crypto/tls"
 	"fmt"
+	"github.com/Azure/azure-extension-foundation/cloud"
 	"github.com/Azure/azure-extension-foundation/errorhelper"
 	"github.com/Azure/azure-extension-foundation/httputil"
 	"github.com/Azure/azure-extension-foundation/metadata"
@@ -14,22 +14,65 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
 )
 
+const defaultVmResourceIdParameter = "vmResourceId"
+
+// MsiHttpClientOptions configures the token and the query parameter msiHttpClient adds to requests.
+// The zero value requests tokens for Azure Resource Manager, Key Vault and storage of the active cloud, see
+// cloud.ActiveEnvironment, and appends the legacy vmResourceId parameter.
+type MsiHttpClientOptions struct {
+	// Resource is the audience of the token used when no HostAudiences entry matches. When it is empty, Key Vault and
+	// storage hosts of the active cloud get tokens for their audience and other hosts for Azure Resource Manager.
+	Resource string
+	// Identity selects a user assigned identity, the system assigned identity is used when it is empty
+	Identity msi.IdentitySelector
+	// HostAudiences maps request hosts to token audiences, e.g. {"myvault.vault.azure.net": "https://vault.azure.net"}.
+	// Keys starting with a dot match any host ending with them, e.g. ".blob.core.windows.net", the longest matching
+	// key is used. Hosts are matched case insensitively.
+	HostAudiences map[string]string
+	// DisableVmResourceIdParameter stops the resource id of the virtual machine from being added to request urls
+	DisableVmResourceIdParameter bool
+	// VmResourceIdParameter is the name of the query parameter carrying the virtual machine resource id, defaults to
+	// vmResourceId
+	VmResourceIdParameter string
+	// AllowedChallengeAudiences lists audiences a 401 Bearer challenge may request for any host. Other audiences are
+	// only accepted from hosts in their domain, e.g. https://vault.azure.net from myvault.vault.azure.net.
+	AllowedChallengeAudiences []string
+	// EncodeVmResourceIdParameter escapes the resource id in the query. It is appended verbatim by default for
+	// compatibility with existing services.
+	EncodeVmResourceIdParameter bool
+	// TokenCache is a cache owned by the caller, e.g. shared by several clients and closed on shutdown, tokens are
+	// requested through it instead of msiProvider and TokenSource. By default each client caches tokens without refreshing them in the
+	// background so that dropped clients don't keep requesting tokens.
+	TokenCache *msi.TokenCache
+	// TokenSource authenticates requests with tokens of a service principal, workload identity or chain of sources
+	// instead of msiProvider, which may be nil then. Identity can't be set along with it.
+	TokenSource msi.TokenSource
+	// TLS configures the transport requests are sent with, the zero value applies the hardened defaults of
+	// httputil.TLSOptions
+	TLS httputil.TLSOptions
+	// MetadataProvider supplies the resource id of the virtual machine when no metadata is passed to the constructor.
+	// It is called for each request, so it should cache, e.g. metadata.NewCachingMetadataProvider.
+	MetadataProvider metadata.MetadataProvider
+}
+
 type msiHttpClient struct {
 	httpClient    httpClientInterface
 	retryBehavior httputil.RetryBehavior
-	msi           *msi.Msi
 	msiProvider   msi.MsiProvider
+	tokenCache    *msi.TokenCache
 	metadata      *metadata.Metadata
-}
+	options       MsiHttpClientOptions
 
-var getHttpClientFunc = func() httpClientInterface {
-	tlsConfig := &tls.Config{
-		Renegotiation: tls.RenegotiateFreelyAsClient,
-	}
+	mu sync.Mutex
+	// challengedAudiences holds the audiences requested by Bearer challenges per host
+	challengedAudiences map[string]string
+}
 
-	transport := &http.Transport{TLSClientConfig: tlsConfig}
+var getHttpClientFunc = func(transport *http.Transport) httpClientInterface {
 	return &http.Client{Transport: transport}
 }
 
@@ -37,18 +80,93 @@ type httpClientInterface interface {
 	Do(req *http.Request) (*http.Response, error)
 }
 
+// NewMsiHttpClient returns a client authenticating requests with Azure Resource Manager tokens of the system
+// assigned identity. When mdata is given the active cloud is initialized from it, see cloud.Init; the public cloud
+// is kept if it names an unknown cloud.
 func NewMsiHttpClient(msiProvider msi.MsiProvider, mdata *metadata.Metadata, retryBehavior httputil.RetryBehavior) httputil.HttpClient {
+	initCloud(mdata, nil)
+	client, err := newMsiHttpClient(msiProvider, mdata, retryBehavior, MsiHttpClientOptions{})
+	if err != nil {
+		// the default TLS options can't fail to build
+		panic(err)
+	}
+	return client
+}
+
+// NewMsiHttpClientWithOptions returns a client authenticating requests with tokens of the audience and identity
+// configured in options. The active cloud is initialized from mdata or options.MetadataProvider, see cloud.Init.
+func NewMsiHttpClientWithOptions(msiProvider msi.MsiProvider, mdata *metadata.Metadata, retryBehavior httputil.RetryBehavior, options MsiHttpClientOptions) (httputil.HttpClient, error) {
+	if options.Identity.IsSpecified() {
+		if options.TokenSource != nil {
+			return nil, errorhelper.AddStackToError(fmt.Errorf("identity can't be selected for tokens of a token source"))
+		}
+		if err := options.Identity.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if err := initCloud(mdata, options.MetadataProvider); err != nil {
+		return nil, err
+	}
+	return newMsiHttpClient(msiProvider, mdata, retryBehavior, options)
+}
+
+func newMsiHttpClient(msiProvider msi.MsiProvider, mdata *metadata.Metadata, retryBehavior httputil.RetryBehavior, options MsiHttpClientOptions) (*msiHttpClient, error) {
 	if retryBehavior == nil {
 		panic("Retry policy must be specified")
 	}
-	if msiProvider == nil {
+	if msiProvider == nil && options.TokenSource == nil && options.TokenCache == nil {
 		panic("msiProvider must be specified")
 	}
-	httpClient := getHttpClientFunc()
-	mhc := msiHttpClient{httpClient, retryBehavior, nil, msiProvider, mdata}
-	mhc.refreshMsiAuthentication()
-	return &mhc
+	if options.VmResourceIdParameter == "" {
+		options.VmResourceIdParameter = defaultVmResourceIdParameter
+	}
+	if options.HostAudiences != nil {
+		// hosts are matched in lower case, the map of the caller is left untouched
+		hostAudiences := make(map[string]string, len(options.HostAudiences))
+		for host, audience := range options.HostAudiences {
+			hostAudiences[strings.ToLower(host)] = audience
+		}
+		options.HostAudiences = hostAudiences
+	}
+	transport, err := httputil.NewHttpTransport(options.TLS)
+	if err != nil {
+		return nil, err
+	}
+	mhc := &msiHttpClient{
+		httpClient:          getHttpClientFunc(transport),
+		retryBehavior:       retryBehavior,
+		msiProvider:         msiProvider,
+		tokenCache:          options.TokenCache,
+		metadata:            mdata,
+		options:             options,
+		challengedAudiences: make(map[string]string),
+	}
+	if mhc.tokenCache == nil {
+		// a negative fraction disables background refresh, the client has no way to stop it
+		mhc.tokenCache = msi.NewTokenCache(msiProvider, msi.TokenCacheOptions{RefreshFraction: -1, TokenSource: options.TokenSource})
+	}
+	mhc.refreshMsiAuthentication(options.Resource)
+	return mhc, nil
+}
+
+// initCloud detects the active cloud from the metadata the client was given, unless it was already initialized
+func initCloud(mdata *metadata.Metadata, provider metadata.MetadataProvider) error {
+	if mdata != nil {
+		provider = staticMetadataProvider{mdata}
+	}
+	if provider == nil {
+		return nil
+	}
+	_, err := cloud.Init(provider, cloud.Settings{})
+	return err
+}
+
+type staticMetadataProvider struct {
+	mdata *metadata.Metadata
+}
 
+func (provider staticMetadataProvider) GetMetadata() (metadata.Metadata, error) {
+	return *provider.mdata, nil
 }
 
 func (client *msiHttpClient) Get(url string, headers map[string]string) (responseCode int, body []byte, err error) {
@@ -75,74 +193,193 @@ func (client *msiHttpClient) addVmIdQueryParameterToUrl(u string) (string, error
 	if err != nil {
 		return "", err
 	}
-	qParams.RawQuery = fmt.Sprintf("%s&vmResourceId=%s", qParams.RawQuery, client.metadata.GetAzureResourceId())
+	if client.options.DisableVmResourceIdParameter {
+		return qParams.String(), nil
+	}
+	mdata := client.metadata
+	if mdata == nil {
+		if client.options.MetadataProvider == nil {
+			return qParams.String(), nil
+		}
+		current, err := client.options.MetadataProvider.GetMetadata()
+		if err != nil {
+			return "", err
+		}
+		mdata = &current
+	}
+	name := client.options.VmResourceIdParameter
+	if name == "" {
+		name = defaultVmResourceIdParameter
+	}
+	if client.options.EncodeVmResourceIdParameter {
+		// only the new pair is escaped, the query of the caller such as a SAS token is kept as is
+		qParams.RawQuery = fmt.Sprintf("%s&%s=%s", qParams.RawQuery, url.QueryEscape(name), url.QueryEscape(mdata.GetAzureResourceId()))
+	} else {
+		qParams.RawQuery = fmt.Sprintf("%s&%s=%s", qParams.RawQuery, name, mdata.GetAzureResourceId())
+	}
 	return qParams.String(), nil
 }
 
-func (client *msiHttpClient) refreshMsiAuthentication() error {
-
-	if client.msi == nil {
-		myMsi, err := client.msiProvider.GetMsi()
-		if err != nil {
-			return err
+// audienceForUrl returns the token audience configured for the host of u
+func (client *msiHttpClient) audienceForUrl(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return client.options.Resource
+	}
+	host := strings.ToLower(parsed.Hostname())
+	// the audiences configured by the caller win over those requested by challenges
+	if audience, ok := client.options.HostAudiences[host]; ok {
+		return audience
+	}
+	// the most specific suffix wins, e.g. ".vault.azure.net" over ".azure.net"
+	longest, audience := "", ""
+	for suffix, candidate := range client.options.HostAudiences {
+		if strings.HasPrefix(suffix, ".") && strings.HasSuffix(host, suffix) && len(suffix) > len(longest) {
+			longest, audience = suffix, candidate
 		}
-		client.msi = &myMsi
-	} else {
-		tokenExpired, err := client.msi.IsMsiTokenExpired()
-		if err != nil {
-			return err
+	}
+	if longest != "" {
+		return audience
+	}
+	client.mu.Lock()
+	audience, ok := client.challengedAudiences[host]
+	client.mu.Unlock()
+	if ok {
+		return audience
+	}
+	if client.options.Resource == "" {
+		if audience, ok := cloud.ActiveEnvironment().AudienceForHost(host); ok {
+			return audience
 		}
-		if tokenExpired {
-			myMsi, err := client.msiProvider.GetMsi()
-			if err != nil {
-				return err
-			}
-			client.msi = &myMsi
+	}
+	return client.options.Resource
+}
+
+// acceptChallengeAudience returns true if a Bearer challenge from host may request tokens for audience. Tokens of
+// other audiences must not be handed to the host, which could use them against those services.
+func (client *msiHttpClient) acceptChallengeAudience(host string, audience string) bool {
+	for _, allowed := range client.options.AllowedChallengeAudiences {
+		if sameAudience(allowed, audience) {
+			return true
 		}
 	}
-	return nil
+	// services of the active cloud whose audience isn't in their domain, e.g. https://storage.azure.com for blobs
+	if cloudAudience, ok := cloud.ActiveEnvironment().AudienceForHost(host); ok && sameAudience(cloudAudience, audience) {
+		return true
+	}
+	parsed, err := url.Parse(audience)
+	if err != nil || parsed.Scheme != "https" || parsed.Hostname() == "" {
+		return false
+	}
+	audienceHost := strings.ToLower(parsed.Hostname())
+	host = strings.ToLower(host)
+	return host == audienceHost || strings.HasSuffix(host, "."+audienceHost)
 }
 
-func (client *msiHttpClient) setMsiAuthenticationHeader(request *http.Request) {
-	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", client.msi.AccessToken))
+// acceptChallengeAuthority returns true if a Bearer challenge names no authority or the one of the active cloud,
+// managed identity tokens can't be issued by another authority so such challenges are not followed
+func acceptChallengeAuthority(authorizationUri string) bool {
+	if authorizationUri == "" {
+		return true
+	}
+	challenged, err := url.Parse(authorizationUri)
+	if err != nil {
+		return false
+	}
+	return cloud.ActiveEnvironment().IsAuthorityHost(challenged.Hostname())
 }
 
-func (client *msiHttpClient) issueRequest(operation string, url string, headers map[string]string, payload *bytes.Buffer) (int, []byte, error) {
-	// add query parameter for vmId
-	modifiedUrl, err := client.addVmIdQueryParameterToUrl(url)
+func sameAudience(a string, b string) bool {
+	return strings.EqualFold(strings.TrimSuffix(a, "/"), strings.TrimSuffix(b, "/"))
+}
+
+// handleUnauthorized refreshes the token rejected with res, switching to the audience of the Bearer challenge if
+// there is an acceptable one, and replays request once
+func (client *msiHttpClient) handleUnauthorized(request *http.Request, res *http.Response, audience string) (*http.Response, string, error) {
+	res.Body.Close()
+	host := strings.ToLower(request.URL.Hostname())
+	rejectedAudience := audience
+	if challenge, ok := httputil.ParseBearerChallenge(res.Header); ok {
+		resource := challenge.Resource()
+		if resource != "" && resource != audience && acceptChallengeAuthority(challenge.AuthorizationUri) && client.acceptChallengeAudience(host, resource) {
+			client.mu.Lock()
+			client.challengedAudiences[host] = resource
+			client.mu.Unlock()
+			audience = resource
+		}
+	}
+	if audience == rejectedAudience {
+		client.tokenCache.Invalidate(client.options.Identity.TokenCacheKey(audience))
+	}
+	token, err := client.refreshMsiAuthentication(audience)
 	if err != nil {
-		return -1, nil, errorhelper.AddStackToError(err)
+		return nil, audience, err
 	}
-	request, err := http.NewRequest(operation, modifiedUrl, nil)
-	if payload != nil && payload.Len() != 0 {
-		request, err = http.NewRequest(operation, modifiedUrl, payload)
+	client.setMsiAuthenticationHeader(request, token)
+	if err := httputil.RewindRequestBody(request); err != nil {
+		return nil, audience, err
 	}
+	res, err = client.httpClient.Do(request)
+	return res, audience, err
+}
 
-	// Initialize and refresh msi as required
-	err = client.refreshMsiAuthentication()
+// refreshMsiAuthentication returns the cached token for resource, requesting a new one if it is about to expire
+func (client *msiHttpClient) refreshMsiAuthentication(resource string) (msi.Msi, error) {
+	return client.tokenCache.Get(client.options.Identity.TokenCacheKey(resource))
+}
+
+func (client *msiHttpClient) setMsiAuthenticationHeader(request *http.Request, token msi.Msi) {
+	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token.AccessToken))
+}
+
+// Do issues the request described by spec with the managed identity bearer token, unless spec already carries an
+// Authorization header
+func (client *msiHttpClient) Do(spec httputil.RequestSpec) (*httputil.Response, error) {
+	// add query parameter for vmId
+	modifiedUrl, err := client.addVmIdQueryParameterToUrl(spec.URL)
 	if err != nil {
-		return -1, nil, errorhelper.AddStackToError(err)
+		return nil, errorhelper.AddStackToError(err)
 	}
-	// Add authorization if required
-	client.setMsiAuthenticationHeader(request)
+	spec.URL = modifiedUrl
+	request, err := httputil.NewHttpRequest(spec)
+	if err != nil {
+		return nil, errorhelper.AddStackToError(err)
+	}
+	useMsiAuthentication := request.Header.Get("Authorization") == ""
+	audience := client.audienceForUrl(spec.URL)
 
-	// add headers
-	for key, value := range headers {
-		request.Header.Set(key, value)
+	if useMsiAuthentication {
+		// Initialize and refresh msi as required
+		token, err := client.refreshMsiAuthentication(audience)
+		if err != nil {
+			return nil, errorhelper.AddStackToError(err)
+		}
+		// Add authorization if required
+		client.setMsiAuthenticationHeader(request, token)
 	}
 
 	res, err := client.httpClient.Do(request)
+	if err == nil && useMsiAuthentication && res.StatusCode == http.StatusUnauthorized {
+		// the token may have been revoked or requested for the wrong audience
+		res, audience, err = client.handleUnauthorized(request, res, audience)
+	}
 	if err == nil && httputil.IsSuccessStatusCode(res.StatusCode) {
 		// no need to retry
 	} else if err == nil && res != nil {
 		for i := 1; client.retryBehavior(res.StatusCode, i); i++ {
-			// Initialize as refresh msi as required
-			err = client.refreshMsiAuthentication()
-			if err != nil {
-				return -1, nil, errorhelper.AddStackToError(err)
+			res.Body.Close()
+			if useMsiAuthentication {
+				// Initialize as refresh msi as required
+				token, err := client.refreshMsiAuthentication(audience)
+				if err != nil {
+					return nil, errorhelper.AddStackToError(err)
+				}
+				// Add authorization if required
+				client.setMsiAuthenticationHeader(request, token)
+			}
+			if err = httputil.RewindRequestBody(request); err != nil {
+				break
 			}
-			// Add authorization if required
-			client.setMsiAuthenticationHeader(request)
 			res, err = client.httpClient.Do(request)
 			if err != nil {
 				break
@@ -151,7 +388,23 @@ func (client *msiHttpClient) issueRequest(operation string, url string, headers
 	}
 
 	if err != nil {
-		return -1, nil, errorhelper.AddStackToError(err)
+		return nil, errorhelper.AddStackToError(err)
+	}
+	return &httputil.Response{StatusCode: res.StatusCode, Header: res.Header, Body: res.Body}, nil
+}
+
+func (client *msiHttpClient) issueRequest(operation string, url string, headers map[string]string, payload *bytes.Buffer) (int, []byte, error) {
+	spec := httputil.RequestSpec{Method: operation, URL: url, Header: http.Header{}}
+	for key, value := range headers {
+		spec.Header.Set(key, value)
+	}
+	if payload != nil && payload.Len() != 0 {
+		spec.Body = payload
+	}
+
+	res, err := client.Do(spec)
+	if err != nil {
+		return -1, nil, err
 	}
 
 	body, err := ioutil.ReadAll(res.Body)
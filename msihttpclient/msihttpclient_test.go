@@ -4,7 +4,9 @@
 package msihttpclient
 
 import (
+	"crypto/tls"
 	"fmt"
+	"github.com/Azure/azure-extension-foundation/cloud"
 	"github.com/Azure/azure-extension-foundation/httputil"
 	"github.com/Azure/azure-extension-foundation/metadata"
 	"github.com/Azure/azure-extension-foundation/msi"
@@ -12,6 +14,7 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -44,8 +47,17 @@ func (prov *mockMsiProvider) GetMsi() (msi.Msi, error) {
 	return *prov.dummyMsi, nil
 }
 
+func (prov *mockMsiProvider) resourceToken(identity string, targetResource string) (msi.Msi, error) {
+	prov.timesInvoked++
+	return msi.Msi{
+		AccessToken: identity + "|" + targetResource,
+		ExpiresOn:   strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10),
+		Resource:    targetResource,
+	}, nil
+}
+
 func (prov *mockMsiProvider) GetMsiForResource(targetResource string) (msi.Msi, error) {
-	return msi.Msi{}, nil
+	return prov.resourceToken("system", targetResource)
 }
 
 func (prov *mockMsiProvider) GetMsiUsingClientId(clientId string, targetResource string) (msi.Msi, error) {
@@ -56,6 +68,10 @@ func (prov *mockMsiProvider) GetMsiUsingObjectId(objectId string, targetResource
 	return msi.Msi{}, nil
 }
 
+func (prov *mockMsiProvider) GetMsiUsingResourceId(msiResId string, targetResource string) (msi.Msi, error) {
+	return prov.resourceToken(msiResId, targetResource)
+}
+
 type mockHttpClient struct {
 	AttemptCount *int
 	DoFunc       func(i *int, req *http.Request) (*http.Response, error)
@@ -84,7 +100,7 @@ var mdata = metadata.Metadata{
 
 func TestAddVmIdQueryParameterToUrl(t *testing.T) {
 	dummyMsi := getDummyMsiFunc()
-	getHttpClientFunc = func() httpClientInterface {
+	getHttpClientFunc = func(*http.Transport) httpClientInterface {
 		return &mockHttpClient{
 			DoFunc: func(i *int, req *http.Request) (*http.Response, error) {
 				authorization := req.Header.Get("Authorization")
@@ -95,7 +111,7 @@ func TestAddVmIdQueryParameterToUrl(t *testing.T) {
 			},
 		}
 	}
-	msiHttp := msiHttpClient{httpClient: getHttpClientFunc(), retryBehavior: httputil.DefaultRetryBehavior, msiProvider: &mockMsiProvider{timesInvoked: 0}, metadata: &mdata}
+	msiHttp := msiHttpClient{httpClient: getHttpClientFunc(nil), retryBehavior: httputil.DefaultRetryBehavior, msiProvider: &mockMsiProvider{timesInvoked: 0}, metadata: &mdata}
 	modifiedUrl, err := msiHttp.addVmIdQueryParameterToUrl("http://foo.bar.com?query1=val1&query2=val2&speed=100")
 	if err != nil {
 		t.Fatal(err)
@@ -113,7 +129,7 @@ func TestAddVmIdQueryParameterToUrl(t *testing.T) {
 
 func TestNewMsiHttpClientHeaders(t *testing.T) {
 	dummyMsi := getDummyMsiFunc()
-	getHttpClientFunc = func() httpClientInterface {
+	getHttpClientFunc = func(*http.Transport) httpClientInterface {
 		return &mockHttpClient{
 			DoFunc: func(i *int, req *http.Request) (*http.Response, error) {
 				authorization := req.Header.Get("Authorization")
@@ -131,7 +147,7 @@ func TestNewMsiHttpClientHeaders(t *testing.T) {
 func TestRetryLogic(t *testing.T) {
 	mockMsi := mockMsiProvider{timesInvoked: 0}
 	i := 0
-	getHttpClientFunc = func() httpClientInterface {
+	getHttpClientFunc = func(*http.Transport) httpClientInterface {
 		return &mockHttpClient{
 			AttemptCount: &i,
 			DoFunc: func(i *int, req *http.Request) (*http.Response, error) {
@@ -151,3 +167,465 @@ func TestRetryLogic(t *testing.T) {
 		t.Fatal("retry logic didn't invoke msiProvider for retries")
 	}
 }
+
+func TestDoKeepsCallerAuthorization(t *testing.T) {
+	mockMsi := mockMsiProvider{timesInvoked: 0}
+	getHttpClientFunc = func(*http.Transport) httpClientInterface {
+		return &mockHttpClient{
+			DoFunc: func(i *int, req *http.Request) (*http.Response, error) {
+				if req.Method != httputil.OperationHead {
+					t.Fatalf("unexpected method %s", req.Method)
+				}
+				if req.Header.Get("Authorization") != "SharedKey foo" {
+					t.Fatal("caller authorization header was replaced")
+				}
+				return &http.Response{StatusCode: 200, Header: http.Header{"Content-Length": {"10"}}, Body: noBody{}}, nil
+			},
+		}
+	}
+	msiHttp := NewMsiHttpClient(&mockMsi, &mdata, httputil.NoRetry)
+	invokedByConstructor := mockMsi.timesInvoked
+
+	res, err := msiHttp.Do(httputil.RequestSpec{
+		Method: httputil.OperationHead,
+		URL:    "http://foo.bar.com/blob",
+		Header: http.Header{"Authorization": {"SharedKey foo"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.Header.Get("Content-Length") != "10" {
+		t.Fatal("response headers were not returned")
+	}
+	if mockMsi.timesInvoked != invokedByConstructor {
+		t.Fatal("msi token was requested although the caller supplied authorization")
+	}
+}
+
+func TestRequestsUseTokenOfHostAudience(t *testing.T) {
+	const msiResId = "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.ManagedIdentity/userAssignedIdentities/myid"
+	expected := map[string]string{
+		"myvault.vault.azure.net":       msiResId + "|https://vault.azure.net",
+		"account.blob.core.windows.net": msiResId + "|https://storage.azure.com/",
+		"management.azure.com":          msiResId + "|https://management.azure.com/",
+	}
+	getHttpClientFunc = func(*http.Transport) httpClientInterface {
+		return &mockHttpClient{
+			DoFunc: func(i *int, req *http.Request) (*http.Response, error) {
+				if req.Header.Get("Authorization") != "Bearer "+expected[req.URL.Host] {
+					t.Fatalf("unexpected authorization %s for %s", req.Header.Get("Authorization"), req.URL.Host)
+				}
+				if len(req.URL.Query()) != 0 {
+					t.Fatalf("unexpected query %s", req.URL.RawQuery)
+				}
+				return &http.Response{StatusCode: 200, Body: noBody{}}, nil
+			},
+		}
+	}
+	msiHttp, err := NewMsiHttpClientWithOptions(&mockMsiProvider{}, &mdata, httputil.NoRetry, MsiHttpClientOptions{
+		Resource: "https://management.azure.com/",
+		Identity: msi.IdentitySelector{ResourceId: msiResId},
+		HostAudiences: map[string]string{
+			"myvault.vault.azure.net": "https://vault.azure.net",
+			".blob.core.windows.net":  "https://storage.azure.com/",
+		},
+		DisableVmResourceIdParameter: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host := range expected {
+		if _, _, err := msiHttp.Get("https://"+host+"/path", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestVmResourceIdParameterOptions(t *testing.T) {
+	msiHttp := msiHttpClient{metadata: &mdata, options: MsiHttpClientOptions{VmResourceIdParameter: "vm", EncodeVmResourceIdParameter: true}}
+	modifiedUrl, err := msiHttp.addVmIdQueryParameterToUrl("http://foo.bar.com/path?query1=val1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(modifiedUrl)
+	if u.Query().Get("vm") != mdata.GetAzureResourceId() || u.Query().Get("query1") != "val1" {
+		t.Fatalf("unexpected url %s", modifiedUrl)
+	}
+	if u.Query().Get("vmResourceId") != "" || strings.Contains(u.RawQuery, "/") {
+		t.Fatalf("resource id was not encoded under the configured name: %s", modifiedUrl)
+	}
+
+	msiHttp.options.DisableVmResourceIdParameter = true
+	modifiedUrl, _ = msiHttp.addVmIdQueryParameterToUrl("http://foo.bar.com/path?query1=val1")
+	if modifiedUrl != "http://foo.bar.com/path?query1=val1" {
+		t.Fatalf("parameter was added although it is disabled: %s", modifiedUrl)
+	}
+}
+
+func TestNewMsiHttpClientWithOptionsValidatesIdentity(t *testing.T) {
+	_, err := NewMsiHttpClientWithOptions(&mockMsiProvider{}, &mdata, httputil.NoRetry, MsiHttpClientOptions{
+		Identity: msi.IdentitySelector{ClientId: "client", ObjectId: "object"},
+	})
+	if err == nil {
+		t.Fatal("ambiguous identity was accepted")
+	}
+}
+
+func TestUnauthorizedRefreshesTokenAndReplays(t *testing.T) {
+	mockMsi := mockMsiProvider{}
+	var authorizations []string
+	getHttpClientFunc = func(*http.Transport) httpClientInterface {
+		return &mockHttpClient{
+			DoFunc: func(i *int, req *http.Request) (*http.Response, error) {
+				authorizations = append(authorizations, req.Header.Get("Authorization"))
+				if len(authorizations) == 1 {
+					return &http.Response{StatusCode: 401, Header: http.Header{}, Body: noBody{}}, nil
+				}
+				return &http.Response{StatusCode: 200, Body: noBody{}}, nil
+			},
+		}
+	}
+	msiHttp, err := NewMsiHttpClientWithOptions(&mockMsi, &mdata, httputil.NoRetry, MsiHttpClientOptions{Resource: "https://management.azure.com/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	invokedByConstructor := mockMsi.timesInvoked
+
+	code, _, err := msiHttp.Get("https://management.azure.com/subscriptions", nil)
+	if err != nil || code != 200 {
+		t.Fatalf("request was not replayed: %v %v", code, err)
+	}
+	if len(authorizations) != 2 || mockMsi.timesInvoked != invokedByConstructor+1 {
+		t.Fatalf("token was not refreshed before the replay, provider calls: %d", mockMsi.timesInvoked)
+	}
+}
+
+func TestUnauthorizedSwitchesToChallengedAudience(t *testing.T) {
+	var authorizations []string
+	getHttpClientFunc = func(*http.Transport) httpClientInterface {
+		return &mockHttpClient{
+			DoFunc: func(i *int, req *http.Request) (*http.Response, error) {
+				authorization := req.Header.Get("Authorization")
+				authorizations = append(authorizations, authorization)
+				if authorization != "Bearer system|https://vault.azure.net" {
+					header := http.Header{"Www-Authenticate": {`Bearer authorization="https://login.microsoftonline.com/tenant", resource="https://vault.azure.net"`}}
+					return &http.Response{StatusCode: 401, Header: header, Body: noBody{}}, nil
+				}
+				return &http.Response{StatusCode: 200, Body: noBody{}}, nil
+			},
+		}
+	}
+	msiHttp, err := NewMsiHttpClientWithOptions(&mockMsiProvider{}, &mdata, httputil.NoRetry, MsiHttpClientOptions{
+		Resource:                     "https://management.azure.com/",
+		DisableVmResourceIdParameter: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		code, _, err := msiHttp.Get("https://myvault.vault.azure.net/secrets/foo", nil)
+		if err != nil || code != 200 {
+			t.Fatalf("request was not replayed with the challenged audience: %v %v", code, err)
+		}
+	}
+	if len(authorizations) != 3 {
+		t.Fatalf("challenged audience was not remembered for the host: %v", authorizations)
+	}
+}
+
+func TestUnauthorizedIgnoresForeignChallengedAudience(t *testing.T) {
+	var authorizations []string
+	getHttpClientFunc = func(*http.Transport) httpClientInterface {
+		return &mockHttpClient{
+			DoFunc: func(i *int, req *http.Request) (*http.Response, error) {
+				authorizations = append(authorizations, req.Header.Get("Authorization"))
+				header := http.Header{"Www-Authenticate": {`Bearer resource="https://vault.azure.net"`}}
+				return &http.Response{StatusCode: 401, Header: header, Body: noBody{}}, nil
+			},
+		}
+	}
+	msiHttp, err := NewMsiHttpClientWithOptions(&mockMsiProvider{}, &mdata, httputil.NoRetry, MsiHttpClientOptions{
+		Resource:                     "https://storage.azure.com/",
+		DisableVmResourceIdParameter: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, _, err := msiHttp.Get("https://evil.example.com/", nil)
+	if err != nil || code != 401 {
+		t.Fatalf("unexpected response %v %v", code, err)
+	}
+	for _, authorization := range authorizations {
+		if strings.Contains(authorization, "vault.azure.net") {
+			t.Fatalf("token for a foreign audience was sent: %v", authorizations)
+		}
+	}
+	if len(authorizations) != 2 {
+		t.Fatalf("request was not replayed exactly once: %v", authorizations)
+	}
+}
+
+func TestUnauthorizedAcceptsStorageAudienceOfActiveCloud(t *testing.T) {
+	var authorizations []string
+	getHttpClientFunc = func(*http.Transport) httpClientInterface {
+		return &mockHttpClient{
+			DoFunc: func(i *int, req *http.Request) (*http.Response, error) {
+				authorization := req.Header.Get("Authorization")
+				authorizations = append(authorizations, authorization)
+				if authorization != "Bearer system|https://storage.azure.com" {
+					header := http.Header{"Www-Authenticate": {`Bearer authorization_uri=https://login.microsoftonline.com/tenant/oauth2/authorize resource_id=https://storage.azure.com`}}
+					return &http.Response{StatusCode: 401, Header: header, Body: noBody{}}, nil
+				}
+				return &http.Response{StatusCode: 200, Body: noBody{}}, nil
+			},
+		}
+	}
+	msiHttp, err := NewMsiHttpClientWithOptions(&mockMsiProvider{}, &mdata, httputil.NoRetry, MsiHttpClientOptions{
+		Resource:                     "https://management.azure.com/",
+		DisableVmResourceIdParameter: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, _, err := msiHttp.Get("https://account.blob.core.windows.net/container/blob", nil)
+	if err != nil || code != 200 || len(authorizations) != 2 {
+		t.Fatalf("request was not replayed with the storage audience: %v %v %v", code, err, authorizations)
+	}
+	if _, _, err := msiHttp.Get("https://account.blob.core.windows.net.example.com/container/blob", nil); err != nil {
+		t.Fatal(err)
+	}
+	if last := authorizations[len(authorizations)-1]; last == "Bearer system|https://storage.azure.com" {
+		t.Fatal("storage token was sent to a host outside the storage domain")
+	}
+}
+
+func TestUnauthorizedAcceptsAuthorityAlias(t *testing.T) {
+	var authorizations []string
+	getHttpClientFunc = func(*http.Transport) httpClientInterface {
+		return &mockHttpClient{
+			DoFunc: func(i *int, req *http.Request) (*http.Response, error) {
+				authorization := req.Header.Get("Authorization")
+				authorizations = append(authorizations, authorization)
+				if authorization != "Bearer system|https://vault.azure.net" {
+					header := http.Header{"Www-Authenticate": {`Bearer authorization="https://login.windows.net/00000000-0000-0000-0000-000000000000", resource="https://vault.azure.net"`}}
+					return &http.Response{StatusCode: 401, Header: header, Body: noBody{}}, nil
+				}
+				return &http.Response{StatusCode: 200, Body: noBody{}}, nil
+			},
+		}
+	}
+	msiHttp, err := NewMsiHttpClientWithOptions(&mockMsiProvider{}, &mdata, httputil.NoRetry, MsiHttpClientOptions{
+		Resource:                     "https://management.azure.com/",
+		DisableVmResourceIdParameter: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code, _, err := msiHttp.Get("https://myvault.vault.azure.net/secrets/foo", nil); err != nil || code != 200 {
+		t.Fatalf("challenge naming login.windows.net wasn't followed: %v %v %v", code, err, authorizations)
+	}
+}
+
+func TestUnauthorizedIgnoresChallengeOfForeignAuthority(t *testing.T) {
+	var authorizations []string
+	getHttpClientFunc = func(*http.Transport) httpClientInterface {
+		return &mockHttpClient{
+			DoFunc: func(i *int, req *http.Request) (*http.Response, error) {
+				authorizations = append(authorizations, req.Header.Get("Authorization"))
+				header := http.Header{"Www-Authenticate": {`Bearer authorization="https://login.example.com/tenant", resource="https://vault.azure.net"`}}
+				return &http.Response{StatusCode: 401, Header: header, Body: noBody{}}, nil
+			},
+		}
+	}
+	msiHttp, err := NewMsiHttpClientWithOptions(&mockMsiProvider{}, &mdata, httputil.NoRetry, MsiHttpClientOptions{
+		Resource:                     "https://management.azure.com/",
+		DisableVmResourceIdParameter: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code, _, err := msiHttp.Get("https://myvault.vault.azure.net/secrets/foo", nil); err != nil || code != 401 {
+		t.Fatalf("unexpected response %v %v", code, err)
+	}
+	for _, authorization := range authorizations {
+		if strings.Contains(authorization, "vault.azure.net") {
+			t.Fatalf("challenge of a foreign authority was followed: %v", authorizations)
+		}
+	}
+}
+
+type fakeMetadataProvider struct {
+	calls int
+}
+
+func (provider *fakeMetadataProvider) GetMetadata() (metadata.Metadata, error) {
+	provider.calls++
+	return mdata, nil
+}
+
+func TestVmResourceIdFromMetadataProvider(t *testing.T) {
+	provider := &fakeMetadataProvider{}
+	msiHttp := msiHttpClient{options: MsiHttpClientOptions{MetadataProvider: provider}}
+	modifiedUrl, err := msiHttp.addVmIdQueryParameterToUrl("http://foo.bar.com/path?query1=val1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(modifiedUrl, "&vmResourceId="+mdata.GetAzureResourceId()) || provider.calls != 1 {
+		t.Fatalf("unexpected url %s", modifiedUrl)
+	}
+}
+
+func TestAudienceOfActiveCloud(t *testing.T) {
+	if err := cloud.SetActiveEnvironment(cloud.AzureChinaCloud); err != nil {
+		t.Fatal(err)
+	}
+	defer cloud.SetActiveEnvironment(cloud.AzurePublicCloud)
+	client := msiHttpClient{challengedAudiences: map[string]string{}}
+	for u, expected := range map[string]string{
+		"https://myvault.vault.azure.cn/secrets/s":             "https://vault.azure.cn",
+		"https://account.blob.core.chinacloudapi.cn/container": "https://storage.azure.com/",
+		"https://management.chinacloudapi.cn/subscriptions":    "https://management.core.chinacloudapi.cn/",
+		"https://myvault.vault.azure.net/secrets/s":            "",
+	} {
+		if audience := client.audienceForUrl(u); audience != expected {
+			t.Fatalf("unexpected audience %q for %s", audience, u)
+		}
+	}
+
+	client.options.Resource = "api://app"
+	if audience := client.audienceForUrl("https://myvault.vault.azure.cn/secrets/s"); audience != "api://app" {
+		t.Fatalf("configured resource was overridden by %s", audience)
+	}
+}
+
+func TestHostAudiencesPreferLongestSuffix(t *testing.T) {
+	client, _ := newMsiHttpClient(&mockMsiProvider{}, &mdata, httputil.NoRetry, MsiHttpClientOptions{
+		Resource: "https://management.azure.com/",
+		HostAudiences: map[string]string{
+			".azure.net":          "api://azure",
+			".vault.azure.net":    "https://vault.azure.net",
+			"MyVault.Example.com": "api://example",
+		},
+	})
+	// map iteration order is random, repeat to catch order dependent matches
+	for i := 0; i < 20; i++ {
+		for u, expected := range map[string]string{
+			"https://myvault.vault.azure.net/secrets/s": "https://vault.azure.net",
+			"https://other.azure.net/":                  "api://azure",
+			"https://myvault.example.com/":              "api://example",
+			"https://example.com/":                      "https://management.azure.com/",
+		} {
+			if audience := client.audienceForUrl(u); audience != expected {
+				t.Fatalf("unexpected audience %q for %s", audience, u)
+			}
+		}
+	}
+}
+
+type funcTokenSource func(targetResource string) (msi.Msi, error)
+
+func (source funcTokenSource) GetToken(targetResource string) (msi.Msi, error) {
+	return source(targetResource)
+}
+
+func TestTokenSourceAuthenticatesRequests(t *testing.T) {
+	var authorization string
+	getHttpClientFunc = func(*http.Transport) httpClientInterface {
+		return &mockHttpClient{
+			DoFunc: func(i *int, req *http.Request) (*http.Response, error) {
+				authorization = req.Header.Get("Authorization")
+				return &http.Response{StatusCode: 200, Body: noBody{}}, nil
+			},
+		}
+	}
+	source := funcTokenSource(func(resource string) (msi.Msi, error) {
+		return msi.Msi{AccessToken: "principal|" + resource, ExpiresOn: strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)}, nil
+	})
+	client, err := NewMsiHttpClientWithOptions(nil, nil, httputil.NoRetry, MsiHttpClientOptions{TokenSource: source})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _, err := client.Get("https://myvault.vault.azure.net/secrets/s", nil); err != nil || code != 200 {
+		t.Fatalf("request failed with %d: %v", code, err)
+	}
+	if authorization != "Bearer principal|https://vault.azure.net" {
+		t.Fatalf("token of the source wasn't used: %q", authorization)
+	}
+
+	if _, err := NewMsiHttpClientWithOptions(nil, nil, httputil.NoRetry, MsiHttpClientOptions{
+		TokenSource: source,
+		Identity:    msi.IdentitySelector{ClientId: "client"},
+	}); err == nil {
+		t.Fatal("identity was selected for a token source")
+	}
+}
+
+func TestTLSOptionsConfigureTransport(t *testing.T) {
+	var tlsConfig *tls.Config
+	getHttpClientFunc = func(transport *http.Transport) httpClientInterface {
+		tlsConfig = transport.TLSClientConfig
+		return &mockHttpClient{}
+	}
+	if _, err := NewMsiHttpClientWithOptions(&mockMsiProvider{}, &mdata, httputil.NoRetry, MsiHttpClientOptions{TLS: httputil.TLSOptions{MinVersion: tls.VersionTLS13}}); err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig == nil || tlsConfig.MinVersion != tls.VersionTLS13 {
+		t.Fatalf("tls options weren't applied: %+v", tlsConfig)
+	}
+	if _, err := NewMsiHttpClientWithOptions(&mockMsiProvider{}, &mdata, httputil.NoRetry, MsiHttpClientOptions{TLS: httputil.TLSOptions{MinVersion: tls.VersionTLS10}}); err == nil {
+		t.Fatal("invalid tls options were accepted")
+	}
+}
+
+func TestEncodedVmResourceIdKeepsQuery(t *testing.T) {
+	msiHttp := msiHttpClient{metadata: &mdata, options: MsiHttpClientOptions{EncodeVmResourceIdParameter: true}}
+	sas := "sv=2021-08-06&sr=b&sp=r&sig=a%2Bb%2Fc%3D"
+	modifiedUrl, err := msiHttp.addVmIdQueryParameterToUrl("https://account.blob.core.windows.net/c/b?" + sas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(modifiedUrl)
+	if !strings.HasPrefix(u.RawQuery, sas+"&vmResourceId=") || u.Query().Get("vmResourceId") != mdata.GetAzureResourceId() {
+		t.Fatalf("query of the caller was rewritten: %s", modifiedUrl)
+	}
+}
+
+func TestHostAudiencesWinOverChallengedAudiences(t *testing.T) {
+	client, _ := newMsiHttpClient(&mockMsiProvider{}, &mdata, httputil.NoRetry, MsiHttpClientOptions{
+		HostAudiences: map[string]string{"myvault.vault.azure.net": "https://vault.azure.net"},
+	})
+	client.challengedAudiences["myvault.vault.azure.net"] = "https://other.azure.net"
+	client.challengedAudiences["account.blob.core.windows.net"] = "https://storage.azure.com"
+	if audience := client.audienceForUrl("https://myvault.vault.azure.net/secrets/s"); audience != "https://vault.azure.net" {
+		t.Fatalf("challenged audience %q overrode the configured one", audience)
+	}
+	if audience := client.audienceForUrl("https://account.blob.core.windows.net/c"); audience != "https://storage.azure.com" {
+		t.Fatalf("challenged audience wasn't used: %q", audience)
+	}
+}
+
+func TestCallerOwnedTokenCache(t *testing.T) {
+	owned := &mockMsiProvider{}
+	cache := msi.NewTokenCache(owned, msi.TokenCacheOptions{})
+	defer cache.Close()
+	unused := &mockMsiProvider{}
+	client, err := NewMsiHttpClientWithOptions(unused, &mdata, httputil.NoRetry, MsiHttpClientOptions{
+		Resource:   "https://management.azure.com/",
+		TokenCache: cache,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owned.timesInvoked != 1 || unused.timesInvoked != 0 {
+		t.Fatalf("tokens weren't requested through the cache, %d and %d requests", owned.timesInvoked, unused.timesInvoked)
+	}
+	if token, err := client.(*msiHttpClient).refreshMsiAuthentication("https://management.azure.com/"); err != nil || token.AccessToken != "system|https://management.azure.com/" {
+		t.Fatalf("unexpected token %+v: %v", token, err)
+	}
+}